@@ -0,0 +1,630 @@
+/*
+Alerting. AlertRules are checked by the lighthouse, each firing condition creates one Alert that stays firing until the condition is gone,
+so a channel gets one notification when an alert fires and one when it's resolved
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rqlite/gorqlite"
+)
+
+const AlertRuleMachineOffline = "machine_offline"
+const AlertRuleDeploymentFailed = "deployment_failed"
+const AlertRuleCPUUsage = "cpu_usage"
+const AlertRuleMemoryUsage = "memory_usage"
+const AlertRuleDiskUsage = "disk_usage"
+const AlertRuleContainerRestarts = "container_restarts"
+
+const AlertChannelWebhook = "webhook"
+const AlertChannelSMTP = "smtp"
+const AlertChannelSlack = "slack"
+
+const AlertStatusFiring = "firing"
+const AlertStatusResolved = "resolved"
+
+type AlertChannel struct {
+	Id           string
+	Name         string
+	Type         string //webhook, smtp or slack
+	URL          string //Webhook or Slack incoming webhook URL
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string //Encrypted in DB and empty in API responses
+	SMTPFrom     string
+	SMTPTo       []string
+}
+
+type AlertRule struct {
+	Id            string
+	Name          string
+	Type          string
+	MachineId     string  //Optional, machine rules check all machines if it's empty
+	EnvironmentId string  //Optional, environment rules check all environments if it's empty
+	Threshold     float64 //Percent for cpu_usage, memory_usage and disk_usage, number of restarts for container_restarts
+	Duration      int     //Seconds a condition should last before the alert fires, for container_restarts it's the period restarts are counted in
+	ChannelIds    []string
+}
+
+type Alert struct {
+	Id            string
+	RuleId        string
+	DedupKey      string //Machine, environment or container the alert is about, one firing alert per rule and key
+	Status        string
+	Message       string
+	MachineId     string
+	EnvironmentId string
+	ResolvedAt    string
+	CreatedAt     string
+}
+
+var alertRuleTypes = []string{AlertRuleMachineOffline, AlertRuleDeploymentFailed, AlertRuleCPUUsage, AlertRuleMemoryUsage, AlertRuleDiskUsage, AlertRuleContainerRestarts}
+
+func handleAlertChannelPost(w http.ResponseWriter, r *http.Request) {
+	var channel AlertChannel
+	err := decodeJSONBody(w, r, &channel, true)
+
+	if err != nil {
+		var mr *malformedRequest
+		if errors.As(err, &mr) {
+			http.Error(w, mr.msg, mr.status)
+		} else {
+			log.Print(err.Error())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	err = validateAlertChannel(&channel)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = addAlertChannel(&channel)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	channel.SMTPPassword = ""
+
+	jsonBytes, err := json.Marshal(channel)
+	if err != nil {
+		fmt.Println("Cannot convert AlertChannel object into JSON:", err)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+func handleAlertChannelGet(w http.ResponseWriter, r *http.Request) {
+
+	channels := getAlertChannels()
+	for index := range channels {
+		channels[index].SMTPPassword = ""
+	}
+
+	jsonBytes, err := json.Marshal(channels)
+	if err != nil {
+		fmt.Println("Cannot convert AlertChannel object into JSON:", err)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+func handleAlertChannelDelete(w http.ResponseWriter, r *http.Request) {
+
+	if !deleteAlertChannel(r.PathValue("id")) {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprint(w, "")
+}
+
+// Sends a test notification, so channel settings can be checked before a real alert fires
+func handleAlertChannelTestPost(w http.ResponseWriter, r *http.Request) {
+	channel := getAlertChannelById(r.PathValue("id"))
+	if channel == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	notification := AlertNotification{Status: AlertStatusFiring, RuleName: "Test", RuleType: "test", Message: "Test notification from TurboCloud"}
+	err := sendAlertNotification(*channel, notification)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	fmt.Fprint(w, "")
+}
+
+func handleAlertRulePost(w http.ResponseWriter, r *http.Request) {
+	var rule AlertRule
+	err := decodeJSONBody(w, r, &rule, true)
+
+	if err != nil {
+		var mr *malformedRequest
+		if errors.As(err, &mr) {
+			http.Error(w, mr.msg, mr.status)
+		} else {
+			log.Print(err.Error())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	err = validateAlertRule(&rule)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = addAlertRule(&rule)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(rule)
+	if err != nil {
+		fmt.Println("Cannot convert AlertRule object into JSON:", err)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+func handleAlertRuleGet(w http.ResponseWriter, r *http.Request) {
+
+	jsonBytes, err := json.Marshal(getAlertRules())
+	if err != nil {
+		fmt.Println("Cannot convert AlertRule object into JSON:", err)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+// Firing alerts of a deleted rule are resolved, channels of the rule get resolve notifications
+func handleAlertRuleDelete(w http.ResponseWriter, r *http.Request) {
+	ruleId := r.PathValue("id")
+
+	firingAlerts := []Alert{}
+	for _, alert := range getFiringAlerts() {
+		if alert.RuleId == ruleId {
+			firingAlerts = append(firingAlerts, alert)
+		}
+	}
+
+	var deletedRule *AlertRule
+	for _, rule := range getAlertRules() {
+		if rule.Id == ruleId {
+			deletedRule = &rule
+			break
+		}
+	}
+
+	resolvedAt := time.Now().UTC().Format(sqliteTimeFormat)
+	if !deleteAlertRule(ruleId, resolvedAt) {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if deletedRule != nil {
+		for _, alert := range firingAlerts {
+			alert.Status = AlertStatusResolved
+			alert.ResolvedAt = resolvedAt
+			go notifyAlertChannels(*deletedRule, alert)
+		}
+	}
+
+	fmt.Fprint(w, "")
+}
+
+// Returns the last 100 alerts, ?status=firing returns firing alerts only
+func handleAlertGet(w http.ResponseWriter, r *http.Request) {
+
+	status := r.URL.Query().Get("status")
+	if status != "" && status != AlertStatusFiring && status != AlertStatusResolved {
+		http.Error(w, "Invalid status, use '"+AlertStatusFiring+"' or '"+AlertStatusResolved+"'", http.StatusBadRequest)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(getAlerts(status))
+	if err != nil {
+		fmt.Println("Cannot convert Alert object into JSON:", err)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+func validateAlertChannel(channel *AlertChannel) error {
+	if channel.Name == "" {
+		return errors.New("Name is required")
+	}
+
+	switch channel.Type {
+	case AlertChannelWebhook, AlertChannelSlack:
+		if !strings.HasPrefix(channel.URL, "http://") && !strings.HasPrefix(channel.URL, "https://") {
+			return errors.New("URL should start with http:// or https://")
+		}
+	case AlertChannelSMTP:
+		if channel.SMTPHost == "" || channel.SMTPFrom == "" || len(channel.SMTPTo) == 0 {
+			return errors.New("SMTPHost, SMTPFrom and SMTPTo are required")
+		}
+		if channel.SMTPPort == 0 {
+			channel.SMTPPort = 587
+		}
+		for _, address := range append([]string{channel.SMTPFrom}, channel.SMTPTo...) {
+			if strings.ContainsAny(address, "\r\n;") {
+				return errors.New("Invalid email address " + address)
+			}
+		}
+	default:
+		return errors.New("Type should be '" + AlertChannelWebhook + "', '" + AlertChannelSMTP + "' or '" + AlertChannelSlack + "'")
+	}
+
+	return nil
+}
+
+func validateAlertRule(rule *AlertRule) error {
+	if rule.Name == "" || strings.ContainsAny(rule.Name, "\r\n") {
+		return errors.New("Name is required and cannot contain line breaks")
+	}
+
+	if !slices.Contains(alertRuleTypes, rule.Type) {
+		return errors.New("Type should be one of " + strings.Join(alertRuleTypes, ", "))
+	}
+
+	switch rule.Type {
+	case AlertRuleCPUUsage, AlertRuleMemoryUsage, AlertRuleDiskUsage:
+		if rule.Threshold <= 0 || rule.Threshold > 100 {
+			return errors.New("Threshold should be a percent between 0 and 100")
+		}
+	case AlertRuleContainerRestarts:
+		if rule.Threshold < 1 {
+			rule.Threshold = 1
+		}
+		if rule.Duration <= 0 {
+			rule.Duration = 600
+		}
+	}
+
+	if rule.Duration < 0 {
+		return errors.New("Duration cannot be negative")
+	}
+
+	if rule.MachineId != "" && getMachineById(rule.MachineId) == nil {
+		return errors.New("Machine " + rule.MachineId + " doesn't exist")
+	}
+
+	if rule.EnvironmentId != "" && getEnvironmentById(rule.EnvironmentId) == nil {
+		return errors.New("Environment " + rule.EnvironmentId + " doesn't exist")
+	}
+
+	if len(rule.ChannelIds) == 0 {
+		return errors.New("At least one channel is required in ChannelIds")
+	}
+
+	for _, channelId := range rule.ChannelIds {
+		if getAlertChannelById(channelId) == nil {
+			return errors.New("Channel " + channelId + " doesn't exist")
+		}
+	}
+
+	return nil
+}
+
+/*Database*/
+
+func addAlertChannel(channel *AlertChannel) error {
+
+	id, err := NanoId(7)
+	if err != nil {
+		fmt.Println("Cannot generate new NanoId for AlertChannel:", err)
+		return err
+	}
+
+	channel.Id = id
+
+	password := ""
+	if channel.SMTPPassword != "" {
+		password, err = encryptSecret(channel.SMTPPassword)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "INSERT INTO AlertChannel( Id, Name, Type, URL, SMTPHost, SMTPPort, SMTPUsername, SMTPPassword, SMTPFrom, SMTPTo) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+				Arguments: []interface{}{channel.Id, channel.Name, channel.Type, channel.URL, channel.SMTPHost, channel.SMTPPort, channel.SMTPUsername, password, channel.SMTPFrom, strings.Join(channel.SMTPTo, ";")},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot write to AlertChannel table: %s\n", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func deleteAlertChannel(channelId string) bool {
+	_, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "DELETE FROM AlertChannel WHERE Id = ?",
+				Arguments: []interface{}{channelId},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot delete a record from AlertChannel table: %s\n", err.Error())
+		return false
+	}
+
+	return true
+}
+
+func getAlertChannelById(channelId string) *AlertChannel {
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id, Name, Type, URL, SMTPHost, SMTPPort, SMTPUsername, SMTPPassword, SMTPFrom, SMTPTo from AlertChannel WHERE Id = ?",
+			Arguments: []interface{}{channelId},
+		},
+	)
+
+	channels := handleAlertChannelQuery(rows, err)
+	if len(channels) == 0 {
+		return nil
+	}
+
+	return &channels[0]
+}
+
+func getAlertChannels() []AlertChannel {
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id, Name, Type, URL, SMTPHost, SMTPPort, SMTPUsername, SMTPPassword, SMTPFrom, SMTPTo from AlertChannel ORDER BY CreatedAt",
+			Arguments: []interface{}{},
+		},
+	)
+
+	return handleAlertChannelQuery(rows, err)
+}
+
+func handleAlertChannelQuery(rows gorqlite.QueryResult, err error) []AlertChannel {
+
+	var channels = []AlertChannel{}
+
+	if err != nil {
+		fmt.Printf(" Cannot read from AlertChannel table: %s\n", err.Error())
+	}
+
+	for rows.Next() {
+		var channel AlertChannel
+		var smtpTo string
+
+		err := rows.Scan(&channel.Id, &channel.Name, &channel.Type, &channel.URL, &channel.SMTPHost, &channel.SMTPPort, &channel.SMTPUsername, &channel.SMTPPassword, &channel.SMTPFrom, &smtpTo)
+		if err != nil {
+			fmt.Printf(" Cannot run Scan: %s\n", err.Error())
+		}
+
+		channel.SMTPTo = []string{}
+		if smtpTo != "" {
+			channel.SMTPTo = strings.Split(smtpTo, ";")
+		}
+
+		channels = append(channels, channel)
+	}
+
+	return channels
+}
+
+func addAlertRule(rule *AlertRule) error {
+
+	id, err := NanoId(7)
+	if err != nil {
+		fmt.Println("Cannot generate new NanoId for AlertRule:", err)
+		return err
+	}
+
+	rule.Id = id
+
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "INSERT INTO AlertRule( Id, Name, Type, MachineId, EnvironmentId, Threshold, Duration, ChannelIds) VALUES(?, ?, ?, ?, ?, ?, ?, ?)",
+				Arguments: []interface{}{rule.Id, rule.Name, rule.Type, rule.MachineId, rule.EnvironmentId, rule.Threshold, rule.Duration, strings.Join(rule.ChannelIds, ";")},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot write to AlertRule table: %s\n", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// Deletes a rule and resolves its firing alerts, resolved alerts are kept in the history
+func deleteAlertRule(ruleId string, resolvedAt string) bool {
+	_, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "DELETE FROM AlertRule WHERE Id = ?",
+				Arguments: []interface{}{ruleId},
+			},
+			{
+				Query:     "UPDATE Alert SET Status = ?, ResolvedAt = ? WHERE RuleId = ? AND Status = ?",
+				Arguments: []interface{}{AlertStatusResolved, resolvedAt, ruleId, AlertStatusFiring},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot delete a record from AlertRule table: %s\n", err.Error())
+		return false
+	}
+
+	return true
+}
+
+func getAlertRules() []AlertRule {
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id, Name, Type, MachineId, EnvironmentId, Threshold, Duration, ChannelIds from AlertRule ORDER BY CreatedAt",
+			Arguments: []interface{}{},
+		},
+	)
+
+	var rules = []AlertRule{}
+
+	if err != nil {
+		fmt.Printf(" Cannot read from AlertRule table: %s\n", err.Error())
+	}
+
+	for rows.Next() {
+		var rule AlertRule
+		var channelIds string
+
+		err := rows.Scan(&rule.Id, &rule.Name, &rule.Type, &rule.MachineId, &rule.EnvironmentId, &rule.Threshold, &rule.Duration, &channelIds)
+		if err != nil {
+			fmt.Printf(" Cannot run Scan: %s\n", err.Error())
+		}
+
+		rule.ChannelIds = []string{}
+		if channelIds != "" {
+			rule.ChannelIds = strings.Split(channelIds, ";")
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+func addAlert(alert *Alert) error {
+
+	id, err := NanoId(7)
+	if err != nil {
+		fmt.Println("Cannot generate new NanoId for Alert:", err)
+		return err
+	}
+
+	alert.Id = id
+
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "INSERT INTO Alert( Id, RuleId, DedupKey, Status, Message, MachineId, EnvironmentId) VALUES(?, ?, ?, ?, ?, ?, ?)",
+				Arguments: []interface{}{alert.Id, alert.RuleId, alert.DedupKey, alert.Status, alert.Message, alert.MachineId, alert.EnvironmentId},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot write to Alert table: %s\n", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func resolveAlert(alert *Alert, resolvedAt string) error {
+	alert.Status = AlertStatusResolved
+	alert.ResolvedAt = resolvedAt
+
+	_, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "UPDATE Alert SET Status = ?, ResolvedAt = ? WHERE Id = ?",
+				Arguments: []interface{}{alert.Status, alert.ResolvedAt, alert.Id},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf("Cannot update a row in Alert: %s\n", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func getAlerts(status string) []Alert {
+
+	query := "SELECT Id, RuleId, DedupKey, Status, Message, MachineId, EnvironmentId, ResolvedAt, CreatedAt from Alert"
+	arguments := []interface{}{}
+	if status != "" {
+		query += " WHERE Status = ?"
+		arguments = append(arguments, status)
+	}
+	query += " ORDER BY CreatedAt DESC LIMIT 100"
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     query,
+			Arguments: arguments,
+		},
+	)
+
+	return handleAlertQuery(rows, err)
+}
+
+func getFiringAlerts() []Alert {
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id, RuleId, DedupKey, Status, Message, MachineId, EnvironmentId, ResolvedAt, CreatedAt from Alert WHERE Status = ?",
+			Arguments: []interface{}{AlertStatusFiring},
+		},
+	)
+
+	return handleAlertQuery(rows, err)
+}
+
+func handleAlertQuery(rows gorqlite.QueryResult, err error) []Alert {
+
+	var alerts = []Alert{}
+
+	if err != nil {
+		fmt.Printf(" Cannot read from Alert table: %s\n", err.Error())
+	}
+
+	for rows.Next() {
+		var alert Alert
+
+		err := rows.Scan(&alert.Id, &alert.RuleId, &alert.DedupKey, &alert.Status, &alert.Message, &alert.MachineId, &alert.EnvironmentId, &alert.ResolvedAt, &alert.CreatedAt)
+		if err != nil {
+			fmt.Printf(" Cannot run Scan: %s\n", err.Error())
+		}
+
+		alerts = append(alerts, alert)
+	}
+
+	return alerts
+}
@@ -0,0 +1,188 @@
+/*
+Notifications of alerts. Webhook channels get AlertNotification as JSON, Slack channels get a Slack-compatible {"text": ...} message,
+SMTP channels get a plain text email
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const alertNotificationTimeout = time.Second * 10
+
+type AlertNotification struct {
+	AlertId       string
+	Status        string //firing or resolved
+	RuleId        string
+	RuleName      string
+	RuleType      string
+	Message       string
+	MachineId     string
+	EnvironmentId string
+	FiredAt       string
+	ResolvedAt    string
+}
+
+var alertNotificationClient = &http.Client{Timeout: alertNotificationTimeout}
+
+// Errors are logged, a failed notification isn't sent again
+func notifyAlertChannels(rule AlertRule, alert Alert) {
+	notification := AlertNotification{
+		AlertId:       alert.Id,
+		Status:        alert.Status,
+		RuleId:        rule.Id,
+		RuleName:      rule.Name,
+		RuleType:      rule.Type,
+		Message:       alert.Message,
+		MachineId:     alert.MachineId,
+		EnvironmentId: alert.EnvironmentId,
+		FiredAt:       alert.CreatedAt,
+		ResolvedAt:    alert.ResolvedAt,
+	}
+
+	for _, channelId := range rule.ChannelIds {
+		channel := getAlertChannelById(channelId)
+		if channel == nil {
+			fmt.Println("Alert channel " + channelId + " of rule " + rule.Name + " doesn't exist")
+			continue
+		}
+
+		err := sendAlertNotification(*channel, notification)
+		if err != nil {
+			fmt.Println("Cannot send alert notification to channel " + channel.Name + ": " + err.Error())
+		}
+	}
+}
+
+func sendAlertNotification(channel AlertChannel, notification AlertNotification) error {
+	switch channel.Type {
+	case AlertChannelWebhook:
+		return postAlertJSON(channel.URL, notification)
+	case AlertChannelSlack:
+		return postAlertJSON(channel.URL, map[string]string{"text": getAlertNotificationTitle(notification) + "\n" + notification.Message})
+	case AlertChannelSMTP:
+		return sendAlertEmail(channel, notification)
+	}
+
+	return fmt.Errorf("unknown channel type %s", channel.Type)
+}
+
+func getAlertNotificationTitle(notification AlertNotification) string {
+	return "[" + strings.ToUpper(notification.Status) + "] " + notification.RuleName
+}
+
+func postAlertJSON(url string, payload any) error {
+	jsonBytes, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	response, err := alertNotificationClient.Post(url, "application/json", bytes.NewReader(jsonBytes))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("%s returned status %d", url, response.StatusCode)
+	}
+
+	return nil
+}
+
+// Port 465 uses implicit TLS, other ports use STARTTLS if the server supports it
+func sendAlertEmail(channel AlertChannel, notification AlertNotification) error {
+	address := net.JoinHostPort(channel.SMTPHost, strconv.Itoa(channel.SMTPPort))
+	tlsConfig := &tls.Config{ServerName: channel.SMTPHost}
+
+	var conn net.Conn
+	var err error
+	if channel.SMTPPort == 465 {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: alertNotificationTimeout}, "tcp", address, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", address, alertNotificationTimeout)
+	}
+	if err != nil {
+		return err
+	}
+
+	conn.SetDeadline(time.Now().Add(alertNotificationTimeout))
+
+	client, err := smtp.NewClient(conn, channel.SMTPHost)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if isStartTLS, _ := client.Extension("STARTTLS"); isStartTLS && channel.SMTPPort != 465 {
+		err = client.StartTLS(tlsConfig)
+		if err != nil {
+			return err
+		}
+	}
+
+	if channel.SMTPUsername != "" {
+		password, err := decryptSecret(channel.SMTPPassword)
+		if err != nil {
+			return err
+		}
+
+		err = client.Auth(smtp.PlainAuth("", channel.SMTPUsername, password, channel.SMTPHost))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = client.Mail(channel.SMTPFrom)
+	if err != nil {
+		return err
+	}
+
+	for _, to := range channel.SMTPTo {
+		err = client.Rcpt(to)
+		if err != nil {
+			return err
+		}
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+
+	message := "From: " + channel.SMTPFrom + "\r\n" +
+		"To: " + strings.Join(channel.SMTPTo, ", ") + "\r\n" +
+		"Subject: TurboCloud " + getAlertNotificationTitle(notification) + "\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + notification.Message + "\r\n"
+
+	if notification.FiredAt != "" {
+		message += "\r\nFired at: " + notification.FiredAt + " UTC\r\n"
+	}
+	if notification.ResolvedAt != "" {
+		message += "Resolved at: " + notification.ResolvedAt + " UTC\r\n"
+	}
+
+	_, err = writer.Write([]byte(message))
+	if err != nil {
+		return err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Starts a server that saves the last request body and responds with status
+func newAlertReceiver(t *testing.T, status int) (*httptest.Server, *[]byte) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request %s with Content-Type %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &body
+}
+
+func TestSendAlertNotificationWebhook(t *testing.T) {
+	server, body := newAlertReceiver(t, http.StatusOK)
+	channel := AlertChannel{Name: "hook", Type: AlertChannelWebhook, URL: server.URL}
+	notification := AlertNotification{AlertId: "alert1", Status: AlertStatusResolved, RuleId: "rule1", RuleName: "Offline", RuleType: AlertRuleMachineOffline, Message: "Machine m1 is offline", MachineId: "m1", FiredAt: "2024-01-01 10:00:00", ResolvedAt: "2024-01-01 10:05:00"}
+
+	err := sendAlertNotification(channel, notification)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var received AlertNotification
+	err = json.Unmarshal(*body, &received)
+	if err != nil {
+		t.Fatalf("webhook payload isn't AlertNotification JSON: %s", *body)
+	}
+	if received != notification {
+		t.Fatalf("webhook payload = %+v, want %+v", received, notification)
+	}
+}
+
+func TestSendAlertNotificationSlack(t *testing.T) {
+	server, body := newAlertReceiver(t, http.StatusOK)
+	channel := AlertChannel{Name: "slack", Type: AlertChannelSlack, URL: server.URL}
+	notification := AlertNotification{Status: AlertStatusFiring, RuleName: "CPU", Message: "CPU usage of machine m1 is 95.0%"}
+
+	err := sendAlertNotification(channel, notification)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var received map[string]string
+	err = json.Unmarshal(*body, &received)
+	if err != nil {
+		t.Fatalf("Slack payload isn't JSON: %s", *body)
+	}
+	if len(received) != 1 || received["text"] != "[FIRING] CPU\nCPU usage of machine m1 is 95.0%" {
+		t.Fatalf("unexpected Slack payload %s", *body)
+	}
+}
+
+func TestSendAlertNotificationErrorStatus(t *testing.T) {
+	server, _ := newAlertReceiver(t, http.StatusInternalServerError)
+	channel := AlertChannel{Name: "hook", Type: AlertChannelWebhook, URL: server.URL}
+
+	err := sendAlertNotification(channel, AlertNotification{Status: AlertStatusFiring})
+	if err == nil {
+		t.Fatal("expected an error for status 500")
+	}
+}
@@ -0,0 +1,281 @@
+/*
+Alert evaluation on lighthouses. Every rule returns conditions that are true right now, a new condition fires an alert after Duration seconds,
+and a firing alert without a condition is resolved
+*/
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rqlite/gorqlite"
+)
+
+const alertEvaluationInterval = time.Second * 30
+
+// Condition of a rule that is true right now, DedupKey identifies the machine, environment or container
+type alertCondition struct {
+	DedupKey      string
+	Message       string
+	MachineId     string
+	EnvironmentId string
+}
+
+// Rule ID/DedupKey -> time when the condition was noticed first, kept in memory, so a restarted lighthouse waits for Duration again
+var pendingAlertsSince = map[string]time.Time{}
+
+func startAlertEvaluator() {
+
+	// Only lighthouses check alert rules
+	if !slices.Contains(thisMachine.Types, MachineTypeLighthouse) {
+		return
+	}
+
+	for range time.Tick(alertEvaluationInterval) {
+		evaluateAlertRules()
+	}
+}
+
+func evaluateAlertRules() {
+	firingAlerts := map[string]Alert{}
+	for _, alert := range getFiringAlerts() {
+		firingAlerts[alert.RuleId+"/"+alert.DedupKey] = alert
+	}
+
+	ruleIds := map[string]bool{}
+	for _, rule := range getAlertRules() {
+		ruleIds[rule.Id] = true
+
+		conditions, err := getAlertConditions(rule)
+		if err != nil {
+			fmt.Println("Cannot check alert rule " + rule.Name + ": " + err.Error())
+			continue
+		}
+
+		newAlerts, resolvedAlerts := evaluateAlertRule(rule, conditions, firingAlerts, time.Now())
+
+		for _, alert := range newAlerts {
+			if addAlert(&alert) != nil {
+				continue
+			}
+			alert.CreatedAt = time.Now().UTC().Format(sqliteTimeFormat)
+
+			fmt.Println("Alert " + rule.Name + " is firing: " + alert.Message)
+			go notifyAlertChannels(rule, alert)
+		}
+
+		for _, alert := range resolvedAlerts {
+			if resolveAlert(&alert, time.Now().UTC().Format(sqliteTimeFormat)) != nil {
+				continue
+			}
+
+			fmt.Println("Alert " + rule.Name + " is resolved: " + alert.Message)
+			go notifyAlertChannels(rule, alert)
+		}
+	}
+
+	//Conditions of deleted rules are forgotten
+	for key := range pendingAlertsSince {
+		ruleId, _, _ := strings.Cut(key, "/")
+		if !ruleIds[ruleId] {
+			delete(pendingAlertsSince, key)
+		}
+	}
+}
+
+// Returns new alerts of conditions that have lasted for Duration seconds and firing alerts of the rule without a condition.
+// A condition with a firing alert doesn't fire again, so channels get one notification when an alert fires and one when it's resolved
+func evaluateAlertRule(rule AlertRule, conditions []alertCondition, firingAlerts map[string]Alert, now time.Time) ([]Alert, []Alert) {
+	newAlerts := []Alert{}
+	resolvedAlerts := []Alert{}
+
+	activeKeys := map[string]bool{}
+	for _, condition := range conditions {
+		key := rule.Id + "/" + condition.DedupKey
+		activeKeys[key] = true
+
+		if _, isFiring := firingAlerts[key]; isFiring {
+			continue
+		}
+
+		pendingSince, isPending := pendingAlertsSince[key]
+		if !isPending {
+			pendingSince = now
+			pendingAlertsSince[key] = pendingSince
+		}
+
+		if rule.Type != AlertRuleContainerRestarts && now.Sub(pendingSince) < time.Duration(rule.Duration)*time.Second {
+			continue
+		}
+
+		newAlerts = append(newAlerts, Alert{RuleId: rule.Id, DedupKey: condition.DedupKey, Status: AlertStatusFiring, Message: condition.Message, MachineId: condition.MachineId, EnvironmentId: condition.EnvironmentId})
+	}
+
+	for key := range pendingAlertsSince {
+		if !activeKeys[key] && strings.HasPrefix(key, rule.Id+"/") {
+			delete(pendingAlertsSince, key)
+		}
+	}
+
+	for key, alert := range firingAlerts {
+		if alert.RuleId != rule.Id || activeKeys[key] {
+			continue
+		}
+
+		resolvedAlerts = append(resolvedAlerts, alert)
+	}
+
+	return newAlerts, resolvedAlerts
+}
+
+func getAlertConditions(rule AlertRule) ([]alertCondition, error) {
+	switch rule.Type {
+	case AlertRuleMachineOffline:
+		return getMachineOfflineConditions(rule), nil
+	case AlertRuleDeploymentFailed:
+		return getDeploymentFailedConditions(rule), nil
+	case AlertRuleCPUUsage, AlertRuleMemoryUsage, AlertRuleDiskUsage:
+		return getMachineUsageConditions(rule), nil
+	case AlertRuleContainerRestarts:
+		return getContainerRestartsConditions(rule)
+	}
+
+	return nil, fmt.Errorf("unknown rule type %s", rule.Type)
+}
+
+func getMachineOfflineConditions(rule AlertRule) []alertCondition {
+	conditions := []alertCondition{}
+
+	for _, machine := range getMachines() {
+		if (rule.MachineId != "" && machine.Id != rule.MachineId) || machine.Status != MachineStatusOffline {
+			continue
+		}
+
+		conditions = append(conditions, alertCondition{DedupKey: machine.Id, MachineId: machine.Id, Message: "Machine " + machine.Name + " (ID=" + machine.Id + ") is offline"})
+	}
+
+	return conditions
+}
+
+// An environment is failed while its last completed deployment is failed, a deployment in progress doesn't change it
+func getDeploymentFailedConditions(rule AlertRule) []alertCondition {
+	conditions := []alertCondition{}
+
+	for _, environment := range getEnvironments() {
+		if rule.EnvironmentId != "" && environment.Id != rule.EnvironmentId {
+			continue
+		}
+
+		for _, deployment := range getDeploymentsByEnvironmentId(environment.Id) {
+			if deployment.Status == DeploymentStatusFinished {
+				break
+			}
+
+			if deployment.Status == DeploymentStatusFailed {
+				conditions = append(conditions, alertCondition{DedupKey: environment.Id, EnvironmentId: environment.Id, Message: "Deployment " + deployment.Id + " of environment " + environment.Name + " (ID=" + environment.Id + ") has failed: " + deployment.ErrorMsg})
+				break
+			}
+		}
+	}
+
+	return conditions
+}
+
+// Usage is checked in the last stats of online machines, offline machines have their own rule
+func getMachineUsageConditions(rule AlertRule) []alertCondition {
+	conditions := []alertCondition{}
+
+	for _, machine := range getMachines() {
+		if (rule.MachineId != "" && machine.Id != rule.MachineId) || machine.Status != MachineStatusOnline {
+			continue
+		}
+
+		stats := getLastMachineStats(machine.Id)
+		if stats == nil {
+			continue
+		}
+
+		var usage float64
+		var resource string
+		switch rule.Type {
+		case AlertRuleCPUUsage:
+			usage = float64(stats.CPUUsage)
+			resource = "CPU"
+		case AlertRuleMemoryUsage:
+			usage = usagePercent(stats.AvailableMemory, stats.TotalMemory)
+			resource = "Memory"
+		case AlertRuleDiskUsage:
+			usage = usagePercent(stats.AvailableDisk, stats.TotalDisk)
+			resource = "Disk"
+		}
+
+		if usage < rule.Threshold {
+			continue
+		}
+
+		conditions = append(conditions, alertCondition{DedupKey: machine.Id, MachineId: machine.Id, Message: resource + " usage of machine " + machine.Name + " (ID=" + machine.Id + ") is " + strconv.FormatFloat(usage, 'f', 1, 64) + "%, threshold is " + strconv.FormatFloat(rule.Threshold, 'f', 1, 64) + "%"})
+	}
+
+	return conditions
+}
+
+func usagePercent(available int64, total int64) float64 {
+	if total <= 0 {
+		return 0
+	}
+
+	return float64(total-available) / float64(total) * 100
+}
+
+// Restarts are counted from RestartCount in ContainerStats during the last Duration seconds
+func getContainerRestartsConditions(rule AlertRule) ([]alertCondition, error) {
+	query := "SELECT MachineId, EnvironmentId, ContainerName, MAX(RestartCount) - MIN(RestartCount) AS Restarts from ContainerStats WHERE CreatedAt >= ?"
+	arguments := []interface{}{time.Now().UTC().Add(-time.Duration(rule.Duration) * time.Second).Format(sqliteTimeFormat)}
+
+	if rule.EnvironmentId != "" {
+		query += " AND EnvironmentId = ?"
+		arguments = append(arguments, rule.EnvironmentId)
+	}
+
+	if rule.MachineId != "" {
+		query += " AND MachineId = ?"
+		arguments = append(arguments, rule.MachineId)
+	}
+
+	query += " GROUP BY MachineId, EnvironmentId, ContainerName HAVING Restarts >= ?"
+	arguments = append(arguments, rule.Threshold)
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     query,
+			Arguments: arguments,
+		},
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	conditions := []alertCondition{}
+	for rows.Next() {
+		var condition alertCondition
+		var containerName string
+		var restarts int64
+
+		err := rows.Scan(&condition.MachineId, &condition.EnvironmentId, &containerName, &restarts)
+		if err != nil {
+			fmt.Printf(" Cannot run Scan: %s\n", err.Error())
+			continue
+		}
+
+		condition.DedupKey = condition.MachineId + "/" + containerName
+		condition.Message = "Container " + containerName + " on machine " + condition.MachineId + " has been restarted " + strconv.FormatInt(restarts, 10) + " times in " + strconv.Itoa(rule.Duration) + " seconds"
+		conditions = append(conditions, condition)
+	}
+
+	return conditions, nil
+}
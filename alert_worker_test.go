@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEvaluateAlertRuleFiresAndResolvesOnce(t *testing.T) {
+	pendingAlertsSince = map[string]time.Time{}
+	rule := AlertRule{Id: "rule1", Name: "Offline", Type: AlertRuleMachineOffline, Duration: 60}
+	conditions := []alertCondition{{DedupKey: "machine1", MachineId: "machine1", Message: "Machine machine1 is offline"}}
+	firingAlerts := map[string]Alert{}
+	start := time.Now()
+
+	newAlerts, resolvedAlerts := evaluateAlertRule(rule, conditions, firingAlerts, start)
+	if len(newAlerts) != 0 || len(resolvedAlerts) != 0 {
+		t.Fatalf("condition fired before Duration: %d new, %d resolved", len(newAlerts), len(resolvedAlerts))
+	}
+
+	newAlerts, _ = evaluateAlertRule(rule, conditions, firingAlerts, start.Add(time.Second*30))
+	if len(newAlerts) != 0 {
+		t.Fatalf("condition fired before Duration: %d new", len(newAlerts))
+	}
+
+	newAlerts, _ = evaluateAlertRule(rule, conditions, firingAlerts, start.Add(time.Second*60))
+	if len(newAlerts) != 1 {
+		t.Fatalf("expected 1 new alert after Duration, got %d", len(newAlerts))
+	}
+	if newAlerts[0].Status != AlertStatusFiring || newAlerts[0].DedupKey != "machine1" || newAlerts[0].MachineId != "machine1" {
+		t.Fatalf("unexpected alert %+v", newAlerts[0])
+	}
+
+	//The alert is saved as firing, the same condition doesn't fire again
+	firing := newAlerts[0]
+	firing.Id = "alert1"
+	firingAlerts[rule.Id+"/"+firing.DedupKey] = firing
+
+	for _, seconds := range []int{90, 120, 600} {
+		newAlerts, resolvedAlerts = evaluateAlertRule(rule, conditions, firingAlerts, start.Add(time.Second*time.Duration(seconds)))
+		if len(newAlerts) != 0 || len(resolvedAlerts) != 0 {
+			t.Fatalf("firing alert was notified again after %d seconds: %d new, %d resolved", seconds, len(newAlerts), len(resolvedAlerts))
+		}
+	}
+
+	newAlerts, resolvedAlerts = evaluateAlertRule(rule, []alertCondition{}, firingAlerts, start.Add(time.Second*630))
+	if len(newAlerts) != 0 || len(resolvedAlerts) != 1 || resolvedAlerts[0].Id != "alert1" {
+		t.Fatalf("expected alert1 to be resolved, got %d new, %+v resolved", len(newAlerts), resolvedAlerts)
+	}
+
+	//The condition is back after the alert has been resolved, it waits for Duration again
+	delete(firingAlerts, rule.Id+"/"+firing.DedupKey)
+	newAlerts, _ = evaluateAlertRule(rule, conditions, firingAlerts, start.Add(time.Second*660))
+	if len(newAlerts) != 0 {
+		t.Fatalf("condition fired again before Duration: %d new", len(newAlerts))
+	}
+	newAlerts, _ = evaluateAlertRule(rule, conditions, firingAlerts, start.Add(time.Second*720))
+	if len(newAlerts) != 1 {
+		t.Fatalf("expected the condition to fire again after Duration, got %d", len(newAlerts))
+	}
+}
+
+func TestEvaluateAlertRuleKeepsOtherRulesAndKeys(t *testing.T) {
+	pendingAlertsSince = map[string]time.Time{}
+	rule := AlertRule{Id: "rule1", Type: AlertRuleContainerRestarts, Duration: 300}
+	firingAlerts := map[string]Alert{
+		"rule1/machine1/app.1": {Id: "alert1", RuleId: "rule1", DedupKey: "machine1/app.1", Status: AlertStatusFiring},
+		"rule2/machine1":       {Id: "alert2", RuleId: "rule2", DedupKey: "machine1", Status: AlertStatusFiring},
+	}
+	conditions := []alertCondition{
+		{DedupKey: "machine1/app.1", MachineId: "machine1"},
+		{DedupKey: "machine1/app.2", MachineId: "machine1"},
+	}
+
+	//Restarts are counted over Duration already, so a new condition fires right away
+	newAlerts, resolvedAlerts := evaluateAlertRule(rule, conditions, firingAlerts, time.Now())
+	if len(newAlerts) != 1 || newAlerts[0].DedupKey != "machine1/app.2" {
+		t.Fatalf("expected only machine1/app.2 to fire, got %+v", newAlerts)
+	}
+	if len(resolvedAlerts) != 0 {
+		t.Fatalf("alerts of other rules or active keys were resolved: %+v", resolvedAlerts)
+	}
+}
@@ -0,0 +1,305 @@
+/*
+API tokens protect the agent HTTP API. A token is shown only once when it's created,
+we store only a SHA-256 hash of the token in DB
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/user"
+	"strings"
+
+	"github.com/rqlite/gorqlite"
+)
+
+const ApiTokenPrefix = "tc_"
+const ApiTokenFileName = ".turbocloud_api_token"
+
+type ApiToken struct {
+	Id        string
+	Name      string
+	Token     string `json:",omitempty"` //Plain token, returned only once in POST /token
+	CreatedAt string
+}
+
+// Routes that are available without an API token
+// Webhooks from GitHub/Bitbucket and join URLs for new machines cannot send our token
+var publicRoutes = newPublicRoutesMux()
+
+func newPublicRoutesMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	noop := func(w http.ResponseWriter, r *http.Request) {}
+
+	//Preflight requests
+	mux.HandleFunc("OPTIONS /{pathname...}", noop)
+	//Health check, used by setup scripts
+	mux.HandleFunc("GET /hey", noop)
+	//Webhooks
+	mux.HandleFunc("POST /deploy/{serviceId}", noop)
+	//Join URL for new machines, protected by a secret in the URL
+	mux.HandleFunc("GET /join/{machineId}/{secret}", noop)
+	//Backup files for other machines, protected by a secret in the URL
+	mux.HandleFunc("GET /backup/{id}/file/{secret}", noop)
+
+	return mux
+}
+
+func isPublicRoute(r *http.Request) bool {
+	_, pattern := publicRoutes.Handler(r)
+	return pattern != ""
+}
+
+// Routes that accept the API token in ?access_token=, EventSource cannot set the Authorization header
+var queryTokenRoutes = newQueryTokenRoutesMux()
+
+func newQueryTokenRoutesMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	noop := func(w http.ResponseWriter, r *http.Request) {}
+
+	//Live logs
+	mux.HandleFunc("GET /logs/environment/{environmentId}/stream", noop)
+
+	return mux
+}
+
+// Returns the token from the Authorization header, or from ?access_token= on routes that allow it.
+// loggingMiddleware redacts the query token, so it doesn't appear in request logs
+func getRequestApiToken(r *http.Request) string {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if found {
+		return token
+	}
+
+	if _, pattern := queryTokenRoutes.Handler(r); pattern == "" {
+		return ""
+	}
+
+	return r.URL.Query().Get("access_token")
+}
+
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if isPublicRoute(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := getRequestApiToken(r)
+		if token == "" || getApiTokenByHash(hashApiToken(token)) == nil {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func handleApiTokenPost(w http.ResponseWriter, r *http.Request) {
+	var apiToken ApiToken
+	err := decodeJSONBody(w, r, &apiToken, true)
+
+	if err != nil {
+		var mr *malformedRequest
+		if errors.As(err, &mr) {
+			http.Error(w, mr.msg, mr.status)
+		} else {
+			log.Print(err.Error())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if !addApiToken(&apiToken) {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(apiToken)
+	if err != nil {
+		fmt.Println("Cannot convert ApiToken object into JSON:", err)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+func handleApiTokenGet(w http.ResponseWriter, r *http.Request) {
+
+	jsonBytes, err := json.Marshal(getAllApiTokens())
+	if err != nil {
+		fmt.Println("Cannot convert ApiToken object into JSON:", err)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+func handleApiTokenDelete(w http.ResponseWriter, r *http.Request) {
+	tokenId := r.PathValue("id")
+
+	if !deleteApiToken(tokenId) {
+		fmt.Println("Cannot delete a record from ApiToken table")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprint(w, "")
+}
+
+/*Internal*/
+
+func hashApiToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// We create the first token when ApiToken table is created and save it to the home directory
+// so the owner of the server can read it over SSH and add more tokens with the API
+func addFirstApiToken() {
+	var apiToken ApiToken
+	apiToken.Name = "root"
+
+	if !addApiToken(&apiToken) {
+		return
+	}
+
+	currentUser, err := user.Current()
+	if err != nil {
+		fmt.Println("Cannot get home directory, api_token.go:", err)
+		return
+	}
+
+	tokenPath := currentUser.HomeDir + "/" + ApiTokenFileName
+	err = os.WriteFile(tokenPath, []byte(apiToken.Token), 0600)
+	if err != nil {
+		fmt.Printf(" Cannot save the first API token: %s\n", err.Error())
+		return
+	}
+
+	fmt.Println("The first API token has been saved to " + tokenPath)
+}
+
+/*Database*/
+
+func addApiToken(apiToken *ApiToken) bool {
+
+	id, err := NanoId(7)
+	if err != nil {
+		fmt.Println("Cannot generate new NanoId for ApiToken:", err)
+		return false
+	}
+
+	token, err := NanoId(40)
+	if err != nil {
+		fmt.Println("Cannot generate a new API token:", err)
+		return false
+	}
+
+	apiToken.Id = id
+	apiToken.Token = ApiTokenPrefix + token
+
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "INSERT INTO ApiToken( Id, Name, TokenHash) VALUES(?, ?, ?)",
+				Arguments: []interface{}{apiToken.Id, apiToken.Name, hashApiToken(apiToken.Token)},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot write to ApiToken table: %s\n", err.Error())
+		return false
+	}
+
+	return true
+}
+
+func getAllApiTokens() []ApiToken {
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id, Name, CreatedAt from ApiToken ORDER BY CreatedAt ASC",
+			Arguments: []interface{}{},
+		},
+	)
+
+	return handleApiTokenQuery(rows, err)
+}
+
+func getApiTokenByHash(tokenHash string) *ApiToken {
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id, Name, CreatedAt from ApiToken WHERE TokenHash = ?",
+			Arguments: []interface{}{tokenHash},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot read from ApiToken table: %s\n", err.Error())
+		return nil
+	}
+
+	tokens := handleApiTokenQuery(rows, err)
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	return &tokens[0]
+}
+
+func deleteApiToken(tokenId string) (result bool) {
+	_, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "DELETE FROM ApiToken WHERE Id = ?",
+				Arguments: []interface{}{tokenId},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot delete a record from ApiToken table: %s\n", err.Error())
+		return false
+	}
+
+	return true
+}
+
+func handleApiTokenQuery(rows gorqlite.QueryResult, err error) []ApiToken {
+
+	var tokens = []ApiToken{}
+
+	if err != nil {
+		fmt.Printf(" Cannot read from ApiToken table: %s\n", err.Error())
+	}
+
+	for rows.Next() {
+		var Id string
+		var Name string
+		var CreatedAt string
+
+		err := rows.Scan(&Id, &Name, &CreatedAt)
+		if err != nil {
+			fmt.Printf(" Cannot run Scan: %s\n", err.Error())
+		}
+		loadedToken := ApiToken{
+			Id:        Id,
+			Name:      Name,
+			CreatedAt: CreatedAt,
+		}
+		tokens = append(tokens, loadedToken)
+	}
+
+	return tokens
+}
@@ -0,0 +1,204 @@
+/*
+Autoscaling of environments. The lighthouse compares container CPU and memory from ContainerStats and request rates from RequestStats with thresholds of environments
+New replicas of the deployed deployment are started by DeploymentJobs, extra replicas are removed by ContainerJobs
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const autoscalerInterval = time.Second * 30
+const autoscaleWindow = 120 //Seconds of stats the autoscaler looks at
+const defaultScaleCooldown = 300
+
+// Autoscaling is enabled if MaxReplicas > 0, thresholds equal to 0 are ignored
+type AutoscaleSettings struct {
+	MinReplicas         int
+	MaxReplicas         int
+	ScaleOutCPU         float64 //Average CPU of replicas in percent of one CPU
+	ScaleInCPU          float64
+	ScaleOutMemory      float64 //Average memory of replicas in percent of MemoryLimit (or machine memory)
+	ScaleInMemory       float64
+	ScaleOutRequestRate float64 //Requests per second per replica
+	ScaleInRequestRate  float64
+	ScaleCooldown       int //Seconds between scaling actions, 300 by default
+}
+
+// Environment ID -> time of the last scaling action, kept in memory on the lighthouse
+var lastScaledAt = map[string]time.Time{}
+
+func validateAutoscaleSettings(settings AutoscaleSettings) error {
+	if settings.MaxReplicas == 0 {
+		return nil
+	}
+
+	if settings.MinReplicas < 1 || settings.MinReplicas > settings.MaxReplicas {
+		return errors.New("MinReplicas should be between 1 and MaxReplicas")
+	}
+
+	if settings.ScaleOutCPU <= 0 && settings.ScaleOutMemory <= 0 && settings.ScaleOutRequestRate <= 0 {
+		return errors.New("Set at least one of ScaleOutCPU, ScaleOutMemory or ScaleOutRequestRate")
+	}
+
+	if settings.ScaleOutCPU > 0 && settings.ScaleInCPU >= settings.ScaleOutCPU {
+		return errors.New("ScaleInCPU should be less than ScaleOutCPU")
+	}
+
+	if settings.ScaleOutMemory > 0 && settings.ScaleInMemory >= settings.ScaleOutMemory {
+		return errors.New("ScaleInMemory should be less than ScaleOutMemory")
+	}
+
+	if settings.ScaleOutRequestRate > 0 && settings.ScaleInRequestRate >= settings.ScaleOutRequestRate {
+		return errors.New("ScaleInRequestRate should be less than ScaleOutRequestRate")
+	}
+
+	return nil
+}
+
+func startAutoscaler() {
+
+	// Only lighthouses make scaling decisions
+	if !slices.Contains(thisMachine.Types, MachineTypeLighthouse) {
+		return
+	}
+
+	for range time.Tick(autoscalerInterval) {
+		for _, environment := range getEnvironments() {
+			if environment.MaxReplicas > 0 {
+				autoscaleEnvironment(environment)
+			}
+		}
+	}
+}
+
+func autoscaleEnvironment(environment Environment) {
+	cooldown := environment.ScaleCooldown
+	if cooldown <= 0 {
+		cooldown = defaultScaleCooldown
+	}
+
+	if time.Since(lastScaledAt[environment.Id]) < time.Duration(cooldown)*time.Second {
+		return
+	}
+
+	//Replicas are changed only when no deployment is running, a new deployment starts the current number of replicas anyway
+	deployments := getLastDeploymentByEnvironmentId(environment.Id)
+	if len(deployments) == 0 || deployments[0].Status == DeploymentStatusScheduled || deployments[0].Status == DeploymentStatusBuildingImage || deployments[0].Status == DeploymentStatusStartingContainers {
+		return
+	}
+
+	deployed, _ := getLastDeployedDeployment(environment.Id)
+	if deployed == nil {
+		return
+	}
+
+	//The latest sample of each container, containers of previous deployments can be in the window after a deployment
+	containerStats := map[string]ContainerStats{}
+	for _, stats := range getRecentContainerStatsByEnvironmentId(environment.Id, autoscaleWindow) {
+		if stats.DeploymentId != deployed.Id {
+			continue
+		}
+		if _, isFound := containerStats[stats.MachineId+"/"+stats.ContainerName]; !isFound {
+			containerStats[stats.MachineId+"/"+stats.ContainerName] = stats
+		}
+	}
+
+	if len(containerStats) == 0 {
+		return
+	}
+
+	var cpu float64
+	var memory float64
+	for _, stats := range containerStats {
+		cpu += stats.CPUPercent
+		memory += stats.MemoryPercent
+	}
+	cpu /= float64(len(containerStats))
+	memory /= float64(len(containerStats))
+	requestRate := getRecentRequestRate(environment.Id, autoscaleWindow) / float64(len(containerStats))
+
+	metrics := "CPU " + strconv.FormatFloat(cpu, 'f', 1, 64) + "%, memory " + strconv.FormatFloat(memory, 'f', 1, 64) + "%, " + strconv.FormatFloat(requestRate, 'f', 2, 64) + " requests/s per replica"
+
+	isScaleOut := (environment.ScaleOutCPU > 0 && cpu > environment.ScaleOutCPU) ||
+		(environment.ScaleOutMemory > 0 && memory > environment.ScaleOutMemory) ||
+		(environment.ScaleOutRequestRate > 0 && requestRate > environment.ScaleOutRequestRate)
+
+	//All metrics with thresholds should be low to scale in
+	isScaleIn := (environment.ScaleOutCPU <= 0 || cpu < environment.ScaleInCPU) &&
+		(environment.ScaleOutMemory <= 0 || memory < environment.ScaleInMemory) &&
+		(environment.ScaleOutRequestRate <= 0 || requestRate < environment.ScaleInRequestRate)
+
+	replicas := environment.Replicas
+	switch {
+	case isScaleOut && replicas < environment.MaxReplicas:
+		replicas++
+	case replicas > environment.MaxReplicas:
+		replicas = environment.MaxReplicas
+	case !isScaleOut && isScaleIn && replicas > environment.MinReplicas:
+		replicas--
+	case replicas < environment.MinReplicas:
+		replicas = environment.MinReplicas
+	}
+
+	if replicas == environment.Replicas {
+		return
+	}
+
+	err := scaleEnvironment(environment, replicas, metrics)
+	if err != nil {
+		fmt.Println("Cannot scale environment " + environment.Id + ": " + err.Error())
+		return
+	}
+
+	lastScaledAt[environment.Id] = time.Now()
+}
+
+func scaleEnvironment(environment Environment, replicas int, reason string) error {
+	previousReplicas := environment.Replicas
+
+	deployment := getDeployedDeployment(environment.Id)
+	if deployment == nil {
+		return errors.New("environment has no deployed deployment")
+	}
+
+	environment.Replicas = replicas
+	if !updateEnvironment(environment) {
+		return errors.New("cannot update environment")
+	}
+
+	var envLog EnvironmentLog
+	envLog.EnvironmentId = environment.Id
+	envLog.Level = "5"
+	envLog.MachineId = thisMachine.Id
+	envLog.Message = "Autoscaler: scaling from " + strconv.Itoa(previousReplicas) + " to " + strconv.Itoa(replicas) + " replicas per machine (" + reason + ")"
+	saveEnvironmentLog(envLog)
+
+	//Running replicas are kept, DeploymentJobs start new replica numbers of the deployed deployment and ContainerJobs remove replicas above the new number
+	if replicas > previousReplicas {
+		//Machines where the deployment has failed get all replicas with the next deployment
+		for _, job := range getDeploymentJobsByDeploymentIdAndStatus(deployment.Id, StatusDeployed) {
+			if slices.Contains(environment.MachineIds, job.MachineId) && job.FirstReplica <= 1 {
+				scheduleScaleOutJob(job.MachineId, environment, *deployment, previousReplicas+1)
+			}
+		}
+
+		return nil
+	}
+
+	for _, machineId := range environment.MachineIds {
+		var job ContainerJob
+		job.MachineId = machineId
+		job.Status = ContainerJobStatusPlanned
+		job.JobType = ContainerJobTypeScaleIn
+		job.EnvironmentId = environment.Id
+		addContainerJob(job)
+	}
+
+	return nil
+}
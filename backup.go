@@ -0,0 +1,751 @@
+/*
+Backups of managed databases. Each Database can have one BackupConfig with a cron schedule, a retention count and a target:
+a local directory on the machine with the database, a directory on another machine in VPN or an S3-compatible storage
+*/
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+
+	"github.com/rqlite/gorqlite"
+)
+
+const BackupTargetLocal = "local"
+const BackupTargetMachine = "machine"
+const BackupTargetS3 = "s3"
+
+const BackupStatusScheduled = "scheduled"
+const BackupStatusInProgress = "in_progress"
+const BackupStatusTransferring = "transferring" //A backup is created and should be downloaded by a target machine
+const BackupStatusFinished = "finished"
+const BackupStatusFailed = "failed"
+const BackupStatusToDelete = "scheduled_to_delete"
+
+const RestoreStatusPlanned = "planned"
+const RestoreStatusInProgress = "in_progress"
+const RestoreStatusFinished = "finished"
+const RestoreStatusFailed = "failed"
+
+type BackupConfig struct {
+	Id              string
+	DatabaseId      string
+	Schedule        string //Cron expression, for example "0 3 * * *"
+	RetentionCount  int    //How many finished backups we keep
+	TargetType      string //local, machine or s3
+	TargetPath      string //Directory for local and machine targets, $HOME/turbocloud-backups by default
+	TargetMachineId string
+	S3Endpoint      string
+	S3Region        string
+	S3Bucket        string
+	S3AccessKey     string
+	S3SecretKey     string
+	LastRunAt       string
+}
+
+type Backup struct {
+	Id              string
+	DatabaseId      string
+	BackupConfigId  string
+	Engine          string
+	Status          string
+	TargetType      string
+	MachineId       string //Machine with the backup file for local and machine targets
+	SourceMachineId string //Machine where the backup has been created
+	Path            string //Path on MachineId or S3 object key
+	Size            int64
+	Secret          string `json:"-"` //Secret to download the backup file from another machine
+	ErrorMsg        string
+	CreatedAt       string
+}
+
+type DatabaseRestore struct {
+	Id         string
+	BackupId   string
+	DatabaseId string //Database to restore into, a new database is created if it's empty in POST /backup/{id}/restore
+	Status     string
+	ErrorMsg   string
+	CreatedAt  string
+}
+
+// Config values are used in shell scripts inside single quotes
+var backupConfigValueRegexp = regexp.MustCompile(`^[^'\s]*$`)
+
+func handleBackupConfigPut(w http.ResponseWriter, r *http.Request) {
+	var config BackupConfig
+	err := decodeJSONBody(w, r, &config, true)
+
+	if err != nil {
+		var mr *malformedRequest
+		if errors.As(err, &mr) {
+			http.Error(w, mr.msg, mr.status)
+		} else {
+			log.Print(err.Error())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	database := getDatabaseById(r.PathValue("id"))
+	if database == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	config.DatabaseId = database.Id
+
+	err = validateBackupConfig(*database, &config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !saveBackupConfig(&config) {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	config.S3SecretKey = ""
+
+	jsonBytes, err := json.Marshal(config)
+	if err != nil {
+		fmt.Println("Cannot convert BackupConfig object into JSON:", err)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+func handleBackupConfigGet(w http.ResponseWriter, r *http.Request) {
+
+	config := getBackupConfigByDatabaseId(r.PathValue("id"))
+	if config == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	//Never return S3 secret key
+	config.S3SecretKey = ""
+
+	jsonBytes, err := json.Marshal(config)
+	if err != nil {
+		fmt.Println("Cannot convert BackupConfig object into JSON:", err)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+func handleBackupConfigDelete(w http.ResponseWriter, r *http.Request) {
+
+	if !deleteBackupConfig(r.PathValue("id")) {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprint(w, "")
+}
+
+func handleDatabaseBackupPost(w http.ResponseWriter, r *http.Request) {
+
+	database := getDatabaseById(r.PathValue("id"))
+	if database == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	config := getBackupConfigByDatabaseId(database.Id)
+	if config == nil {
+		http.Error(w, "Backups aren't configured for this database, use PUT /database/{id}/backup-config first", http.StatusBadRequest)
+		return
+	}
+
+	backup := scheduleBackup(*database, *config)
+	if backup == nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(backup)
+	if err != nil {
+		fmt.Println("Cannot convert Backup object into JSON:", err)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+func handleDatabaseBackupGet(w http.ResponseWriter, r *http.Request) {
+
+	jsonBytes, err := json.Marshal(getBackupsByDatabaseId(r.PathValue("id")))
+	if err != nil {
+		fmt.Println("Cannot convert Backup object into JSON:", err)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+func handleBackupRestorePost(w http.ResponseWriter, r *http.Request) {
+	var restore DatabaseRestore
+	err := decodeJSONBody(w, r, &restore, false)
+
+	if err != nil {
+		var mr *malformedRequest
+		if errors.As(err, &mr) {
+			http.Error(w, mr.msg, mr.status)
+		} else {
+			log.Print(err.Error())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	backup := getBackupById(r.PathValue("id"))
+	if backup == nil || backup.Status != BackupStatusFinished {
+		http.Error(w, "Backup not found or not finished yet", http.StatusNotFound)
+		return
+	}
+
+	sourceDatabase := getDatabaseById(backup.DatabaseId)
+
+	if restore.DatabaseId == "" {
+		//Restore into a new database with the same engine, version and password
+		if sourceDatabase == nil {
+			http.Error(w, "Source database has been deleted, specify DatabaseId to restore into an existing database", http.StatusBadRequest)
+			return
+		}
+
+		var database Database
+		database.Name = sourceDatabase.Name + "-restored"
+		database.Engine = sourceDatabase.Engine
+		database.Version = sourceDatabase.Version
+		database.RootPassword = sourceDatabase.RootPassword
+		database.MachineIds = sourceDatabase.MachineIds
+		database.ProjectId = sourceDatabase.ProjectId
+
+		err = applyDatabaseTemplate(&database)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		addDatabase(&database)
+		restore.DatabaseId = database.Id
+	} else {
+		database := getDatabaseById(restore.DatabaseId)
+		if database == nil {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		if database.Engine != backup.Engine {
+			http.Error(w, "Cannot restore a "+backup.Engine+" backup into a "+database.Engine+" database", http.StatusBadRequest)
+			return
+		}
+	}
+
+	restore.BackupId = backup.Id
+	restore.Status = RestoreStatusPlanned
+
+	if !addDatabaseRestore(&restore) {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(restore)
+	if err != nil {
+		fmt.Println("Cannot convert DatabaseRestore object into JSON:", err)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+func handleDatabaseRestoreGet(w http.ResponseWriter, r *http.Request) {
+
+	jsonBytes, err := json.Marshal(getDatabaseRestoresByDatabaseId(r.PathValue("id")))
+	if err != nil {
+		fmt.Println("Cannot convert DatabaseRestore object into JSON:", err)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+// Machines download backup files from each other over VPN, a request is protected by Backup.Secret
+func handleBackupFileGet(w http.ResponseWriter, r *http.Request) {
+
+	backup := getBackupById(r.PathValue("id"))
+	if backup == nil || backup.Secret == "" || subtle.ConstantTimeCompare([]byte(backup.Secret), []byte(r.PathValue("secret"))) != 1 {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	filePath := getBackupLocalFilePath(*backup)
+	if filePath == "" {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	http.ServeFile(w, r, filePath)
+}
+
+/*Internal*/
+
+func validateBackupConfig(database Database, config *BackupConfig) error {
+
+	if getDatabaseTemplate(database.Engine) == nil {
+		return errors.New("Backups are supported only for managed databases (postgres, mysql, redis, mongodb)")
+	}
+
+	if _, err := parseCronSchedule(config.Schedule); err != nil {
+		return err
+	}
+
+	if config.RetentionCount <= 0 {
+		return errors.New("RetentionCount should be greater than 0")
+	}
+
+	for _, value := range []string{config.TargetPath, config.S3Endpoint, config.S3Region, config.S3Bucket, config.S3AccessKey, config.S3SecretKey} {
+		if !backupConfigValueRegexp.MatchString(value) {
+			return errors.New("Backup config values cannot contain whitespaces and quotes")
+		}
+	}
+
+	switch config.TargetType {
+	case BackupTargetLocal:
+	case BackupTargetMachine:
+		if getMachineById(config.TargetMachineId) == nil {
+			return errors.New("Machine with TargetMachineId not found")
+		}
+	case BackupTargetS3:
+		if config.S3Endpoint == "" || config.S3Bucket == "" || config.S3AccessKey == "" || config.S3SecretKey == "" {
+			return errors.New("S3Endpoint, S3Bucket, S3AccessKey and S3SecretKey are required for s3 target")
+		}
+		if config.S3Region == "" {
+			config.S3Region = "us-east-1"
+		}
+	default:
+		return errors.New("TargetType should be one of: local, machine, s3")
+	}
+
+	return nil
+}
+
+func scheduleBackup(database Database, config BackupConfig) *Backup {
+	var backup Backup
+	backup.DatabaseId = database.Id
+	backup.BackupConfigId = config.Id
+	backup.Engine = database.Engine
+	backup.Status = BackupStatusScheduled
+	backup.TargetType = config.TargetType
+
+	if !addBackup(&backup) {
+		return nil
+	}
+
+	return &backup
+}
+
+// Returns a path to the backup file if the file is stored on this machine
+func getBackupLocalFilePath(backup Backup) string {
+	var filePath string
+
+	switch {
+	case backup.Status == BackupStatusFinished && backup.TargetType != BackupTargetS3 && backup.MachineId == thisMachine.Id:
+		filePath = backup.Path
+	case backup.Status == BackupStatusTransferring && backup.SourceMachineId == thisMachine.Id:
+		filePath = getBackupStagingFilePath(backup)
+	default:
+		return ""
+	}
+
+	if _, err := os.Stat(filePath); err != nil {
+		return ""
+	}
+
+	return filePath
+}
+
+// Keeps only RetentionCount last finished backups, files of other backups are deleted by machines with these files
+func applyBackupRetention(databaseId string) {
+	config := getBackupConfigByDatabaseId(databaseId)
+	if config == nil {
+		return
+	}
+
+	finishedBackups := []Backup{}
+	for _, backup := range getBackupsByDatabaseId(databaseId) {
+		if backup.Status == BackupStatusFinished {
+			finishedBackups = append(finishedBackups, backup)
+		}
+	}
+
+	//Backups are sorted from the newest to the oldest
+	for index, backup := range finishedBackups {
+		if index >= config.RetentionCount {
+			updateBackupStatus(backup, BackupStatusToDelete, "")
+		}
+	}
+}
+
+/*Database*/
+
+func saveBackupConfig(config *BackupConfig) bool {
+
+	id, err := NanoId(7)
+	if err != nil {
+		fmt.Println("Cannot generate new NanoId for BackupConfig:", err)
+		return false
+	}
+
+	config.Id = id
+
+	//Each database has only one config
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "DELETE FROM BackupConfig WHERE DatabaseId = ?",
+				Arguments: []interface{}{config.DatabaseId},
+			},
+			{
+				Query:     "INSERT INTO BackupConfig( Id, DatabaseId, Schedule, RetentionCount, TargetType, TargetPath, TargetMachineId, S3Endpoint, S3Region, S3Bucket, S3AccessKey, S3SecretKey, LastRunAt) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+				Arguments: []interface{}{config.Id, config.DatabaseId, config.Schedule, config.RetentionCount, config.TargetType, config.TargetPath, config.TargetMachineId, config.S3Endpoint, config.S3Region, config.S3Bucket, config.S3AccessKey, config.S3SecretKey, config.LastRunAt},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot write to BackupConfig table: %s\n", err.Error())
+		return false
+	}
+
+	return true
+}
+
+func getAllBackupConfigs() []BackupConfig {
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id, DatabaseId, Schedule, RetentionCount, TargetType, TargetPath, TargetMachineId, S3Endpoint, S3Region, S3Bucket, S3AccessKey, S3SecretKey, LastRunAt from BackupConfig",
+			Arguments: []interface{}{},
+		},
+	)
+
+	return handleBackupConfigQuery(rows, err)
+}
+
+func getBackupConfigByDatabaseId(databaseId string) *BackupConfig {
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id, DatabaseId, Schedule, RetentionCount, TargetType, TargetPath, TargetMachineId, S3Endpoint, S3Region, S3Bucket, S3AccessKey, S3SecretKey, LastRunAt from BackupConfig WHERE DatabaseId = ?",
+			Arguments: []interface{}{databaseId},
+		},
+	)
+
+	configs := handleBackupConfigQuery(rows, err)
+	if len(configs) == 0 {
+		return nil
+	}
+
+	return &configs[0]
+}
+
+func updateBackupConfigLastRunAt(config BackupConfig, lastRunAt string) error {
+
+	_, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "UPDATE BackupConfig SET LastRunAt = ? WHERE Id = ?",
+				Arguments: []interface{}{lastRunAt, config.Id},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf("Cannot update a row in BackupConfig: %s\n", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func deleteBackupConfig(databaseId string) bool {
+	_, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "DELETE FROM BackupConfig WHERE DatabaseId = ?",
+				Arguments: []interface{}{databaseId},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot delete a record from BackupConfig table: %s\n", err.Error())
+		return false
+	}
+
+	return true
+}
+
+func handleBackupConfigQuery(rows gorqlite.QueryResult, err error) []BackupConfig {
+
+	var configs = []BackupConfig{}
+
+	if err != nil {
+		fmt.Printf(" Cannot read from BackupConfig table: %s\n", err.Error())
+	}
+
+	for rows.Next() {
+		var config BackupConfig
+
+		err := rows.Scan(&config.Id, &config.DatabaseId, &config.Schedule, &config.RetentionCount, &config.TargetType, &config.TargetPath, &config.TargetMachineId, &config.S3Endpoint, &config.S3Region, &config.S3Bucket, &config.S3AccessKey, &config.S3SecretKey, &config.LastRunAt)
+		if err != nil {
+			fmt.Printf(" Cannot run Scan: %s\n", err.Error())
+		}
+
+		configs = append(configs, config)
+	}
+
+	return configs
+}
+
+func addBackup(backup *Backup) bool {
+
+	id, err := NanoId(7)
+	if err != nil {
+		fmt.Println("Cannot generate new NanoId for Backup:", err)
+		return false
+	}
+
+	backup.Id = id
+
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "INSERT INTO Backup( Id, DatabaseId, BackupConfigId, Engine, Status, TargetType, MachineId, SourceMachineId, Path, Size, Secret, ErrorMsg) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+				Arguments: []interface{}{backup.Id, backup.DatabaseId, backup.BackupConfigId, backup.Engine, backup.Status, backup.TargetType, backup.MachineId, backup.SourceMachineId, backup.Path, backup.Size, backup.Secret, backup.ErrorMsg},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot write to Backup table: %s\n", err.Error())
+		return false
+	}
+
+	return true
+}
+
+func updateBackup(backup Backup) error {
+
+	_, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "UPDATE Backup SET Status = ?, MachineId = ?, SourceMachineId = ?, Path = ?, Size = ?, Secret = ?, ErrorMsg = ? WHERE Id = ?",
+				Arguments: []interface{}{backup.Status, backup.MachineId, backup.SourceMachineId, backup.Path, backup.Size, backup.Secret, backup.ErrorMsg, backup.Id},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf("Cannot update a row in Backup: %s\n", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func updateBackupStatus(backup Backup, status string, errorMsg string) error {
+	backup.Status = status
+	backup.ErrorMsg = errorMsg
+	return updateBackup(backup)
+}
+
+func getBackupById(backupId string) *Backup {
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id, DatabaseId, BackupConfigId, Engine, Status, TargetType, MachineId, SourceMachineId, Path, Size, Secret, ErrorMsg, CreatedAt from Backup WHERE Id = ?",
+			Arguments: []interface{}{backupId},
+		},
+	)
+
+	backups := handleBackupQuery(rows, err)
+	if len(backups) == 0 {
+		return nil
+	}
+
+	return &backups[0]
+}
+
+func getBackupsByDatabaseId(databaseId string) []Backup {
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id, DatabaseId, BackupConfigId, Engine, Status, TargetType, MachineId, SourceMachineId, Path, Size, Secret, ErrorMsg, CreatedAt from Backup WHERE DatabaseId = ? ORDER BY CreatedAt DESC",
+			Arguments: []interface{}{databaseId},
+		},
+	)
+
+	return handleBackupQuery(rows, err)
+}
+
+func getBackupsByStatus(status string) []Backup {
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id, DatabaseId, BackupConfigId, Engine, Status, TargetType, MachineId, SourceMachineId, Path, Size, Secret, ErrorMsg, CreatedAt from Backup WHERE Status = ?",
+			Arguments: []interface{}{status},
+		},
+	)
+
+	return handleBackupQuery(rows, err)
+}
+
+func deleteBackup(backupId string) bool {
+	_, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "DELETE FROM Backup WHERE Id = ?",
+				Arguments: []interface{}{backupId},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot delete a record from Backup table: %s\n", err.Error())
+		return false
+	}
+
+	return true
+}
+
+func handleBackupQuery(rows gorqlite.QueryResult, err error) []Backup {
+
+	var backups = []Backup{}
+
+	if err != nil {
+		fmt.Printf(" Cannot read from Backup table: %s\n", err.Error())
+	}
+
+	for rows.Next() {
+		var backup Backup
+
+		err := rows.Scan(&backup.Id, &backup.DatabaseId, &backup.BackupConfigId, &backup.Engine, &backup.Status, &backup.TargetType, &backup.MachineId, &backup.SourceMachineId, &backup.Path, &backup.Size, &backup.Secret, &backup.ErrorMsg, &backup.CreatedAt)
+		if err != nil {
+			fmt.Printf(" Cannot run Scan: %s\n", err.Error())
+		}
+
+		backups = append(backups, backup)
+	}
+
+	return backups
+}
+
+func addDatabaseRestore(restore *DatabaseRestore) bool {
+
+	id, err := NanoId(7)
+	if err != nil {
+		fmt.Println("Cannot generate new NanoId for DatabaseRestore:", err)
+		return false
+	}
+
+	restore.Id = id
+
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "INSERT INTO DatabaseRestore( Id, BackupId, DatabaseId, Status, ErrorMsg) VALUES(?, ?, ?, ?, ?)",
+				Arguments: []interface{}{restore.Id, restore.BackupId, restore.DatabaseId, restore.Status, restore.ErrorMsg},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot write to DatabaseRestore table: %s\n", err.Error())
+		return false
+	}
+
+	return true
+}
+
+func updateDatabaseRestoreStatus(restore DatabaseRestore, status string, errorMsg string) error {
+
+	_, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "UPDATE DatabaseRestore SET Status = ?, ErrorMsg = ? WHERE Id = ?",
+				Arguments: []interface{}{status, errorMsg, restore.Id},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf("Cannot update a row in DatabaseRestore: %s\n", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func getDatabaseRestoresByDatabaseId(databaseId string) []DatabaseRestore {
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id, BackupId, DatabaseId, Status, ErrorMsg, CreatedAt from DatabaseRestore WHERE DatabaseId = ? ORDER BY CreatedAt DESC",
+			Arguments: []interface{}{databaseId},
+		},
+	)
+
+	return handleDatabaseRestoreQuery(rows, err)
+}
+
+func getDatabaseRestoresByStatus(status string) []DatabaseRestore {
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id, BackupId, DatabaseId, Status, ErrorMsg, CreatedAt from DatabaseRestore WHERE Status = ?",
+			Arguments: []interface{}{status},
+		},
+	)
+
+	return handleDatabaseRestoreQuery(rows, err)
+}
+
+func handleDatabaseRestoreQuery(rows gorqlite.QueryResult, err error) []DatabaseRestore {
+
+	var restores = []DatabaseRestore{}
+
+	if err != nil {
+		fmt.Printf(" Cannot read from DatabaseRestore table: %s\n", err.Error())
+	}
+
+	for rows.Next() {
+		var restore DatabaseRestore
+
+		err := rows.Scan(&restore.Id, &restore.BackupId, &restore.DatabaseId, &restore.Status, &restore.ErrorMsg, &restore.CreatedAt)
+		if err != nil {
+			fmt.Printf(" Cannot run Scan: %s\n", err.Error())
+		}
+
+		restores = append(restores, restore)
+	}
+
+	return restores
+}
+
+// Returns true if the primary container of a database runs on this machine
+func isDatabasePrimaryOnThisMachine(database Database) bool {
+	job := getDatabasePrimaryJob(database)
+	return job != nil && job.MachineId == thisMachine.Id
+}
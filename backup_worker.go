@@ -0,0 +1,518 @@
+/*
+Backup worker runs on every machine. A machine with the primary container of a database creates dumps, a target machine
+downloads dumps over VPN, a machine with a backup file removes it when the backup is out of retention
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Downloads can take longer than one tick of the worker, we don't start a second download of the same backup
+var downloadingBackupIds sync.Map
+
+func startBackupWorker() {
+	for range time.Tick(time.Second * 20) {
+		go func() {
+			scheduleBackupsByCron()
+
+			for _, backup := range getBackupsByStatus(BackupStatusScheduled) {
+				database := getDatabaseById(backup.DatabaseId)
+				if database != nil && isDatabasePrimaryOnThisMachine(*database) {
+					runBackup(*database, backup)
+				}
+			}
+
+			for _, backup := range getBackupsByStatus(BackupStatusTransferring) {
+				config := getBackupConfigByDatabaseId(backup.DatabaseId)
+				if config != nil && config.TargetMachineId == thisMachine.Id {
+					downloadBackupFromMachine(*config, backup)
+				}
+			}
+
+			for _, backup := range getBackupsByStatus(BackupStatusToDelete) {
+				removeBackupFile(backup)
+			}
+
+			removeTransferredStagingFiles()
+
+			for _, restore := range getDatabaseRestoresByStatus(RestoreStatusPlanned) {
+				database := getDatabaseById(restore.DatabaseId)
+				if database != nil && database.Status == DatabaseStatusFinished && isDatabasePrimaryOnThisMachine(*database) {
+					runDatabaseRestore(*database, restore)
+				}
+			}
+		}()
+	}
+}
+
+func scheduleBackupsByCron() {
+	now := time.Now().UTC()
+	currentMinute := now.Format("2006-01-02 15:04")
+
+	for _, config := range getAllBackupConfigs() {
+		//The worker runs a few times per minute, we create only one backup per matching minute
+		if config.LastRunAt == currentMinute {
+			continue
+		}
+
+		schedule, err := parseCronSchedule(config.Schedule)
+		if err != nil || !schedule.Matches(now) {
+			continue
+		}
+
+		database := getDatabaseById(config.DatabaseId)
+		if database == nil || database.Status != DatabaseStatusFinished || !isDatabasePrimaryOnThisMachine(*database) {
+			continue
+		}
+
+		if updateBackupConfigLastRunAt(config, currentMinute) != nil {
+			continue
+		}
+
+		fmt.Println("Scheduling a backup of Database " + database.Id)
+		scheduleBackup(*database, config)
+	}
+}
+
+func runBackup(database Database, backup Backup) {
+	fmt.Println("Creating backup " + backup.Id + " of Database " + database.Id)
+
+	backup.Status = BackupStatusInProgress
+	backup.SourceMachineId = thisMachine.Id
+	if updateBackup(backup) != nil {
+		return
+	}
+
+	config := getBackupConfigByDatabaseId(database.Id)
+	if config == nil {
+		updateBackupStatus(backup, BackupStatusFailed, "Backup config has been deleted")
+		return
+	}
+
+	stagingPath := getBackupStagingFilePath(backup)
+	err := os.MkdirAll(filepath.Dir(stagingPath), 0700)
+	if err != nil {
+		updateBackupStatus(backup, BackupStatusFailed, "Cannot create a directory for backups: "+err.Error())
+		return
+	}
+
+	dumpCommand := getDatabaseDumpCommand(database)
+	if dumpCommand == "" {
+		updateBackupStatus(backup, BackupStatusFailed, "Backups aren't supported for engine '"+database.Engine+"'")
+		return
+	}
+
+	scriptTemplate := createTemplate("backup_database", `
+	#!/bin/sh
+	set -e
+	{{.DUMP_COMMAND}} > {{.FILE_PATH}}.dump
+	gzip -c {{.FILE_PATH}}.dump > {{.FILE_PATH}}
+	rm -f {{.FILE_PATH}}.dump
+`)
+
+	var templateBytes bytes.Buffer
+	templateData := map[string]string{
+		"DUMP_COMMAND": dumpCommand,
+		"FILE_PATH":    stagingPath,
+	}
+
+	if err := scriptTemplate.Execute(&templateBytes, templateData); err != nil {
+		fmt.Println("Cannot execute template for backing up a database:", err)
+		return
+	}
+
+	output, err := executeScriptString(templateBytes.String(), func(logLine string) {})
+	if err != nil {
+		os.Remove(stagingPath)
+		os.Remove(stagingPath + ".dump")
+		updateBackupStatus(backup, BackupStatusFailed, "Dump failed: "+lastLines(output, 5))
+		return
+	}
+
+	fileInfo, err := os.Stat(stagingPath)
+	if err != nil {
+		updateBackupStatus(backup, BackupStatusFailed, "Cannot find a dump file: "+err.Error())
+		return
+	}
+	backup.Size = fileInfo.Size()
+
+	switch config.TargetType {
+	case BackupTargetLocal:
+		targetDir := config.TargetPath
+		if targetDir == "" {
+			targetDir = filepath.Dir(stagingPath)
+		}
+		backup.Path = filepath.Join(targetDir, filepath.Base(stagingPath))
+
+		err = moveBackupFile(stagingPath, backup.Path)
+		if err != nil {
+			updateBackupStatus(backup, BackupStatusFailed, "Cannot move a backup file: "+err.Error())
+			return
+		}
+
+		backup.MachineId = thisMachine.Id
+		backup.Status = BackupStatusFinished
+	case BackupTargetS3:
+		backup.Path = database.Id + "/" + filepath.Base(stagingPath)
+
+		err = uploadBackupToS3(*config, stagingPath, backup.Path)
+		os.Remove(stagingPath)
+		if err != nil {
+			updateBackupStatus(backup, BackupStatusFailed, err.Error())
+			return
+		}
+
+		backup.Status = BackupStatusFinished
+	case BackupTargetMachine:
+		//The target machine downloads the file and finishes the backup, then we remove the staging file
+		secret, err := NanoId(32)
+		if err != nil {
+			updateBackupStatus(backup, BackupStatusFailed, "Cannot generate a secret for a backup file")
+			return
+		}
+		backup.Secret = secret
+		backup.Status = BackupStatusTransferring
+	}
+
+	backup.ErrorMsg = ""
+	if updateBackup(backup) != nil {
+		return
+	}
+
+	if backup.Status == BackupStatusFinished {
+		fmt.Println("Backup " + backup.Id + " of Database " + database.Id + " has been created")
+		applyBackupRetention(database.Id)
+	}
+}
+
+func downloadBackupFromMachine(config BackupConfig, backup Backup) {
+	if _, isDownloading := downloadingBackupIds.LoadOrStore(backup.Id, true); isDownloading {
+		return
+	}
+	defer downloadingBackupIds.Delete(backup.Id)
+
+	sourceMachine := getMachineById(backup.SourceMachineId)
+	if sourceMachine == nil {
+		updateBackupStatus(backup, BackupStatusFailed, "Source machine has been deleted")
+		return
+	}
+
+	targetDir := config.TargetPath
+	if targetDir == "" {
+		targetDir = filepath.Dir(getBackupStagingFilePath(backup))
+	}
+	targetPath := filepath.Join(targetDir, backup.Id+".gz")
+
+	err := os.MkdirAll(targetDir, 0700)
+	if err != nil {
+		updateBackupStatus(backup, BackupStatusFailed, "Cannot create a directory for backups: "+err.Error())
+		return
+	}
+
+	if sourceMachine.Id == thisMachine.Id {
+		//A target machine is the machine with the database, we don't need to download anything
+		err = moveBackupFile(getBackupStagingFilePath(backup), targetPath)
+		if err != nil {
+			updateBackupStatus(backup, BackupStatusFailed, "Cannot move a backup file: "+err.Error())
+			return
+		}
+	} else {
+		response, err := http.Get("http://" + sourceMachine.VPNIp + ":" + PORT + "/backup/" + backup.Id + "/file/" + backup.Secret)
+		if err != nil {
+			//The source machine can be offline for a while, we try again on the next tick
+			fmt.Println("Cannot download backup "+backup.Id+":", err)
+			return
+		}
+		defer response.Body.Close()
+
+		if response.StatusCode != http.StatusOK {
+			updateBackupStatus(backup, BackupStatusFailed, "Cannot download a backup file, source machine returned "+response.Status)
+			return
+		}
+
+		file, err := os.OpenFile(targetPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			updateBackupStatus(backup, BackupStatusFailed, "Cannot create a backup file: "+err.Error())
+			return
+		}
+
+		_, err = io.Copy(file, response.Body)
+		file.Close()
+		if err != nil {
+			os.Remove(targetPath)
+			fmt.Println("Cannot download backup "+backup.Id+":", err)
+			return
+		}
+	}
+
+	backup.Path = targetPath
+	backup.MachineId = thisMachine.Id
+	backup.Status = BackupStatusFinished
+	backup.ErrorMsg = ""
+	if updateBackup(backup) != nil {
+		return
+	}
+
+	fmt.Println("Backup " + backup.Id + " has been downloaded from machine " + sourceMachine.Id)
+	applyBackupRetention(backup.DatabaseId)
+}
+
+func removeBackupFile(backup Backup) {
+	switch {
+	case backup.TargetType == BackupTargetS3 && backup.SourceMachineId == thisMachine.Id:
+		config := getBackupConfigByDatabaseId(backup.DatabaseId)
+		if config != nil {
+			err := removeBackupFromS3(*config, backup.Path)
+			if err != nil {
+				fmt.Println("Cannot remove backup "+backup.Id+" from S3:", err)
+				return
+			}
+		}
+	case backup.TargetType != BackupTargetS3 && backup.MachineId == thisMachine.Id:
+		err := os.Remove(backup.Path)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Println("Cannot remove backup file "+backup.Path+":", err)
+			return
+		}
+	default:
+		return
+	}
+
+	fmt.Println("Backup " + backup.Id + " has been removed")
+	deleteBackup(backup.Id)
+}
+
+// A source machine removes its copy of a dump when a target machine has downloaded it
+func removeTransferredStagingFiles() {
+	for _, backup := range getBackupsByStatus(BackupStatusFinished) {
+		if backup.TargetType != BackupTargetMachine || backup.SourceMachineId != thisMachine.Id || backup.MachineId == thisMachine.Id {
+			continue
+		}
+
+		err := os.Remove(getBackupStagingFilePath(backup))
+		if err == nil {
+			fmt.Println("Backup " + backup.Id + " has been transferred to machine " + backup.MachineId + ", a local copy has been removed")
+		}
+	}
+}
+
+func runDatabaseRestore(database Database, restore DatabaseRestore) {
+	fmt.Println("Restoring backup " + restore.BackupId + " into Database " + database.Id)
+
+	if updateDatabaseRestoreStatus(restore, RestoreStatusInProgress, "") != nil {
+		return
+	}
+
+	backup := getBackupById(restore.BackupId)
+	if backup == nil || backup.Status != BackupStatusFinished {
+		updateDatabaseRestoreStatus(restore, RestoreStatusFailed, "Backup not found")
+		return
+	}
+
+	//Load a backup file into a temporary file on this machine
+	filePath := getBackupStagingFilePath(*backup) + ".restore-" + restore.Id
+	err := os.MkdirAll(filepath.Dir(filePath), 0700)
+	if err != nil {
+		updateDatabaseRestoreStatus(restore, RestoreStatusFailed, "Cannot create a directory for backups: "+err.Error())
+		return
+	}
+	defer os.Remove(filePath)
+
+	err = loadBackupFile(*backup, filePath)
+	if err != nil {
+		updateDatabaseRestoreStatus(restore, RestoreStatusFailed, err.Error())
+		return
+	}
+
+	restoreScript := getDatabaseRestoreScript(database, filePath)
+	if restoreScript == "" {
+		updateDatabaseRestoreStatus(restore, RestoreStatusFailed, "Restores aren't supported for engine '"+database.Engine+"'")
+		return
+	}
+
+	output, err := executeScriptString("#!/bin/sh\nset -e\n"+restoreScript+"\n", func(logLine string) {})
+	if err != nil {
+		updateDatabaseRestoreStatus(restore, RestoreStatusFailed, "Restore failed: "+lastLines(output, 5))
+		return
+	}
+
+	fmt.Println("Backup " + backup.Id + " has been restored into Database " + database.Id)
+	updateDatabaseRestoreStatus(restore, RestoreStatusFinished, "")
+}
+
+// Copies a backup file from a local directory, another machine or S3 into filePath
+func loadBackupFile(backup Backup, filePath string) error {
+	switch {
+	case backup.TargetType == BackupTargetS3:
+		config := getBackupConfigByDatabaseId(backup.DatabaseId)
+		if config == nil {
+			return fmt.Errorf("backup config with S3 credentials has been deleted")
+		}
+		return downloadBackupFromS3(*config, backup.Path, filePath)
+	case backup.MachineId == thisMachine.Id:
+		return copyBackupFile(backup.Path, filePath)
+	default:
+		machine := getMachineById(backup.MachineId)
+		if machine == nil {
+			return fmt.Errorf("machine with the backup file has been deleted")
+		}
+
+		response, err := http.Get("http://" + machine.VPNIp + ":" + PORT + "/backup/" + backup.Id + "/file/" + backup.Secret)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+
+		if response.StatusCode != http.StatusOK {
+			return fmt.Errorf("cannot download a backup file, machine %s returned %s", machine.Id, response.Status)
+		}
+
+		file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = io.Copy(file, response.Body)
+		return err
+	}
+}
+
+// Dump commands write an uncompressed dump into stdout
+func getDatabaseDumpCommand(database Database) string {
+	containerName := getDatabaseContainerName(database.Id)
+
+	switch database.Engine {
+	case DatabaseEnginePostgres:
+		return "docker exec " + containerName + " pg_dumpall -U postgres --clean --if-exists"
+	case DatabaseEngineMySQL:
+		return "docker exec " + containerName + ` sh -c 'exec mysqldump -uroot -p"$MYSQL_ROOT_PASSWORD" --single-transaction --routines --events --databases $(mysql -uroot -p"$MYSQL_ROOT_PASSWORD" -N -e "SHOW DATABASES" | grep -Ev "^(mysql|sys|information_schema|performance_schema)$")'`
+	case DatabaseEngineRedis:
+		//set -e doesn't stop a script on a failed command in an && list, and redis-cli can exit with 0 on error replies, so the reply is checked
+		return "docker exec " + containerName + " redis-cli -a " + database.RootPassword + " --no-auth-warning SAVE | grep -qx OK || exit 1; docker exec " + containerName + " cat " + database.DataPath + "/dump.rdb"
+	case DatabaseEngineMongoDB:
+		return "docker exec " + containerName + " mongodump --quiet --archive -u root -p " + database.RootPassword + " --authenticationDatabase admin"
+	}
+
+	return ""
+}
+
+// Restore scripts read a gzipped dump from filePath
+func getDatabaseRestoreScript(database Database, filePath string) string {
+	containerName := getDatabaseContainerName(database.Id)
+
+	switch database.Engine {
+	case DatabaseEnginePostgres:
+		//A dump contains the password of the source database, we set the password of this database back
+		return "gunzip -c " + filePath + " | docker exec -i " + containerName + " psql -U postgres -q -d postgres\n" +
+			"docker exec " + containerName + ` psql -U postgres -q -c "ALTER USER postgres PASSWORD '` + database.RootPassword + `'"`
+	case DatabaseEngineMySQL:
+		return "gunzip -c " + filePath + " | docker exec -i " + containerName + ` sh -c 'exec mysql -uroot -p"$MYSQL_ROOT_PASSWORD"'`
+	case DatabaseEngineRedis:
+		//Redis loads RDB files only on start, AOF files should be removed, otherwise Redis loads data from them
+		return "docker stop " + containerName + "\n" +
+			"gunzip -c " + filePath + " | docker run --rm -i -v " + database.VolumeId + ":" + database.DataPath + " alpine sh -c 'rm -rf " + database.DataPath + "/appendonlydir " + database.DataPath + "/*.aof && cat > " + database.DataPath + "/dump.rdb'\n" +
+			"docker start " + containerName
+	case DatabaseEngineMongoDB:
+		return "gunzip -c " + filePath + " | docker exec -i " + containerName + " mongorestore --quiet --archive --drop --nsExclude 'admin.*' -u root -p " + database.RootPassword + " --authenticationDatabase admin"
+	}
+
+	return ""
+}
+
+func uploadBackupToS3(config BackupConfig, filePath string, key string) error {
+	output, err := executeScriptString(getS3Command(config, "cp "+filePath+" s3://"+config.S3Bucket+"/"+key), func(logLine string) {})
+	if err != nil {
+		return fmt.Errorf("cannot upload a backup to S3: %s", lastLines(output, 5))
+	}
+	return nil
+}
+
+func downloadBackupFromS3(config BackupConfig, key string, filePath string) error {
+	output, err := executeScriptString(getS3Command(config, "cp s3://"+config.S3Bucket+"/"+key+" "+filePath), func(logLine string) {})
+	if err != nil {
+		return fmt.Errorf("cannot download a backup from S3: %s", lastLines(output, 5))
+	}
+	return nil
+}
+
+func removeBackupFromS3(config BackupConfig, key string) error {
+	output, err := executeScriptString(getS3Command(config, "rm s3://"+config.S3Bucket+"/"+key), func(logLine string) {})
+	if err != nil {
+		return fmt.Errorf("cannot remove a backup from S3: %s", lastLines(output, 5))
+	}
+	return nil
+}
+
+// We run AWS CLI in a container, so it works with any S3-compatible storage (MinIO, R2, etc.) without installing anything on a machine
+func getS3Command(config BackupConfig, arguments string) string {
+	dir := getBackupsDir()
+	return "docker run --rm --network host -v " + dir + ":" + dir +
+		" -e AWS_ACCESS_KEY_ID='" + config.S3AccessKey + "' -e AWS_SECRET_ACCESS_KEY='" + config.S3SecretKey + "' -e AWS_DEFAULT_REGION='" + config.S3Region + "'" +
+		" amazon/aws-cli --endpoint-url '" + config.S3Endpoint + "' s3 " + arguments
+}
+
+func getBackupsDir() string {
+	currentUser, err := user.Current()
+	if err != nil {
+		fmt.Println("Cannot get home directory:", err)
+		return ""
+	}
+
+	return filepath.Join(currentUser.HomeDir, "turbocloud-backups")
+}
+
+// Dumps are created in $HOME/turbocloud-backups/{databaseId}/ and moved to a target after that
+func getBackupStagingFilePath(backup Backup) string {
+	return filepath.Join(getBackupsDir(), backup.DatabaseId, backup.Id+".gz")
+}
+
+func moveBackupFile(sourcePath string, targetPath string) error {
+	if sourcePath == targetPath {
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(targetPath), 0700)
+	if err != nil {
+		return err
+	}
+
+	//Rename doesn't work across file systems, we copy a file in this case
+	if os.Rename(sourcePath, targetPath) == nil {
+		return nil
+	}
+
+	err = copyBackupFile(sourcePath, targetPath)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(sourcePath)
+}
+
+func copyBackupFile(sourcePath string, targetPath string) error {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	target, err := os.OpenFile(targetPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	_, err = io.Copy(target, source)
+	return err
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetDatabaseDumpCommandRedis(t *testing.T) {
+	database := Database{Id: "abc", Engine: DatabaseEngineRedis, RootPassword: "secret", DataPath: "/data"}
+
+	command := getDatabaseDumpCommand(database)
+	expected := "docker exec db-abc redis-cli -a secret --no-auth-warning SAVE | grep -qx OK || exit 1; docker exec db-abc cat /data/dump.rdb"
+	if command != expected {
+		t.Fatalf("getDatabaseDumpCommand() = %q, want %q", command, expected)
+	}
+}
+
+// Runs the dump command as the backup script does, with a fake docker that replies to SAVE with saveReply
+func TestRedisDumpStopsWhenSaveFails(t *testing.T) {
+	database := Database{Id: "abc", Engine: DatabaseEngineRedis, RootPassword: "secret", DataPath: "/data"}
+
+	tests := []struct {
+		saveReply string
+		isSaved   bool
+	}{
+		{"OK", true},
+		{"ERR Background save already in progress", false},
+		{"NOAUTH Authentication required.", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		dir := t.TempDir()
+		fakeDocker := "#!/bin/sh\nfor arg; do last=$arg; done\nif [ \"$last\" = SAVE ]; then echo '" + test.saveReply + "'; else echo RDB; fi\n"
+		err := os.WriteFile(filepath.Join(dir, "docker"), []byte(fakeDocker), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dumpPath := filepath.Join(dir, "backup.dump")
+		cmd := exec.Command("sh", "-c", "set -e\n"+getDatabaseDumpCommand(database)+" > "+dumpPath)
+		cmd.Env = append(os.Environ(), "PATH="+dir+":"+os.Getenv("PATH"))
+		err = cmd.Run()
+
+		if test.isSaved {
+			dump, _ := os.ReadFile(dumpPath)
+			if err != nil || string(dump) != "RDB\n" {
+				t.Errorf("SAVE reply %q: err = %v, dump = %q, want the dump", test.saveReply, err, dump)
+			}
+		} else if err == nil {
+			t.Errorf("SAVE reply %q: script succeeded, want a failed backup", test.saveReply)
+		}
+	}
+}
@@ -7,12 +7,16 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/rqlite/gorqlite"
 )
 
 const ContainerJobTypeDelete = "container_del"
+const ContainerJobTypeScaleIn = "container_scale_in" //Removes replicas with numbers greater than Environment.Replicas
 
 const ContainerJobStatusPlanned = "planned"
 const ContainerJobStatusFinished = "finished"
@@ -97,32 +101,123 @@ func handleContainerJobQuery(rows gorqlite.QueryResult, err error) []ContainerJo
 
 }
 
-func stopPreviousContainer(environmentId string) {
-	//Stop old container
-	//Get all deployments and take the previous to get deploymentId that we use a container name
+func stopPreviousContainer(deployment Deployment) {
+	//Stop old containers
+	//Previous deployments can fail on this machine, so we stop containers of the most recent deployment that has been deployed here
+	deployments := getDeploymentsByEnvironmentId(deployment.EnvironmentId)
+	isPrevious := false
+	for _, previousDeployment := range deployments {
+		if previousDeployment.Id == deployment.Id {
+			isPrevious = true
+			continue
+		}
+		if !isPrevious {
+			continue
+		}
+
+		for _, job := range getDeploymentJobsByDeploymentIdAndStatus(previousDeployment.Id, StatusDeployed) {
+			if job.MachineId == thisMachine.Id {
+				stopAndRemoveContainer(previousDeployment.Id)
+				return
+			}
+		}
+	}
+}
+
+// Stops containers of an environment on this machine
+// The last deployment is not always deployed here (it could fail or the environment could be moved), so we look for the most recent deployed one
+func stopEnvironmentContainers(environmentId string) {
 	deployments := getDeploymentsByEnvironmentId(environmentId)
-	if len(deployments) > 1 {
-		//Stop the previous container
-		stopAndRemoveContainer(deployments[1].Id)
+	if len(deployments) == 0 {
+		return
+	}
+
+	//The last deployment can still be starting containers
+	stopAndRemoveContainer(deployments[0].Id)
+
+	deployment := getDeployedDeploymentOnThisMachine(environmentId)
+	if deployment != nil && deployment.Id != deployments[0].Id {
+		stopAndRemoveContainer(deployment.Id)
+	}
+}
+
+// The most recent deployment of an environment that has been deployed on this machine
+func getDeployedDeploymentOnThisMachine(environmentId string) *Deployment {
+	for _, deployment := range getDeploymentsByEnvironmentId(environmentId) {
+		for _, job := range getDeploymentJobsByDeploymentIdAndStatus(deployment.Id, StatusDeployed) {
+			if job.MachineId == thisMachine.Id {
+				return &deployment
+			}
+		}
 	}
+
+	return nil
+}
+
+// Removes replicas of the deployed deployment with numbers greater than Environment.Replicas
+func removeExtraReplicas(environmentId string) {
+	environment := getEnvironmentById(environmentId)
+	deployment := getDeployedDeploymentOnThisMachine(environmentId)
+	if environment == nil || deployment == nil {
+		return
+	}
+
+	removeReplicasFrom(deployment.Id, environment.Replicas+1)
+}
+
+// Removes replicas of a deployment with numbers from firstReplica on this machine
+// Proxies are removed first, so Caddy stops sending requests to these replicas before they are stopped
+func removeReplicasFrom(deploymentId string, firstReplica int) {
+	output, err := exec.Command("docker", "ps", "-a", "--filter", "name=^/?"+deploymentId+"\\.", "--format", "{{.Names}}").Output()
+	if err != nil {
+		fmt.Println("Cannot list containers of deployment "+deploymentId+":", err)
+		return
+	}
+
+	extraContainers := []string{}
+	for _, containerName := range strings.Fields(string(output)) {
+		_, replica, isDeployment := parseContainerName(containerName)
+		if isDeployment && replica >= firstReplica {
+			extraContainers = append(extraContainers, containerName)
+			deleteProxiesByContainerId(containerName, thisMachine.VPNIp)
+		}
+	}
+
+	if len(extraContainers) == 0 {
+		return
+	}
+
+	time.Sleep(proxyDrainPeriod)
+
+	_, err = exec.Command("docker", append([]string{"container", "rm", "-f"}, extraContainers...)...).Output()
+	if err != nil {
+		fmt.Println("Cannot remove replicas of deployment "+deploymentId+":", err)
+		return
+	}
+
+	fmt.Printf("Removed %d replicas of deployment %s\n", len(extraContainers), deploymentId)
 }
 
 func stopAndRemoveContainer(deploymentId string) {
-	fmt.Printf("Removing container with ID %s\n", deploymentId)
+	fmt.Printf("Removing containers of deployment with ID %s\n", deploymentId)
 
-	scriptTemplate := createTemplate("caddyfile", `
+	//An environment can have more replicas now than when a deployment was started, so we remove all containers "deploymentId.*"
+	scriptTemplate := createTemplate("remove_containers", `
 	#!/bin/sh
-	docker stop {{.DEPLOYMENT_ID}}
-	docker container rm -f {{.DEPLOYMENT_ID}}
+	CONTAINER_IDS=$(docker ps -aq --filter "name=^/?{{.DEPLOYMENT_ID}}\.")
+	if [ -n "$CONTAINER_IDS" ]; then
+		docker stop $CONTAINER_IDS
+		docker container rm -f $CONTAINER_IDS
+	fi
 `)
 
 	var templateBytes bytes.Buffer
 	templateData := map[string]string{
-		"DEPLOYMENT_ID": deploymentId + ".1",
+		"DEPLOYMENT_ID": deploymentId,
 	}
 
 	if err := scriptTemplate.Execute(&templateBytes, templateData); err != nil {
-		fmt.Println("Cannot execute template for Caddyfile:", err)
+		fmt.Println("Cannot execute template for removing containers:", err)
 	}
 
 	scriptString := templateBytes.String()
@@ -143,6 +238,26 @@ func stopAndRemoveContainer(deploymentId string) {
 	}
 }
 
+// Container names have format "deploymentId.replica_number", replicas start from 1
+func getContainerName(deploymentId string, replica int) string {
+	return deploymentId + "." + strconv.Itoa(replica)
+}
+
+// Returns deploymentId and a replica number of a deployment container, isDeployment is false for other containers (databases, etc.)
+func parseContainerName(containerName string) (deploymentId string, replica int, isDeployment bool) {
+	deploymentId, replicaString, isFound := strings.Cut(containerName, ".")
+	if !isFound {
+		return "", 0, false
+	}
+
+	replica, err := strconv.Atoi(replicaString)
+	if err != nil || replica < 1 {
+		return "", 0, false
+	}
+
+	return deploymentId, replica, true
+}
+
 func startContainerJobsCheckerWorker() {
 	for range time.Tick(time.Second * 5) {
 		go func() {
@@ -150,17 +265,18 @@ func startContainerJobsCheckerWorker() {
 			if len(containerJobs) > 0 {
 				fmt.Printf("Found %d ContainerJobs with status %s\n", len(containerJobs), ContainerJobStatusPlanned)
 				for _, containerJob := range containerJobs {
-					//Find all deployments
-					deployments := getLastDeploymentByEnvironmentId(containerJob.EnvironmentId)
-					if len(deployments) > 0 {
-						//Stop the last container only because all previous should be stopped and removed already
-						stopAndRemoveContainer(deployments[0].Id)
-						//Update ContainerJob status
-						updateContainerJobStatus(containerJob, ContainerJobStatusFinished)
-					}
+					stopEnvironmentContainers(containerJob.EnvironmentId)
+					//Update ContainerJob status
+					updateContainerJobStatus(containerJob, ContainerJobStatusFinished)
 				}
 			}
 
+			for _, containerJob := range getContainerJobsByMachineIdAndStatusAndJobType(thisMachine.Id, ContainerJobStatusPlanned, ContainerJobTypeScaleIn) {
+				//The status is updated first, removing replicas takes longer than the interval of this worker
+				updateContainerJobStatus(containerJob, ContainerJobStatusFinished)
+				removeExtraReplicas(containerJob.EnvironmentId)
+			}
+
 		}()
 	}
 }
@@ -0,0 +1,417 @@
+/*
+Container stats. Each machine samples CPU, memory, network and block I/O of its deployment containers from the Docker API and saves them to ContainerStats
+History of an environment is returned by GET /environment/{environmentId}/stats with time ranges and downsampling
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rqlite/gorqlite"
+)
+
+const containerStatsInterval = time.Second * 15
+const containerStatsRetention = "-7 days"
+const dockerSocketPath = "/var/run/docker.sock"
+
+type ContainerStats struct {
+	Id            string
+	EnvironmentId string
+	DeploymentId  string
+	MachineId     string
+	ContainerName string
+	CPUPercent    float64 //Percent of one CPU, can be more than 100 on machines with several CPUs
+	MemoryPercent float64 //Percent of the container memory limit or machine memory if there is no limit
+	MemoryUsage   int64   //MB
+	NetworkRx     int64   //Bytes received since the previous sample
+	NetworkTx     int64   //Bytes sent since the previous sample
+	BlockRead     int64   //Bytes read from block devices since the previous sample
+	BlockWrite    int64   //Bytes written to block devices since the previous sample
+	RestartCount  int64   //How many times Docker has restarted the container
+	CreatedAt     string
+}
+
+// Stats of one container downsampled to a bucket, network and block I/O are sums, other values are averages and maximums
+type ContainerStatsBucket struct {
+	MachineId        string
+	ContainerName    string
+	Time             string
+	CPUPercent       float64
+	MaxCPUPercent    float64
+	MemoryPercent    float64
+	MaxMemoryPercent float64
+	MemoryUsage      int64
+	MaxMemoryUsage   int64
+	NetworkRx        int64
+	NetworkTx        int64
+	BlockRead        int64
+	BlockWrite       int64
+	Samples          int64
+}
+
+// Fields of GET /containers/json of the Docker API
+type DockerContainer struct {
+	Id    string
+	Names []string
+}
+
+// Fields of GET /containers/{id}/json of the Docker API
+type DockerContainerInspect struct {
+	RestartCount int64
+}
+
+// Fields of GET /containers/{id}/stats of the Docker API
+type DockerContainerStats struct {
+	CPUStats    DockerCPUStats `json:"cpu_stats"`
+	PreCPUStats DockerCPUStats `json:"precpu_stats"`
+	MemoryStats struct {
+		Usage int64            `json:"usage"`
+		Limit int64            `json:"limit"`
+		Stats map[string]int64 `json:"stats"`
+	} `json:"memory_stats"`
+	Networks map[string]struct {
+		RxBytes int64 `json:"rx_bytes"`
+		TxBytes int64 `json:"tx_bytes"`
+	} `json:"networks"`
+	BlkioStats struct {
+		IoServiceBytesRecursive []struct {
+			Op    string `json:"op"`
+			Value int64  `json:"value"`
+		} `json:"io_service_bytes_recursive"`
+	} `json:"blkio_stats"`
+}
+
+type DockerCPUStats struct {
+	CPUUsage struct {
+		TotalUsage int64 `json:"total_usage"`
+	} `json:"cpu_usage"`
+	SystemCPUUsage int64 `json:"system_cpu_usage"`
+	OnlineCPUs     int64 `json:"online_cpus"`
+}
+
+// Cumulative I/O counters of a container from the previous sample
+type containerIOCounters struct {
+	NetworkRx  int64
+	NetworkTx  int64
+	BlockRead  int64
+	BlockWrite int64
+}
+
+var lastContainerIOCounters = map[string]containerIOCounters{}
+
+var dockerClient = &http.Client{
+	Timeout: time.Second * 10,
+	Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", dockerSocketPath)
+		},
+	},
+}
+
+func handleEnvironmentStatsGet(w http.ResponseWriter, r *http.Request) {
+	environmentId := r.PathValue("environmentId")
+	if getEnvironmentById(environmentId) == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	statsRange, err := parseStatsRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(getContainerStatsBuckets(environmentId, r.URL.Query().Get("container"), statsRange))
+	if err != nil {
+		fmt.Println("Cannot convert ContainerStatsBucket object into JSON:", err)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+func startContainerStatsWorker() {
+	for range time.Tick(containerStatsInterval) {
+		saveContainerStats()
+		deleteOldContainerStats()
+	}
+}
+
+func saveContainerStats() {
+	containers := []DockerContainer{}
+	err := dockerAPIGet("/containers/json", &containers)
+	if err != nil {
+		fmt.Println("Cannot get containers from Docker API:", err)
+		return
+	}
+
+	//Deployments don't change, so we load each one once per sample
+	environmentIds := map[string]string{}
+	samples := []ContainerStats{}
+	var samplesMutex sync.Mutex
+	var waitGroup sync.WaitGroup
+	runningContainers := map[string]bool{}
+
+	for _, container := range containers {
+		if len(container.Names) == 0 {
+			continue
+		}
+
+		containerName := strings.TrimPrefix(container.Names[0], "/")
+		deploymentId, _, isDeployment := parseContainerName(containerName)
+		if !isDeployment {
+			continue
+		}
+
+		environmentId, isFound := environmentIds[deploymentId]
+		if !isFound {
+			deployment := getDeploymentById(deploymentId)
+			if deployment != nil {
+				environmentId = deployment.EnvironmentId
+			}
+			environmentIds[deploymentId] = environmentId
+		}
+
+		if environmentId == "" {
+			continue
+		}
+
+		runningContainers[containerName] = true
+
+		//Docker waits for a second sample to calculate CPU usage, so containers are requested in parallel
+		waitGroup.Add(1)
+		go func(containerId string, stats ContainerStats) {
+			defer waitGroup.Done()
+
+			dockerStats := DockerContainerStats{}
+			err := dockerAPIGet("/containers/"+containerId+"/stats?stream=false", &dockerStats)
+			if err != nil {
+				fmt.Println("Cannot get stats of container "+stats.ContainerName+":", err)
+				return
+			}
+
+			dockerInspect := DockerContainerInspect{}
+			err = dockerAPIGet("/containers/"+containerId+"/json", &dockerInspect)
+			if err != nil {
+				fmt.Println("Cannot inspect container "+stats.ContainerName+":", err)
+			}
+			stats.RestartCount = dockerInspect.RestartCount
+
+			//I/O counters of previous samples are shared by all containers
+			samplesMutex.Lock()
+			fillContainerStats(&stats, dockerStats)
+			samples = append(samples, stats)
+			samplesMutex.Unlock()
+		}(container.Id, ContainerStats{EnvironmentId: environmentId, DeploymentId: deploymentId, MachineId: thisMachine.Id, ContainerName: containerName})
+	}
+
+	waitGroup.Wait()
+
+	for _, stats := range samples {
+		addContainerStats(&stats)
+	}
+
+	for containerName := range lastContainerIOCounters {
+		if !runningContainers[containerName] {
+			delete(lastContainerIOCounters, containerName)
+		}
+	}
+}
+
+// Converts Docker API stats the same way as "docker stats" does, I/O counters are saved as deltas since the previous sample
+func fillContainerStats(stats *ContainerStats, dockerStats DockerContainerStats) {
+	cpuDelta := float64(dockerStats.CPUStats.CPUUsage.TotalUsage - dockerStats.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(dockerStats.CPUStats.SystemCPUUsage - dockerStats.PreCPUStats.SystemCPUUsage)
+	if cpuDelta > 0 && systemDelta > 0 {
+		stats.CPUPercent = cpuDelta / systemDelta * float64(max(dockerStats.CPUStats.OnlineCPUs, 1)) * 100
+	}
+
+	//Page cache isn't counted as used memory, "inactive_file" is used by cgroup v2 and "cache" by cgroup v1
+	memoryUsage := dockerStats.MemoryStats.Usage
+	if inactiveFile, isFound := dockerStats.MemoryStats.Stats["inactive_file"]; isFound && inactiveFile < memoryUsage {
+		memoryUsage -= inactiveFile
+	} else if cache, isFound := dockerStats.MemoryStats.Stats["cache"]; isFound && cache < memoryUsage {
+		memoryUsage -= cache
+	}
+	stats.MemoryUsage = memoryUsage / 1024 / 1024
+	if dockerStats.MemoryStats.Limit > 0 {
+		stats.MemoryPercent = float64(memoryUsage) / float64(dockerStats.MemoryStats.Limit) * 100
+	}
+
+	var counters containerIOCounters
+	for _, network := range dockerStats.Networks {
+		counters.NetworkRx += network.RxBytes
+		counters.NetworkTx += network.TxBytes
+	}
+	for _, entry := range dockerStats.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(entry.Op) {
+		case "read":
+			counters.BlockRead += entry.Value
+		case "write":
+			counters.BlockWrite += entry.Value
+		}
+	}
+
+	//The first sample of a container has nothing to compare with, counters of a restarted container start from 0
+	previousCounters, isFound := lastContainerIOCounters[stats.ContainerName]
+	lastContainerIOCounters[stats.ContainerName] = counters
+	if !isFound {
+		return
+	}
+
+	stats.NetworkRx = counterDelta(counters.NetworkRx, previousCounters.NetworkRx)
+	stats.NetworkTx = counterDelta(counters.NetworkTx, previousCounters.NetworkTx)
+	stats.BlockRead = counterDelta(counters.BlockRead, previousCounters.BlockRead)
+	stats.BlockWrite = counterDelta(counters.BlockWrite, previousCounters.BlockWrite)
+}
+
+func counterDelta(current int64, previous int64) int64 {
+	if current < previous {
+		return current
+	}
+
+	return current - previous
+}
+
+func dockerAPIGet(path string, result any) error {
+	response, err := dockerClient.Get("http://docker" + path)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("Docker API returned status %d", response.StatusCode)
+	}
+
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+/*Database*/
+
+func addContainerStats(stats *ContainerStats) {
+	id, err := NanoId(7)
+	if err != nil {
+		fmt.Println("Cannot generate new NanoId for ContainerStats:", err)
+		return
+	}
+
+	stats.Id = id
+
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "INSERT INTO ContainerStats( Id, EnvironmentId, DeploymentId, MachineId, ContainerName, CPUPercent, MemoryPercent, MemoryUsage, NetworkRx, NetworkTx, BlockRead, BlockWrite, RestartCount) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+				Arguments: []interface{}{stats.Id, stats.EnvironmentId, stats.DeploymentId, stats.MachineId, stats.ContainerName, stats.CPUPercent, stats.MemoryPercent, stats.MemoryUsage, stats.NetworkRx, stats.NetworkTx, stats.BlockRead, stats.BlockWrite, stats.RestartCount},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot write to ContainerStats table: %s\n", err.Error())
+	}
+}
+
+// Each machine removes its own old rows
+func deleteOldContainerStats() {
+	_, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "DELETE FROM ContainerStats WHERE MachineId = ? AND CreatedAt < datetime('now', ?)",
+				Arguments: []interface{}{thisMachine.Id, containerStatsRetention},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot delete records from ContainerStats table: %s\n", err.Error())
+	}
+}
+
+// Samples of an environment saved during the last seconds
+func getRecentContainerStatsByEnvironmentId(environmentId string, seconds int) []ContainerStats {
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id, EnvironmentId, DeploymentId, MachineId, ContainerName, CPUPercent, MemoryPercent, MemoryUsage, NetworkRx, NetworkTx, BlockRead, BlockWrite, RestartCount, CreatedAt from ContainerStats WHERE EnvironmentId = ? AND CreatedAt >= datetime('now', ?) ORDER BY CreatedAt DESC",
+			Arguments: []interface{}{environmentId, "-" + strconv.Itoa(seconds) + " seconds"},
+		},
+	)
+
+	return handleContainerStatsQuery(rows, err)
+}
+
+// Samples of each container grouped into buckets of statsRange.Step seconds, containerName is optional
+func getContainerStatsBuckets(environmentId string, containerName string, statsRange StatsRange) []ContainerStatsBucket {
+
+	query := "SELECT MachineId, ContainerName, datetime((CAST(strftime('%s', CreatedAt) AS INTEGER) / ?) * ?, 'unixepoch') AS Bucket, " +
+		"AVG(CPUPercent), MAX(CPUPercent), AVG(MemoryPercent), MAX(MemoryPercent), CAST(AVG(MemoryUsage) AS INTEGER), MAX(MemoryUsage), " +
+		"SUM(NetworkRx), SUM(NetworkTx), SUM(BlockRead), SUM(BlockWrite), COUNT(*) " +
+		"from ContainerStats WHERE EnvironmentId = ? AND CreatedAt >= ? AND CreatedAt < ?"
+	arguments := []interface{}{statsRange.Step, statsRange.Step, environmentId, statsRange.From.Format(sqliteTimeFormat), statsRange.To.Format(sqliteTimeFormat)}
+
+	if containerName != "" {
+		query += " AND ContainerName = ?"
+		arguments = append(arguments, containerName)
+	}
+
+	query += " GROUP BY MachineId, ContainerName, Bucket ORDER BY Bucket, MachineId, ContainerName"
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     query,
+			Arguments: arguments,
+		},
+	)
+
+	var buckets = []ContainerStatsBucket{}
+
+	if err != nil {
+		fmt.Printf(" Cannot read from ContainerStats table: %s\n", err.Error())
+		return buckets
+	}
+
+	for rows.Next() {
+		var bucket ContainerStatsBucket
+
+		err := rows.Scan(&bucket.MachineId, &bucket.ContainerName, &bucket.Time, &bucket.CPUPercent, &bucket.MaxCPUPercent, &bucket.MemoryPercent, &bucket.MaxMemoryPercent, &bucket.MemoryUsage, &bucket.MaxMemoryUsage, &bucket.NetworkRx, &bucket.NetworkTx, &bucket.BlockRead, &bucket.BlockWrite, &bucket.Samples)
+		if err != nil {
+			fmt.Printf(" Cannot run Scan: %s\n", err.Error())
+		}
+
+		buckets = append(buckets, bucket)
+	}
+
+	return buckets
+}
+
+func handleContainerStatsQuery(rows gorqlite.QueryResult, err error) []ContainerStats {
+
+	var stats = []ContainerStats{}
+
+	if err != nil {
+		fmt.Printf(" Cannot read from ContainerStats table: %s\n", err.Error())
+	}
+
+	for rows.Next() {
+		var loadedStats ContainerStats
+
+		err := rows.Scan(&loadedStats.Id, &loadedStats.EnvironmentId, &loadedStats.DeploymentId, &loadedStats.MachineId, &loadedStats.ContainerName, &loadedStats.CPUPercent, &loadedStats.MemoryPercent, &loadedStats.MemoryUsage, &loadedStats.NetworkRx, &loadedStats.NetworkTx, &loadedStats.BlockRead, &loadedStats.BlockWrite, &loadedStats.RestartCount, &loadedStats.CreatedAt)
+		if err != nil {
+			fmt.Printf(" Cannot run Scan: %s\n", err.Error())
+		}
+
+		stats = append(stats, loadedStats)
+	}
+
+	return stats
+}
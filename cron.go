@@ -0,0 +1,121 @@
+// Minimal parser of cron expressions with 5 fields: minute hour day_of_month month day_of_week
+// Each field supports *, numbers, lists (1,2), ranges (1-5) and steps (*/15, 0-30/10)
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type CronSchedule struct {
+	minutes     []bool
+	hours       []bool
+	daysOfMonth []bool
+	months      []bool
+	daysOfWeek  []bool
+
+	//As in standard cron, if both days are restricted, a time should match any of them
+	isAnyDayOfMonth bool
+	isAnyDayOfWeek  bool
+}
+
+func parseCronSchedule(expression string) (*CronSchedule, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, errors.New("cron expression should have 5 fields: minute hour day_of_month month day_of_week")
+	}
+
+	var schedule CronSchedule
+	var err error
+
+	if schedule.minutes, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if schedule.hours, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if schedule.daysOfMonth, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if schedule.months, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	//Sunday can be 0 or 7
+	if schedule.daysOfWeek, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if schedule.daysOfWeek[7] {
+		schedule.daysOfWeek[0] = true
+	}
+
+	schedule.isAnyDayOfMonth = fields[2] == "*"
+	schedule.isAnyDayOfWeek = fields[4] == "*"
+
+	return &schedule, nil
+}
+
+func parseCronField(field string, min int, max int) ([]bool, error) {
+	values := make([]bool, max+1)
+
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step <= 0 {
+				return nil, errors.New("invalid step in cron field '" + field + "'")
+			}
+		}
+
+		start, end := min, max
+		if rangePart != "*" {
+			startPart, endPart, isRange := strings.Cut(rangePart, "-")
+
+			var err error
+			start, err = strconv.Atoi(startPart)
+			if err != nil {
+				return nil, errors.New("invalid value in cron field '" + field + "'")
+			}
+
+			end = start
+			if isRange {
+				end, err = strconv.Atoi(endPart)
+				if err != nil {
+					return nil, errors.New("invalid range in cron field '" + field + "'")
+				}
+			} else if hasStep {
+				end = max
+			}
+		}
+
+		if start < min || end > max || start > end {
+			return nil, errors.New("value out of range in cron field '" + field + "'")
+		}
+
+		for value := start; value <= end; value += step {
+			values[value] = true
+		}
+	}
+
+	return values, nil
+}
+
+func (schedule *CronSchedule) Matches(t time.Time) bool {
+	if !schedule.minutes[t.Minute()] || !schedule.hours[t.Hour()] || !schedule.months[int(t.Month())] {
+		return false
+	}
+
+	isDayOfMonth := schedule.daysOfMonth[t.Day()]
+	isDayOfWeek := schedule.daysOfWeek[int(t.Weekday())]
+
+	if !schedule.isAnyDayOfMonth && !schedule.isAnyDayOfWeek {
+		return isDayOfMonth || isDayOfWeek
+	}
+
+	return isDayOfMonth && isDayOfWeek
+}
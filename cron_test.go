@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronSchedule(t *testing.T) {
+	tests := []struct {
+		expression string
+		isValid    bool
+	}{
+		{"* * * * *", true},
+		{"0 3 * * *", true},
+		{"*/15 * * * *", true},
+		{"0-30/10 1,13 1-15 1,6,12 1-5", true},
+		{"0 0 * * 7", true},
+		{"59 23 31 12 0", true},
+		{"", false},
+		{"* * * *", false},
+		{"* * * * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * 32 * *", false},
+		{"* * * 0 *", false},
+		{"* * * 13 *", false},
+		{"* * * * 8", false},
+		{"*/0 * * * *", false},
+		{"*/x * * * *", false},
+		{"5-1 * * * *", false},
+		{"a * * * *", false},
+		{"1- * * * *", false},
+		{"-1 * * * *", false},
+	}
+
+	for _, test := range tests {
+		_, err := parseCronSchedule(test.expression)
+		if (err == nil) != test.isValid {
+			t.Errorf("parseCronSchedule(%q) error = %v, want valid = %v", test.expression, err, test.isValid)
+		}
+	}
+}
+
+func TestCronScheduleMatches(t *testing.T) {
+	//2024-01-15 is a Monday, 2024-01-14 is a Sunday
+	tests := []struct {
+		expression string
+		time       string
+		isMatch    bool
+	}{
+		{"* * * * *", "2024-01-15 10:07", true},
+		{"0 3 * * *", "2024-01-15 03:00", true},
+		{"0 3 * * *", "2024-01-15 03:01", false},
+		{"0 3 * * *", "2024-01-15 04:00", false},
+		{"*/15 * * * *", "2024-01-15 10:45", true},
+		{"*/15 * * * *", "2024-01-15 10:46", false},
+		{"0-30/10 * * * *", "2024-01-15 10:30", true},
+		{"0-30/10 * * * *", "2024-01-15 10:40", false},
+		{"5/20 * * * *", "2024-01-15 10:45", true},
+		{"5/20 * * * *", "2024-01-15 10:40", false},
+		{"0 9 * * 1-5", "2024-01-15 09:00", true},
+		{"0 9 * * 1-5", "2024-01-14 09:00", false},
+		{"0 0 * * 0", "2024-01-14 00:00", true},
+		{"0 0 * * 7", "2024-01-14 00:00", true},
+		{"0 0 1 1,7 *", "2024-07-01 00:00", true},
+		{"0 0 1 1,7 *", "2024-06-01 00:00", false},
+		//Both days are restricted, so any of them matches
+		{"0 0 1 * 1", "2024-01-15 00:00", true},
+		{"0 0 1 * 1", "2024-02-01 00:00", true},
+		{"0 0 1 * 1", "2024-01-16 00:00", false},
+		//Only day of month is restricted
+		{"0 0 15 * *", "2024-01-15 00:00", true},
+		{"0 0 15 * *", "2024-01-16 00:00", false},
+	}
+
+	for _, test := range tests {
+		schedule, err := parseCronSchedule(test.expression)
+		if err != nil {
+			t.Fatalf("parseCronSchedule(%q) error = %v", test.expression, err)
+		}
+
+		parsedTime, err := time.Parse("2006-01-02 15:04", test.time)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if isMatch := schedule.Matches(parsedTime); isMatch != test.isMatch {
+			t.Errorf("%q.Matches(%s) = %v, want %v", test.expression, test.time, isMatch, test.isMatch)
+		}
+	}
+}
@@ -3,12 +3,25 @@ package main
 import (
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/rqlite/gorqlite"
 )
 
-var connection *gorqlite.Connection
+// Writes are timed for /metrics, other methods are used as they are
+type timedConnection struct {
+	*gorqlite.Connection
+}
+
+func (timed timedConnection) WriteParameterized(statements []gorqlite.ParameterizedStatement) ([]gorqlite.WriteResult, error) {
+	start := time.Now()
+	results, err := timed.Connection.WriteParameterized(statements)
+	observeDBWrite(time.Since(start), err)
+	return results, err
+}
+
+var connection timedConnection
 
 func databaseInit() {
 	var err error
@@ -20,12 +33,12 @@ func databaseInit() {
 		dbURL = "http://" + registryEnv + ":4001"
 	}
 
-	connection, err = gorqlite.Open(dbURL)
+	connection.Connection, err = gorqlite.Open(dbURL)
 	for err != nil {
 		fmt.Printf(" Cannot open database: %s\n", err.Error())
 		fmt.Println("Will retry to connect after 1 second")
 		time.Sleep(1 * time.Second)
-		connection, err = gorqlite.Open(dbURL)
+		connection.Connection, err = gorqlite.Open(dbURL)
 	}
 
 	// get rqlite cluster information
@@ -35,7 +48,7 @@ func databaseInit() {
 		fmt.Printf(" Cannot get DB leader")
 		fmt.Println("Will retry to get a leader after 1 second")
 		time.Sleep(1 * time.Second)
-		connection, _ = gorqlite.Open(dbURL)
+		connection.Connection, _ = gorqlite.Open(dbURL)
 		leader, err = connection.Leader()
 	}
 
@@ -71,7 +84,7 @@ func databaseInit() {
 	_, err = connection.WriteParameterized(
 		[]gorqlite.ParameterizedStatement{
 			{
-				Query:     "CREATE TABLE Service (Id TEXT NOT NULL PRIMARY KEY, Name TEXT, ProjectId TEXT, GitURL TEXT, ImageName TEXT, CreatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL)",
+				Query:     "CREATE TABLE Service (Id TEXT NOT NULL PRIMARY KEY, Name TEXT, ProjectId TEXT, GitURL TEXT, ImageName TEXT, WebhookSecret TEXT, CreatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL)",
 				Arguments: []interface{}{},
 			},
 		},
@@ -80,11 +93,13 @@ func databaseInit() {
 	if err != nil {
 		fmt.Printf(" Cannot create table Service: %s\n", err.Error())
 	}
+	addColumnIfNeeded("Service", "WebhookSecret", "TEXT")
+	addMissingWebhookSecrets()
 
 	_, err = connection.WriteParameterized(
 		[]gorqlite.ParameterizedStatement{
 			{
-				Query:     "CREATE TABLE Environment (Id TEXT NOT NULL PRIMARY KEY, ServiceId TEXT, Name TEXT, Branch TEXT, Domains TEXT, Port TEXT, MachineIds TEXT, GitTag TEXT, VolumeId TEXT, CreatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL)",
+				Query:     "CREATE TABLE Environment (Id TEXT NOT NULL PRIMARY KEY, ServiceId TEXT, Name TEXT, Branch TEXT, Domains TEXT, Port TEXT, MachineIds TEXT, GitTag TEXT, VolumeId TEXT, Replicas INTEGER, HealthCheckPath TEXT, HealthCheckStatus INTEGER, HealthCheckTimeout INTEGER, HealthCheckRetries INTEGER, ImageRetention INTEGER, CPULimit REAL, MemoryLimit INTEGER, CPUReservation REAL, MemoryReservation INTEGER, MachineCount INTEGER, MinReplicas INTEGER, MaxReplicas INTEGER, ScaleOutCPU REAL, ScaleInCPU REAL, ScaleOutMemory REAL, ScaleInMemory REAL, ScaleOutRequestRate REAL, ScaleInRequestRate REAL, ScaleCooldown INTEGER, LogRetentionDays INTEGER, LogRetentionRows INTEGER, LogRateLimit INTEGER, CreatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL)",
 				Arguments: []interface{}{},
 			},
 		},
@@ -93,11 +108,34 @@ func databaseInit() {
 	if err != nil {
 		fmt.Printf(" Cannot create table Environment: %s\n", err.Error())
 	}
+	addColumnIfNeeded("Environment", "Replicas", "INTEGER")
+	addColumnIfNeeded("Environment", "HealthCheckPath", "TEXT")
+	addColumnIfNeeded("Environment", "HealthCheckStatus", "INTEGER")
+	addColumnIfNeeded("Environment", "HealthCheckTimeout", "INTEGER")
+	addColumnIfNeeded("Environment", "HealthCheckRetries", "INTEGER")
+	addColumnIfNeeded("Environment", "ImageRetention", "INTEGER")
+	addColumnIfNeeded("Environment", "CPULimit", "REAL")
+	addColumnIfNeeded("Environment", "MemoryLimit", "INTEGER")
+	addColumnIfNeeded("Environment", "CPUReservation", "REAL")
+	addColumnIfNeeded("Environment", "MemoryReservation", "INTEGER")
+	addColumnIfNeeded("Environment", "MachineCount", "INTEGER")
+	addColumnIfNeeded("Environment", "MinReplicas", "INTEGER")
+	addColumnIfNeeded("Environment", "MaxReplicas", "INTEGER")
+	addColumnIfNeeded("Environment", "ScaleOutCPU", "REAL")
+	addColumnIfNeeded("Environment", "ScaleInCPU", "REAL")
+	addColumnIfNeeded("Environment", "ScaleOutMemory", "REAL")
+	addColumnIfNeeded("Environment", "ScaleInMemory", "REAL")
+	addColumnIfNeeded("Environment", "ScaleOutRequestRate", "REAL")
+	addColumnIfNeeded("Environment", "ScaleInRequestRate", "REAL")
+	addColumnIfNeeded("Environment", "ScaleCooldown", "INTEGER")
+	addColumnIfNeeded("Environment", "LogRetentionDays", "INTEGER")
+	addColumnIfNeeded("Environment", "LogRetentionRows", "INTEGER")
+	addColumnIfNeeded("Environment", "LogRateLimit", "INTEGER")
 
 	_, err = connection.WriteParameterized(
 		[]gorqlite.ParameterizedStatement{
 			{
-				Query:     "CREATE TABLE Deployment (Id TEXT NOT NULL PRIMARY KEY, Status TEXT, EnvironmentId TEXT, ImageId TEXT, SourceFolder TEXT, CreatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL)",
+				Query:     "CREATE TABLE Deployment (Id TEXT NOT NULL PRIMARY KEY, Status TEXT, EnvironmentId TEXT, ImageId TEXT, SourceFolder TEXT, GitTag TEXT, CommitHash TEXT, GitRef TEXT, CommitAuthor TEXT, CommitMessage TEXT, ErrorMsg TEXT, UpdatedAt TEXT, CreatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL)",
 				Arguments: []interface{}{},
 			},
 		},
@@ -106,11 +144,18 @@ func databaseInit() {
 	if err != nil {
 		fmt.Printf(" Cannot create table Deployment: %s\n", err.Error())
 	}
+	addColumnIfNeeded("Deployment", "GitTag", "TEXT")
+	addColumnIfNeeded("Deployment", "CommitHash", "TEXT")
+	addColumnIfNeeded("Deployment", "GitRef", "TEXT")
+	addColumnIfNeeded("Deployment", "CommitAuthor", "TEXT")
+	addColumnIfNeeded("Deployment", "CommitMessage", "TEXT")
+	addColumnIfNeeded("Deployment", "ErrorMsg", "TEXT")
+	addColumnIfNeeded("Deployment", "UpdatedAt", "TEXT")
 
 	_, err = connection.WriteParameterized(
 		[]gorqlite.ParameterizedStatement{
 			{
-				Query:     "CREATE TABLE Image (Id TEXT NOT NULL PRIMARY KEY, Status TEXT, DeploymentId TEXT, EnvironmentId TEXT, ErrorMsg TEXT, CreatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL)",
+				Query:     "CREATE TABLE Image (Id TEXT NOT NULL PRIMARY KEY, Status TEXT, DeploymentId TEXT, EnvironmentId TEXT, ErrorMsg TEXT, UpdatedAt TEXT, CreatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL)",
 				Arguments: []interface{}{},
 			},
 		},
@@ -119,11 +164,12 @@ func databaseInit() {
 	if err != nil {
 		fmt.Printf(" Cannot create table Image: %s\n", err.Error())
 	}
+	addColumnIfNeeded("Image", "UpdatedAt", "TEXT")
 
 	_, err = connection.WriteParameterized(
 		[]gorqlite.ParameterizedStatement{
 			{
-				Query:     "CREATE TABLE DeploymentJob (Id TEXT NOT NULL PRIMARY KEY, Status TEXT, DeploymentId TEXT, MachineId TEXT, CreatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL)",
+				Query:     "CREATE TABLE DeploymentJob (Id TEXT NOT NULL PRIMARY KEY, Status TEXT, DeploymentId TEXT, MachineId TEXT, ErrorMsg TEXT, FirstReplica INTEGER, CreatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL)",
 				Arguments: []interface{}{},
 			},
 		},
@@ -132,6 +178,8 @@ func databaseInit() {
 	if err != nil {
 		fmt.Printf(" Cannot create table DeploymentJob: %s\n", err.Error())
 	}
+	addColumnIfNeeded("DeploymentJob", "ErrorMsg", "TEXT")
+	addColumnIfNeeded("DeploymentJob", "FirstReplica", "INTEGER")
 
 	_, err = connection.WriteParameterized(
 		[]gorqlite.ParameterizedStatement{
@@ -162,7 +210,7 @@ func databaseInit() {
 	_, err = connection.WriteParameterized(
 		[]gorqlite.ParameterizedStatement{
 			{
-				Query:     "CREATE TABLE Database (Id TEXT NOT NULL PRIMARY KEY, Name TEXT, ImageName TEXT, VolumeId TEXT, MachineIds TEXT, Domains TEXT, Status TEXT, ContPort TEXT, HostPort TEXT, DataPath TEXT, ProjectId TEXT, CreatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL)",
+				Query:     "CREATE TABLE Database (Id TEXT NOT NULL PRIMARY KEY, Name TEXT, ImageName TEXT, VolumeId TEXT, MachineIds TEXT, Domains TEXT, Status TEXT, ContPort TEXT, HostPort TEXT, DataPath TEXT, ProjectId TEXT, Engine TEXT, Version TEXT, RootPassword TEXT, CPULimit REAL, MemoryLimit INTEGER, CPUReservation REAL, MemoryReservation INTEGER, ErrorMsg TEXT, CreatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL)",
 				Arguments: []interface{}{},
 			},
 		},
@@ -171,6 +219,14 @@ func databaseInit() {
 	if err != nil {
 		fmt.Printf(" Cannot create table Database: %s\n", err.Error())
 	}
+	addColumnIfNeeded("Database", "Engine", "TEXT")
+	addColumnIfNeeded("Database", "Version", "TEXT")
+	addColumnIfNeeded("Database", "RootPassword", "TEXT")
+	addColumnIfNeeded("Database", "CPULimit", "REAL")
+	addColumnIfNeeded("Database", "MemoryLimit", "INTEGER")
+	addColumnIfNeeded("Database", "CPUReservation", "REAL")
+	addColumnIfNeeded("Database", "MemoryReservation", "INTEGER")
+	addColumnIfNeeded("Database", "ErrorMsg", "TEXT")
 
 	_, err = connection.WriteParameterized(
 		[]gorqlite.ParameterizedStatement{
@@ -185,9 +241,208 @@ func databaseInit() {
 		fmt.Printf(" Cannot create table DatabaseVolume: %s\n", err.Error())
 	}
 
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "CREATE TABLE DatabaseJob (Id TEXT NOT NULL PRIMARY KEY, Status TEXT, DatabaseId TEXT, MachineId TEXT, HostPort TEXT, ErrorMsg TEXT, CreatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL)",
+				Arguments: []interface{}{},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot create table DatabaseJob: %s\n", err.Error())
+	}
+	addColumnIfNeeded("DatabaseJob", "ErrorMsg", "TEXT")
+
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "CREATE TABLE BackupConfig (Id TEXT NOT NULL PRIMARY KEY, DatabaseId TEXT NOT NULL UNIQUE, Schedule TEXT, RetentionCount INTEGER, TargetType TEXT, TargetPath TEXT, TargetMachineId TEXT, S3Endpoint TEXT, S3Region TEXT, S3Bucket TEXT, S3AccessKey TEXT, S3SecretKey TEXT, LastRunAt TEXT, CreatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL)",
+				Arguments: []interface{}{},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot create table BackupConfig: %s\n", err.Error())
+	}
+
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "CREATE TABLE Backup (Id TEXT NOT NULL PRIMARY KEY, DatabaseId TEXT, BackupConfigId TEXT, Engine TEXT, Status TEXT, TargetType TEXT, MachineId TEXT, SourceMachineId TEXT, Path TEXT, Size INTEGER, Secret TEXT, ErrorMsg TEXT, CreatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL)",
+				Arguments: []interface{}{},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot create table Backup: %s\n", err.Error())
+	}
+
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "CREATE TABLE DatabaseRestore (Id TEXT NOT NULL PRIMARY KEY, BackupId TEXT, DatabaseId TEXT, Status TEXT, ErrorMsg TEXT, CreatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL)",
+				Arguments: []interface{}{},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot create table DatabaseRestore: %s\n", err.Error())
+	}
+
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "CREATE TABLE EnvVar (Id TEXT NOT NULL PRIMARY KEY, EnvironmentId TEXT, Name TEXT, Value TEXT, IsSecret INTEGER, CreatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL)",
+				Arguments: []interface{}{},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot create table EnvVar: %s\n", err.Error())
+	}
+
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "CREATE TABLE Volume (Id TEXT NOT NULL PRIMARY KEY, EnvironmentId TEXT, Name TEXT, ContainerPath TEXT, Status TEXT, CreatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL)",
+				Arguments: []interface{}{},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot create table Volume: %s\n", err.Error())
+	}
+
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "CREATE TABLE VolumeJob (Id TEXT NOT NULL PRIMARY KEY, Status TEXT, VolumeId TEXT, MachineId TEXT, JobType TEXT, ErrorMsg TEXT, CreatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL)",
+				Arguments: []interface{}{},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot create table VolumeJob: %s\n", err.Error())
+	}
+
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "CREATE TABLE ContainerStats (Id TEXT NOT NULL PRIMARY KEY, EnvironmentId TEXT, DeploymentId TEXT, MachineId TEXT, ContainerName TEXT, CPUPercent REAL, MemoryPercent REAL, MemoryUsage INTEGER, NetworkRx INTEGER, NetworkTx INTEGER, BlockRead INTEGER, BlockWrite INTEGER, RestartCount INTEGER, CreatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL)",
+				Arguments: []interface{}{},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot create table ContainerStats: %s\n", err.Error())
+	}
+	addColumnIfNeeded("ContainerStats", "NetworkRx", "INTEGER")
+	addColumnIfNeeded("ContainerStats", "NetworkTx", "INTEGER")
+	addColumnIfNeeded("ContainerStats", "BlockRead", "INTEGER")
+	addColumnIfNeeded("ContainerStats", "BlockWrite", "INTEGER")
+	addColumnIfNeeded("ContainerStats", "RestartCount", "INTEGER")
+
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "CREATE TABLE RequestStats (Id TEXT NOT NULL PRIMARY KEY, EnvironmentId TEXT, Requests INTEGER, Seconds INTEGER, CreatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL)",
+				Arguments: []interface{}{},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot create table RequestStats: %s\n", err.Error())
+	}
+
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "CREATE TABLE AlertChannel (Id TEXT NOT NULL PRIMARY KEY, Name TEXT, Type TEXT, URL TEXT, SMTPHost TEXT, SMTPPort INTEGER, SMTPUsername TEXT, SMTPPassword TEXT, SMTPFrom TEXT, SMTPTo TEXT, CreatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL)",
+				Arguments: []interface{}{},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot create table AlertChannel: %s\n", err.Error())
+	}
+
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "CREATE TABLE AlertRule (Id TEXT NOT NULL PRIMARY KEY, Name TEXT, Type TEXT, MachineId TEXT, EnvironmentId TEXT, Threshold REAL, Duration INTEGER, ChannelIds TEXT, CreatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL)",
+				Arguments: []interface{}{},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot create table AlertRule: %s\n", err.Error())
+	}
+
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "CREATE TABLE Alert (Id TEXT NOT NULL PRIMARY KEY, RuleId TEXT, DedupKey TEXT, Status TEXT, Message TEXT, MachineId TEXT, EnvironmentId TEXT, ResolvedAt TEXT, CreatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL)",
+				Arguments: []interface{}{},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot create table Alert: %s\n", err.Error())
+	}
+
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "CREATE TABLE ApiToken (Id TEXT NOT NULL PRIMARY KEY, Name TEXT, TokenHash TEXT NOT NULL UNIQUE, CreatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL)",
+				Arguments: []interface{}{},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot create table ApiToken: %s\n", err.Error())
+	} else {
+		//If err == nil, the table has been just created and we should add the first token
+		addFirstApiToken()
+	}
+
+	//Environments created before log search was added don't have search indexes yet
+	for _, environment := range getEnvironments() {
+		createEnvLogsSearchIndexIfNeeded(environment.Id)
+	}
+
 	//getAllProxies()
 }
 
+// Tables are created only once, so columns added in newer versions should be added to existing tables as well
+func addColumnIfNeeded(table string, column string, columnType string) {
+	_, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "ALTER TABLE " + table + " ADD COLUMN " + column + " " + columnType,
+				Arguments: []interface{}{},
+			},
+		},
+	)
+
+	if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+		fmt.Printf(" Cannot add column %s to table %s: %s\n", column, table, err.Error())
+	}
+}
+
 func createStatsTableIfNeeded() {
 	_, err := connection.WriteParameterized(
 		[]gorqlite.ParameterizedStatement{
@@ -201,6 +456,32 @@ func createStatsTableIfNeeded() {
 	if err != nil {
 		fmt.Printf(" Cannot create table %s: %s\n", "Stats"+thisMachine.Id, err.Error())
 	}
+
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "CREATE TABLE " + "StatsHourly" + thisMachine.Id + " (Id TEXT NOT NULL PRIMARY KEY, CPUUsage REAL, MaxCPUUsage INTEGER, UsedMemory INTEGER, MaxUsedMemory INTEGER, TotalMemory INTEGER, UsedDisk INTEGER, MaxUsedDisk INTEGER, TotalDisk INTEGER, Samples INTEGER, CreatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL)",
+				Arguments: []interface{}{},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot create table %s: %s\n", "StatsHourly"+thisMachine.Id, err.Error())
+	}
+
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "CREATE TABLE " + "StatsDaily" + thisMachine.Id + " (Id TEXT NOT NULL PRIMARY KEY, CPUUsage REAL, MaxCPUUsage INTEGER, UsedMemory INTEGER, MaxUsedMemory INTEGER, TotalMemory INTEGER, UsedDisk INTEGER, MaxUsedDisk INTEGER, TotalDisk INTEGER, Samples INTEGER, CreatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL)",
+				Arguments: []interface{}{},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot create table %s: %s\n", "StatsDaily"+thisMachine.Id, err.Error())
+	}
 }
 
 func createEnvLogsTableIfNeeded(environmentId string) {
@@ -216,4 +497,51 @@ func createEnvLogsTableIfNeeded(environmentId string) {
 	if err != nil {
 		fmt.Printf(" Cannot create table %s: %s\n", "EnvLogs"+environmentId, err.Error())
 	}
+
+	createEnvLogsSearchIndexIfNeeded(environmentId)
+}
+
+// EnvLogsSearch{environmentId} is an FTS5 index of log messages, triggers keep it in sync with EnvLogs{environmentId}
+func createEnvLogsSearchIndexIfNeeded(environmentId string) {
+	logsTable := "EnvLogs" + environmentId
+	searchTable := "EnvLogsSearch" + environmentId
+
+	_, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "CREATE INDEX " + logsTable + "PublishedAt ON " + logsTable + " (PublishedAt, Id)",
+				Arguments: []interface{}{},
+			},
+		},
+	)
+
+	if err != nil && !strings.Contains(err.Error(), "already exists") {
+		fmt.Printf(" Cannot create index %s: %s\n", logsTable+"PublishedAt", err.Error())
+	}
+
+	//All statements run in one transaction, so the index is filled with existing logs only once
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "CREATE VIRTUAL TABLE " + searchTable + " USING fts5(Message, content='" + logsTable + "', content_rowid='rowid')",
+				Arguments: []interface{}{},
+			},
+			{
+				Query:     "CREATE TRIGGER " + searchTable + "Insert AFTER INSERT ON " + logsTable + " BEGIN INSERT INTO " + searchTable + " (rowid, Message) VALUES (new.rowid, new.Message); END",
+				Arguments: []interface{}{},
+			},
+			{
+				Query:     "CREATE TRIGGER " + searchTable + "Delete AFTER DELETE ON " + logsTable + " BEGIN INSERT INTO " + searchTable + " (" + searchTable + ", rowid, Message) VALUES ('delete', old.rowid, old.Message); END",
+				Arguments: []interface{}{},
+			},
+			{
+				Query:     "INSERT INTO " + searchTable + " (" + searchTable + ") VALUES ('rebuild')",
+				Arguments: []interface{}{},
+			},
+		},
+	)
+
+	if err != nil && !strings.Contains(err.Error(), "already exists") {
+		fmt.Printf(" Cannot create table %s: %s\n", searchTable, err.Error())
+	}
 }
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"os/exec"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/rqlite/gorqlite"
 )
@@ -16,6 +21,7 @@ const DatabasetatusStartingContainers = "starting_containers"
 const DatabaseStatusFinished = "finished"
 const DatabaseStatusToDelete = "scheduled_to_delete"
 const DatabaseStatusDeleted = "deleted"
+const DatabaseStatusFailed = "failed" //A container cannot be started on one of machines, ErrorMsg has details
 
 type Database struct {
 	Id         string
@@ -30,6 +36,15 @@ type Database struct {
 	DataPath   string
 	ProjectId  string
 	CreatedAt  string
+	ErrorMsg   string
+
+	//Managed databases, check database_template.go
+	Engine           string //postgres, mysql, redis or mongodb, empty for databases from custom images
+	Version          string
+	RootPassword     string
+	ConnectionString string //Generated when a database is loaded, not stored in DB
+
+	ResourceLimits
 }
 
 type DatabaseVolume struct {
@@ -53,6 +68,20 @@ func handleDatabasePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if database.Engine != "" {
+		err = applyDatabaseTemplate(&database)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = validateResourceLimits(database.ResourceLimits)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	addDatabase(&database)
 
 	jsonBytes, err := json.Marshal(database)
@@ -67,7 +96,12 @@ func handleDatabasePost(w http.ResponseWriter, r *http.Request) {
 
 func handleDatabaseGet(w http.ResponseWriter, r *http.Request) {
 
-	jsonBytes, err := json.Marshal(getAllDatabase())
+	databases := getAllDatabase()
+	for index := range databases {
+		databases[index].ConnectionString = getDatabaseConnectionString(databases[index])
+	}
+
+	jsonBytes, err := json.Marshal(databases)
 	if err != nil {
 		fmt.Println("Cannot convert Services object into JSON:", err)
 		return
@@ -101,21 +135,41 @@ func addDatabase(database *Database) {
 	database.Id = id
 	database.Status = DatabaseStatusScheduled
 
+	//Check if we should add to Database.MachineIds the first machine because there is no MachineIds in the request body
+	if len(database.MachineIds) == 0 {
+		machines := getMachines()
+		if len(machines) > 0 {
+			database.MachineIds = append(database.MachineIds, machines[0].Id)
+		}
+	}
+
 	addDatabaseVolume(database)
 
 	_, err = connection.WriteParameterized(
 		[]gorqlite.ParameterizedStatement{
 			{
-				Query:     "INSERT INTO Database( Id, Name, ImageName, VolumeId, Domains, MachineIds, Status, ContPort, DataPath, ProjectId) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
-				Arguments: []interface{}{database.Id, database.Name, database.ImageName, database.VolumeId, strings.Join(database.Domains, ";"), strings.Join(database.MachineIds, ";"), database.Status, database.ContPort, database.DataPath, database.ProjectId},
+				Query:     "INSERT INTO Database( Id, Name, ImageName, VolumeId, Domains, MachineIds, Status, ContPort, DataPath, ProjectId, Engine, Version, RootPassword, CPULimit, MemoryLimit, CPUReservation, MemoryReservation) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+				Arguments: []interface{}{database.Id, database.Name, database.ImageName, database.VolumeId, strings.Join(database.Domains, ";"), strings.Join(database.MachineIds, ";"), database.Status, database.ContPort, database.DataPath, database.ProjectId, database.Engine, database.Version, database.RootPassword, database.CPULimit, database.MemoryLimit, database.CPUReservation, database.MemoryReservation},
 			},
 		},
 	)
 
 	if err != nil {
 		fmt.Printf(" Cannot write to Database table: %s\n", err.Error())
+		return
 	}
 
+	scheduleDatabaseJobs(*database)
+}
+
+func scheduleDatabaseJobs(database Database) {
+	for _, machineId := range database.MachineIds {
+		var job DatabaseJob
+		job.MachineId = machineId
+		job.Status = StatusToDeploy
+		job.DatabaseId = database.Id
+		addDatabaseJob(job)
+	}
 }
 
 func addDatabaseVolume(database *Database) {
@@ -149,15 +203,49 @@ func addDatabaseVolume(database *Database) {
 }
 
 func getAllDatabase() []Database {
-	var databases = []Database{}
 
 	rows, err := connection.QueryOneParameterized(
 		gorqlite.ParameterizedStatement{
-			Query:     "SELECT Id, Name, ImageName, VolumeId, MachineIds, Domains, Status, ContPort, HostPort, DataPath, ProjectId, CreatedAt from Database",
-			Arguments: []interface{}{},
+			Query:     "SELECT Id, Name, ImageName, VolumeId, MachineIds, Domains, Status, ContPort, HostPort, DataPath, ProjectId, CreatedAt, Engine, Version, RootPassword, CPULimit, MemoryLimit, CPUReservation, MemoryReservation, ErrorMsg from Database WHERE Status != ?",
+			Arguments: []interface{}{DatabaseStatusDeleted},
+		},
+	)
+
+	return handleDatabaseQuery(rows, err)
+}
+
+func getDatabasesByStatus(status string) []Database {
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id, Name, ImageName, VolumeId, MachineIds, Domains, Status, ContPort, HostPort, DataPath, ProjectId, CreatedAt, Engine, Version, RootPassword, CPULimit, MemoryLimit, CPUReservation, MemoryReservation, ErrorMsg from Database WHERE Status = ?",
+			Arguments: []interface{}{status},
 		},
 	)
 
+	return handleDatabaseQuery(rows, err)
+}
+
+func getDatabaseById(databaseId string) *Database {
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id, Name, ImageName, VolumeId, MachineIds, Domains, Status, ContPort, HostPort, DataPath, ProjectId, CreatedAt, Engine, Version, RootPassword, CPULimit, MemoryLimit, CPUReservation, MemoryReservation, ErrorMsg from Database WHERE Id = ?",
+			Arguments: []interface{}{databaseId},
+		},
+	)
+
+	databases := handleDatabaseQuery(rows, err)
+	if len(databases) == 0 {
+		return nil
+	}
+
+	return &databases[0]
+}
+
+func handleDatabaseQuery(rows gorqlite.QueryResult, err error) []Database {
+	var databases = []Database{}
+
 	if err != nil {
 		fmt.Printf(" Cannot read from Database table: %s\n", err.Error())
 	}
@@ -167,7 +255,7 @@ func getAllDatabase() []Database {
 		var MachineIds string
 		var Domains string
 
-		err := rows.Scan(&loadedDatabase.Id, &loadedDatabase.Name, &loadedDatabase.ImageName, &loadedDatabase.VolumeId, &MachineIds, &Domains, &loadedDatabase.Status, &loadedDatabase.ContPort, &loadedDatabase.HostPort, &loadedDatabase.DataPath, &loadedDatabase.ProjectId, &loadedDatabase.CreatedAt)
+		err := rows.Scan(&loadedDatabase.Id, &loadedDatabase.Name, &loadedDatabase.ImageName, &loadedDatabase.VolumeId, &MachineIds, &Domains, &loadedDatabase.Status, &loadedDatabase.ContPort, &loadedDatabase.HostPort, &loadedDatabase.DataPath, &loadedDatabase.ProjectId, &loadedDatabase.CreatedAt, &loadedDatabase.Engine, &loadedDatabase.Version, &loadedDatabase.RootPassword, &loadedDatabase.CPULimit, &loadedDatabase.MemoryLimit, &loadedDatabase.CPUReservation, &loadedDatabase.MemoryReservation, &loadedDatabase.ErrorMsg)
 		if err != nil {
 			fmt.Printf(" Cannot run Scan: %s\n", err.Error())
 		}
@@ -180,6 +268,46 @@ func getAllDatabase() []Database {
 	return databases
 }
 
+// The first started container sets HostPort of the database, containers on other machines use their own ports from DatabaseJob.HostPort
+func updateDatabaseHostPortIfEmpty(databaseId string, hostPort string) error {
+
+	_, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "UPDATE Database SET HostPort = ? WHERE Id = ? AND (HostPort IS NULL OR HostPort = '')",
+				Arguments: []interface{}{hostPort, databaseId},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf("Cannot update a row in Database: %s\n", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// Moves a database to other machines, an empty HostPort lets the first started container become the primary container
+func updateDatabasePlacement(databaseId string, machineIds []string, hostPort string, status string) error {
+
+	_, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "UPDATE Database SET MachineIds = ?, HostPort = ?, Status = ? WHERE Id = ?",
+				Arguments: []interface{}{strings.Join(machineIds, ";"), hostPort, status, databaseId},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf("Cannot update a row in Database: %s\n", err.Error())
+		return err
+	}
+
+	return nil
+}
+
 func updateDatabaseStatus(databaseId string, status string) error {
 
 	_, err := connection.WriteParameterized(
@@ -199,6 +327,25 @@ func updateDatabaseStatus(databaseId string, status string) error {
 	return nil
 }
 
+func updateDatabaseError(databaseId string, errorMsg string) error {
+
+	_, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "UPDATE Database SET Status = ?, ErrorMsg = ? WHERE Id = ?",
+				Arguments: []interface{}{DatabaseStatusFailed, errorMsg, databaseId},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf("Cannot update a row in Database: %s\n", err.Error())
+		return err
+	}
+
+	return nil
+}
+
 func scheduleDeleteDatabase(databaseId string) (result bool) {
 
 	//To delete a database we should stop a container with Database on a machine with ID Database.MachineId
@@ -217,3 +364,197 @@ func scheduleDeleteDatabase(databaseId string) (result bool) {
 
 	return true
 }
+
+func startDatabaseCheckerWorker() {
+	for range time.Tick(time.Second * 2) {
+		go func() {
+			//Start containers for new databases
+			scheduledDatabases := append(getDatabasesByStatus(DatabaseStatusScheduled), getDatabasesByStatus(DatabasetatusStartingContainers)...)
+			for _, database := range scheduledDatabases {
+				//Databases added by previous versions have no DatabaseJobs, we schedule them only from lighthouses to avoid duplicates
+				if database.Status == DatabaseStatusScheduled && slices.Contains(thisMachine.Types, MachineTypeLighthouse) && len(getDatabaseJobsByDatabaseId(database.Id)) == 0 {
+					scheduleDatabaseJobs(database)
+				}
+
+				jobs := getDatabaseJobsByDatabaseIdAndStatus(database.Id, StatusToDeploy)
+				for _, job := range jobs {
+					if job.MachineId == thisMachine.Id {
+						deployDatabase(database, job)
+					}
+				}
+
+				//All DatabaseJobs are finished, update status of Database
+				if database.Status == DatabasetatusStartingContainers && len(jobs) == 0 && len(getDatabaseJobsByDatabaseIdAndStatus(database.Id, StatusInProgress)) == 0 {
+					updateDatabaseStatus(database.Id, DatabaseStatusFinished)
+				}
+			}
+
+			//Remove containers of databases that have been moved from this machine by failover
+			for _, job := range getDatabaseJobsByMachineIdAndStatus(thisMachine.Id, DatabaseJobStatusToRemove) {
+				database := getDatabaseById(job.DatabaseId)
+				if database != nil {
+					removeDatabaseContainer(*database, job)
+				} else {
+					updateDatabaseJobStatus(job, DatabaseJobStatusRemoved)
+				}
+			}
+
+			//Stop and remove containers of deleted databases
+			databasesToDelete := getDatabasesByStatus(DatabaseStatusToDelete)
+			for _, database := range databasesToDelete {
+				isRemoved := true
+				for _, job := range getDatabaseJobsByDatabaseId(database.Id) {
+					if job.Status == DatabaseJobStatusRemoved {
+						continue
+					}
+					if job.MachineId == thisMachine.Id {
+						removeDatabaseContainer(database, job)
+					} else {
+						isRemoved = false
+					}
+				}
+
+				if isRemoved {
+					updateDatabaseStatus(database.Id, DatabaseStatusDeleted)
+				}
+			}
+		}()
+	}
+}
+
+func deployDatabase(database Database, job DatabaseJob) {
+	fmt.Println("Pulling and starting a container for Database " + database.Id)
+
+	err := updateDatabaseJobStatus(job, StatusInProgress)
+	if err != nil {
+		fmt.Println("Cannot update DatabaseJob row:", err)
+		return
+	}
+
+	if database.Status == DatabaseStatusScheduled {
+		updateDatabaseStatus(database.Id, DatabasetatusStartingContainers)
+	}
+
+	portInt, err := GetFreePort()
+	if err != nil {
+		failDatabaseJob(database, job, "Cannot get a free port on machine "+thisMachine.Name+": "+err.Error())
+		return
+	}
+	job.HostPort = strconv.Itoa(portInt)
+
+	//Data is stored in a named volume, so it survives container restarts and removals
+	volumeArg := ""
+	if database.DataPath != "" {
+		volumeArg = "-v " + database.VolumeId + ":" + database.DataPath
+	}
+
+	//Managed databases get a root password and a command from the template
+	envArgs := ""
+	command := ""
+	template := getDatabaseTemplate(database.Engine)
+	if template != nil {
+		for _, env := range template.env(database.RootPassword) {
+			envArgs += " -e " + env
+		}
+		command = template.command(database.RootPassword)
+	}
+
+	scriptTemplate := createTemplate("run_database_container", `
+	#!/bin/sh
+	docker volume create {{.VOLUME_ID}}
+	docker container run -p {{.MACHINE_VPN_IP}}:{{.MACHINE_PORT}}:{{.CONTAINER_PORT}} -d --restart unless-stopped --log-driver=journald --name {{.CONTAINER_NAME}}{{.RESOURCE_ARGS}} {{.VOLUME_ARG}}{{.ENV_ARGS}} {{.IMAGE_NAME}} {{.COMMAND}}
+`)
+
+	var templateBytes bytes.Buffer
+	templateData := map[string]string{
+		"VOLUME_ID":      database.VolumeId,
+		"VOLUME_ARG":     volumeArg,
+		"ENV_ARGS":       envArgs,
+		"RESOURCE_ARGS":  getResourceLimitsArgs(database.ResourceLimits),
+		"COMMAND":        command,
+		"MACHINE_VPN_IP": thisMachine.VPNIp,
+		"MACHINE_PORT":   job.HostPort,
+		"CONTAINER_PORT": database.ContPort,
+		"CONTAINER_NAME": getDatabaseContainerName(database.Id),
+		"IMAGE_NAME":     database.ImageName,
+	}
+
+	if err := scriptTemplate.Execute(&templateBytes, templateData); err != nil {
+		failDatabaseJob(database, job, "Cannot create a script to start a database container: "+err.Error())
+		return
+	}
+
+	output, err := executeScriptString(templateBytes.String(), func(logLine string) {})
+	if err != nil {
+		failDatabaseJob(database, job, "Cannot start a database container: "+lastLines(output, 5))
+		return
+	}
+
+	fmt.Println("Database " + database.Id + " has been started on machine " + job.MachineId + " with port " + job.HostPort)
+
+	err = updateDatabaseJobStatus(job, StatusDeployed)
+	if err != nil {
+		return
+	}
+
+	updateDatabaseHostPortIfEmpty(database.Id, job.HostPort)
+}
+
+// Marks the job and the database as failed, a container that has been created but hasn't started is removed
+func failDatabaseJob(database Database, job DatabaseJob, errorMsg string) {
+	fmt.Println("Database " + database.Id + " cannot be started on machine " + job.MachineId + ": " + errorMsg)
+
+	exec.Command("docker", "container", "rm", "-f", getDatabaseContainerName(database.Id)).Run()
+
+	updateDatabaseJobError(job, errorMsg)
+	updateDatabaseError(database.Id, errorMsg)
+}
+
+func removeDatabaseContainer(database Database, job DatabaseJob) {
+	fmt.Println("Removing a container of Database " + database.Id)
+
+	//Note: We don't delete volumes, they should be removed in another function deleteDatabaseVolume
+	scriptTemplate := createTemplate("remove_database_container", `
+	#!/bin/sh
+	docker stop {{.CONTAINER_NAME}}
+	docker container rm -f {{.CONTAINER_NAME}}
+`)
+
+	var templateBytes bytes.Buffer
+	templateData := map[string]string{
+		"CONTAINER_NAME": getDatabaseContainerName(database.Id),
+	}
+
+	if err := scriptTemplate.Execute(&templateBytes, templateData); err != nil {
+		fmt.Println("Cannot execute template for removing a database container:", err)
+		return
+	}
+
+	_, err := executeScriptString(templateBytes.String(), func(logLine string) {})
+	if err != nil {
+		fmt.Println("Cannot remove a database container")
+		return
+	}
+
+	updateDatabaseJobStatus(job, DatabaseJobStatusRemoved)
+}
+
+// The primary container is the container that set Database.HostPort, we connect to it, back it up and restore it
+func getDatabasePrimaryJob(database Database) *DatabaseJob {
+	if database.HostPort == "" {
+		return nil
+	}
+
+	for _, job := range getDatabaseJobsByDatabaseIdAndStatus(database.Id, StatusDeployed) {
+		if job.HostPort == database.HostPort {
+			return &job
+		}
+	}
+
+	return nil
+}
+
+// Database containers have no "." in the name, so handleDockerLogs doesn't treat them as deployments
+func getDatabaseContainerName(databaseId string) string {
+	return "db-" + databaseId
+}
@@ -0,0 +1,156 @@
+/*
+We create DatabaseJob for each database on each server. If Database has 2 MachineIds we should create 2 DatabaseJobs
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/rqlite/gorqlite"
+)
+
+const DatabaseJobStatusRemoved = "removed"
+const DatabaseJobStatusToRemove = "scheduled_to_remove" //A database has been moved to another machine, the container is removed when the machine is back online
+
+type DatabaseJob struct {
+	Id         string
+	Status     string
+	DatabaseId string
+	MachineId  string
+	HostPort   string
+	ErrorMsg   string
+}
+
+func addDatabaseJob(job DatabaseJob) DatabaseJob {
+	id, err := NanoId(7)
+	if err != nil {
+		fmt.Println("Cannot generate new NanoId for DatabaseJob:", err)
+		return job
+	}
+
+	job.Id = id
+
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "INSERT INTO DatabaseJob( Id, Status, DatabaseId, MachineId, HostPort, ErrorMsg) VALUES(?, ?, ?, ?, ?, ?)",
+				Arguments: []interface{}{job.Id, job.Status, job.DatabaseId, job.MachineId, job.HostPort, job.ErrorMsg},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot write to DatabaseJob table: %s\n", err.Error())
+	}
+	return job
+}
+
+func getDatabaseJobsByDatabaseId(databaseId string) []DatabaseJob {
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id, Status, DatabaseId, MachineId, HostPort, ErrorMsg from DatabaseJob WHERE DatabaseId = ?",
+			Arguments: []interface{}{databaseId},
+		},
+	)
+
+	return handleDatabaseJobQuery(rows, err)
+}
+
+func getDatabaseJobsByDatabaseIdAndStatus(databaseId string, status string) []DatabaseJob {
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id, Status, DatabaseId, MachineId, HostPort, ErrorMsg from DatabaseJob WHERE DatabaseId = ? AND Status = ?",
+			Arguments: []interface{}{databaseId, status},
+		},
+	)
+
+	return handleDatabaseJobQuery(rows, err)
+}
+
+func getDatabaseJobsByMachineIdAndStatus(machineId string, status string) []DatabaseJob {
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id, Status, DatabaseId, MachineId, HostPort, ErrorMsg from DatabaseJob WHERE MachineId = ? AND Status = ?",
+			Arguments: []interface{}{machineId, status},
+		},
+	)
+
+	return handleDatabaseJobQuery(rows, err)
+}
+
+func handleDatabaseJobQuery(rows gorqlite.QueryResult, err error) []DatabaseJob {
+
+	var jobs = []DatabaseJob{}
+
+	if err != nil {
+		fmt.Printf(" Cannot read from DatabaseJob table: %s\n", err.Error())
+	}
+
+	for rows.Next() {
+		var Id string
+		var Status string
+		var DatabaseId string
+		var MachineId string
+		var HostPort string
+		var ErrorMsg string
+
+		err := rows.Scan(&Id, &Status, &DatabaseId, &MachineId, &HostPort, &ErrorMsg)
+		if err != nil {
+			fmt.Printf(" Cannot run Scan: %s\n", err.Error())
+		}
+		loadedJob := DatabaseJob{
+			Id:         Id,
+			Status:     Status,
+			DatabaseId: DatabaseId,
+			MachineId:  MachineId,
+			HostPort:   HostPort,
+			ErrorMsg:   ErrorMsg,
+		}
+		jobs = append(jobs, loadedJob)
+	}
+
+	return jobs
+
+}
+
+func updateDatabaseJobError(job DatabaseJob, errorMsg string) error {
+
+	_, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "UPDATE DatabaseJob SET Status = ?, HostPort = ?, ErrorMsg = ? WHERE Id = ?",
+				Arguments: []interface{}{StatusFailed, job.HostPort, errorMsg, job.Id},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf("Cannot update a row in DatabaseJob: %s\n", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func updateDatabaseJobStatus(job DatabaseJob, status string) error {
+
+	_, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "UPDATE DatabaseJob SET Status = ?, HostPort = ? WHERE Id = ?",
+				Arguments: []interface{}{status, job.HostPort, job.Id},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf("Cannot update a row in DatabaseJob: %s\n", err.Error())
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,177 @@
+/*
+Templates for managed databases. A template fills Database.ImageName, ContPort and DataPath by Database.Engine and Database.Version
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+const DatabaseEnginePostgres = "postgres"
+const DatabaseEngineMySQL = "mysql"
+const DatabaseEngineRedis = "redis"
+const DatabaseEngineMongoDB = "mongodb"
+
+type DatabaseTemplate struct {
+	Engine         string
+	Image          string
+	DefaultVersion string
+	ContPort       string
+	DataPath       string
+
+	env              func(password string) []string //Environment variables for a container
+	command          func(password string) string   //Command for a container, empty to use the image's command
+	connectionString func(password string, ip string, port string) string
+}
+
+var databaseTemplates = []DatabaseTemplate{
+	{
+		Engine:         DatabaseEnginePostgres,
+		Image:          "postgres",
+		DefaultVersion: "16",
+		ContPort:       "5432",
+		DataPath:       "/var/lib/postgresql/data",
+		env: func(password string) []string {
+			return []string{"POSTGRES_PASSWORD=" + password}
+		},
+		command: func(password string) string { return "" },
+		connectionString: func(password string, ip string, port string) string {
+			return "postgresql://postgres:" + password + "@" + ip + ":" + port + "/postgres"
+		},
+	},
+	{
+		Engine:         DatabaseEngineMySQL,
+		Image:          "mysql",
+		DefaultVersion: "8.0",
+		ContPort:       "3306",
+		DataPath:       "/var/lib/mysql",
+		env: func(password string) []string {
+			return []string{"MYSQL_ROOT_PASSWORD=" + password}
+		},
+		command: func(password string) string { return "" },
+		connectionString: func(password string, ip string, port string) string {
+			return "mysql://root:" + password + "@" + ip + ":" + port + "/"
+		},
+	},
+	{
+		Engine:         DatabaseEngineRedis,
+		Image:          "redis",
+		DefaultVersion: "7",
+		ContPort:       "6379",
+		DataPath:       "/data",
+		env: func(password string) []string {
+			return []string{}
+		},
+		command: func(password string) string {
+			return "redis-server --appendonly yes --requirepass " + password
+		},
+		connectionString: func(password string, ip string, port string) string {
+			return "redis://:" + password + "@" + ip + ":" + port + "/0"
+		},
+	},
+	{
+		Engine:         DatabaseEngineMongoDB,
+		Image:          "mongo",
+		DefaultVersion: "7",
+		ContPort:       "27017",
+		DataPath:       "/data/db",
+		env: func(password string) []string {
+			return []string{"MONGO_INITDB_ROOT_USERNAME=root", "MONGO_INITDB_ROOT_PASSWORD=" + password}
+		},
+		command: func(password string) string { return "" },
+		connectionString: func(password string, ip string, port string) string {
+			return "mongodb://root:" + password + "@" + ip + ":" + port + "/?authSource=admin"
+		},
+	},
+}
+
+// Versions are used as image tags in shell scripts, so we allow only characters of Docker tags
+var databaseVersionRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Passwords are used in shell scripts and in connection strings as well
+var databasePasswordRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+func handleDatabaseTemplateGet(w http.ResponseWriter, r *http.Request) {
+
+	jsonBytes, err := json.Marshal(databaseTemplates)
+	if err != nil {
+		fmt.Println("Cannot convert DatabaseTemplate object into JSON:", err)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+func getDatabaseTemplate(engine string) *DatabaseTemplate {
+	for _, template := range databaseTemplates {
+		if template.Engine == engine {
+			return &template
+		}
+	}
+	return nil
+}
+
+// Fills empty fields of a database from the template and generates a root password
+func applyDatabaseTemplate(database *Database) error {
+	template := getDatabaseTemplate(database.Engine)
+	if template == nil {
+		return errors.New("Unknown database engine '" + database.Engine + "'")
+	}
+
+	if database.Version == "" {
+		database.Version = template.DefaultVersion
+	}
+
+	if !databaseVersionRegexp.MatchString(database.Version) {
+		return errors.New("Invalid database version '" + database.Version + "'")
+	}
+
+	if database.ImageName == "" {
+		database.ImageName = template.Image + ":" + database.Version
+	}
+
+	if database.ContPort == "" {
+		database.ContPort = template.ContPort
+	}
+
+	if database.DataPath == "" {
+		database.DataPath = template.DataPath
+	}
+
+	if database.RootPassword == "" {
+		password, err := NanoId(24)
+		if err != nil {
+			return err
+		}
+		database.RootPassword = password
+	} else if !databasePasswordRegexp.MatchString(database.RootPassword) {
+		return errors.New("Root password can contain only letters, digits, '.', '_' and '-'")
+	}
+
+	return nil
+}
+
+// Returns a connection string over VPN to the primary container of a database
+func getDatabaseConnectionString(database Database) string {
+	template := getDatabaseTemplate(database.Engine)
+	if template == nil {
+		return ""
+	}
+
+	job := getDatabasePrimaryJob(database)
+	if job == nil {
+		return ""
+	}
+
+	machine := getMachineById(job.MachineId)
+	if machine == nil {
+		return ""
+	}
+
+	return template.connectionString(database.RootPassword, machine.VPNIp, database.HostPort)
+}
@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"slices"
 	"strconv"
 	"strings"
@@ -24,6 +25,7 @@ const DeploymentStatusScheduled = "scheduled"
 const DeploymentStatusBuildingImage = "building_image"
 const DeploymentStatusStartingContainers = "starting_containers"
 const DeploymentStatusFinished = "finished"
+const DeploymentStatusFailed = "failed"
 
 type Deployment struct {
 	Id            string
@@ -31,31 +33,12 @@ type Deployment struct {
 	EnvironmentId string
 	ImageId       string
 	SourceFolder  string
-}
-
-type GitHubPayload struct {
-	Ref string `json:"ref"`
-}
-
-type BitbucketPayload struct {
-	Push struct {
-		Changes []struct {
-			New struct {
-				Name   string `json:"name"`
-				Type   string `json:"type"`
-				Target struct {
-					Hash string `json:"hash"`
-				} `json:"target"`
-			} `json:"new"`
-			Old struct {
-				Name   string `json:"name"`
-				Type   string `json:"type"`
-				Target struct {
-					Hash string `json:"hash"`
-				} `json:"target"`
-			} `json:"old"`
-		} `json:"changes"`
-	} `json:"push"`
+	GitTag        string //Git tag to build, empty if we build a branch
+	CommitHash    string
+	GitRef        string //Full Git ref, for example refs/heads/main or refs/tags/v1.0.0
+	CommitAuthor  string
+	CommitMessage string
+	ErrorMsg      string //Why a deployment has failed
 }
 
 func handleEnvironmentDeploymentsGet(w http.ResponseWriter, r *http.Request) {
@@ -195,9 +178,82 @@ func handleEnvironmentDeploymentPost(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func handleServiceDeploymentPost(w http.ResponseWriter, r *http.Request) {
+// Redeploys an image of a previous deployment without building it again
+func handleEnvironmentRollbackPost(w http.ResponseWriter, r *http.Request) {
+	environment := getEnvironmentById(r.PathValue("id"))
+	if environment == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	targetDeployment := getDeploymentById(r.PathValue("deploymentId"))
+	if targetDeployment == nil || targetDeployment.EnvironmentId != environment.Id {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	image := getImageById(targetDeployment.ImageId)
+	if image == nil || image.Status != ImageStatusReady {
+		http.Error(w, "Image of deployment "+targetDeployment.Id+" isn't available anymore, increase ImageRetention of the environment to keep more images", http.StatusBadRequest)
+		return
+	}
+
+	deployment, err := redeployImage(*environment, *targetDeployment, *image, environment.MachineIds, "Rollback to deployment ID='"+targetDeployment.Id+"' with image ID='"+image.Id+"'")
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(deployment)
+	if err != nil {
+		fmt.Println("Cannot convert Deployment object into JSON:", err)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+// Creates a deployment that starts a ready image of a previous deployment on machineIds without building it again
+func redeployImage(environment Environment, targetDeployment Deployment, image Image, machineIds []string, message string) (Deployment, error) {
 	var deployment Deployment
 
+	id, err := NanoId(7)
+	if err != nil {
+		fmt.Println("Cannot generate new NanoId for Deployment:", err)
+		return deployment, err
+	}
+
+	//The image is ready, so the deployment goes straight to starting containers
+	deployment.Id = id
+	deployment.EnvironmentId = environment.Id
+	deployment.Status = DeploymentStatusStartingContainers
+	deployment.ImageId = image.Id
+	deployment.SourceFolder = targetDeployment.SourceFolder
+	deployment.GitTag = targetDeployment.GitTag
+	deployment.CommitHash = targetDeployment.CommitHash
+	deployment.GitRef = targetDeployment.GitRef
+	deployment.CommitAuthor = targetDeployment.CommitAuthor
+	deployment.CommitMessage = targetDeployment.CommitMessage
+	addDeployment(&deployment)
+
+	var envLog EnvironmentLog
+	envLog.EnvironmentId = environment.Id
+	envLog.DeploymentId = deployment.Id
+	envLog.Level = "6"
+	envLog.MachineId = thisMachine.Id
+	envLog.Message = message
+	saveEnvironmentLog(envLog)
+
+	//Schedule DeploymentJobs
+	for _, machineId := range machineIds {
+		scheduleDeploymentJob(machineId, environment, deployment)
+	}
+
+	return deployment, nil
+}
+
+func handleServiceDeploymentPost(w http.ResponseWriter, r *http.Request) {
+
 	serviceId := r.PathValue("serviceId")
 
 	var service = getServiceById(serviceId)
@@ -206,78 +262,124 @@ func handleServiceDeploymentPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//We should load environment by branch name and service Id
-	//Check header to know the webhook source
-	branchName := ""
-
-	agentHeader := r.Header.Get("User-Agent")
-	if agentHeader != "" {
-		if strings.Contains(agentHeader, "GitHub") {
-			fmt.Println("New GitHub webhook event is received")
-
-			var githubPayload GitHubPayload
-			err := decodeJSONBody(w, r, &githubPayload, false)
-
-			if err != nil {
-				var mr *malformedRequest
-				if errors.As(err, &mr) {
-					http.Error(w, mr.msg, mr.status)
-				} else {
-					log.Print(err.Error())
-					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-				}
-				return
-			}
+	body, err := readWebhookBody(w, r)
+	if err != nil {
+		http.Error(w, "Cannot read a request body", http.StatusBadRequest)
+		return
+	}
 
-			if !strings.Contains(githubPayload.Ref, "refs/heads/") {
-				fmt.Println("GitHub Handler: Current version doesn't support deployments by Git tags:", err)
-				return
-			}
-			branchName = strings.Replace(githubPayload.Ref, "refs/heads/", "", 1)
-		} else if strings.Contains(agentHeader, "Bitbucket") {
-			fmt.Println("New Bitbucket webhook event is received")
-
-			var bitbucketPayload BitbucketPayload
-			err := decodeJSONBody(w, r, &bitbucketPayload, false)
-
-			if err != nil {
-				var mr *malformedRequest
-				if errors.As(err, &mr) {
-					http.Error(w, mr.msg, mr.status)
-				} else {
-					log.Print(err.Error())
-					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-				}
-				return
-			}
-			if bitbucketPayload.Push.Changes[0].New.Type == "branch" {
-				branchName = bitbucketPayload.Push.Changes[0].New.Name
-			} else {
-				fmt.Println("Bitbucket Handler: Current version doesn't support deployments by Git tags:", err)
+	//Check headers to know the webhook source
+	provider := detectWebhookProvider(r)
+	fmt.Println("New " + provider.Name() + " webhook event is received")
+
+	if !provider.Verify(r, body, service.WebhookSecret) {
+		rejectWebhook(w, service, provider.Name()+" webhook signature is missing or invalid")
+		return
+	}
+
+	push, err := provider.Parse(body)
+	if err != nil {
+		fmt.Println("Cannot parse "+provider.Name()+" webhook payload:", err)
+		http.Error(w, "Cannot parse webhook payload", http.StatusBadRequest)
+		return
+	}
+
+	//Pushes that delete a branch or a tag have no commit to deploy
+	if push.IsDeleted {
+		fmt.Println("Git ref " + push.Ref + " has been deleted, nothing to deploy")
+		fmt.Fprint(w, "")
+		return
+	}
+
+	//Branch and tag names from payloads end up in git commands
+	refName, isTag := push.Tag()
+	if !isTag {
+		refName, _ = push.Branch()
+	}
+	if refName != "" && !isValidGitRefName(refName) {
+		fmt.Println("Invalid Git branch or tag name in "+provider.Name()+" webhook:", strconv.Quote(refName))
+		http.Error(w, "Invalid Git branch or tag name", http.StatusBadRequest)
+		return
+	}
+
+	//Tag pushes are deployed to all environments with GitTag pattern matching the tag
+	if isTag {
+		environments := getEnvironmentsByServiceIdAndTag(serviceId, refName)
+		if len(environments) == 0 {
+			fmt.Println("Cannot find environments for Git tag:", refName)
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		deployments := []Deployment{}
+		for _, environment := range environments {
+			fmt.Println("Found environment getEnvironmentsByServiceIdAndTag:", environment.Id)
+			deployment := scheduleWebhookDeployment(&environment, push)
+			if deployment != nil {
+				deployments = append(deployments, *deployment)
 			}
+		}
 
+		jsonBytes, err := json.Marshal(deployments)
+		if err != nil {
+			fmt.Println("Cannot convert Deployment object into JSON:", err)
+			return
 		}
+
+		fmt.Fprint(w, string(jsonBytes))
+		return
 	}
 
-	if branchName == "" {
+	//We should load environment by branch name and service Id
+	branchName, isBranch := push.Branch()
+	if !isBranch || branchName == "" {
 		fmt.Println("Cannot parse Git branch from payload")
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
 
 	environment := getEnvironmentByServiceIdAndName(serviceId, branchName)
+	if environment == nil {
+		fmt.Println("Cannot find environment for branch:", branchName)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
 	fmt.Println("Found environment getEnvironmentByServiceIdAndName:", environment.Id)
 
-	/////////////////////////////////////////////////////////
+	deployment := scheduleWebhookDeployment(environment, push)
+	if deployment == nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(deployment)
+	if err != nil {
+		fmt.Println("Cannot convert Proxy object into JSON:", err)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonBytes))
+
+}
+
+// Creates a deployment with an image to build from a Git branch or a Git tag from the webhook
+func scheduleWebhookDeployment(environment *Environment, push WebhookPush) *Deployment {
+	var deployment Deployment
+
 	id, err := NanoId(7)
 	if err != nil {
 		fmt.Println("Cannot generate new NanoId for Deployment:", err)
-		return
+		return nil
 	}
 
 	deployment.Id = id
 	deployment.EnvironmentId = environment.Id
 	deployment.Status = DeploymentStatusScheduled
+	deployment.GitTag, _ = push.Tag()
+	deployment.GitRef = push.Ref
+	deployment.CommitHash = push.Commit
+	deployment.CommitAuthor = push.Author
+	deployment.CommitMessage = push.Message
 
 	//Create a new image and schedule image building
 	var image Image
@@ -298,29 +400,68 @@ func handleServiceDeploymentPost(w http.ResponseWriter, r *http.Request) {
 		scheduleDeploymentJob(machineId, *environment, deployment)
 	}
 
-	jsonBytes, err := json.Marshal(deployment)
+	return &deployment
+}
+
+func scheduleDeploymentJob(machineId string, environment Environment, deployment Deployment) {
+	var job DeploymentJob
+	job.MachineId = machineId
+	job.Status = StatusToDeploy
+	job.DeploymentId = deployment.Id
+
+	var envLog EnvironmentLog
+	envLog.EnvironmentId = environment.Id
+	envLog.DeploymentId = deployment.Id
+	envLog.MachineId = machineId
+
+	//All replicas should fit into available memory of a machine, otherwise the job fails right away and the deployment fails when other jobs are finished
+	err := checkMachineMemory(machineId, getRequiredMemory(environment.ResourceLimits)*int64(max(environment.Replicas, 1)))
 	if err != nil {
-		fmt.Println("Cannot convert Proxy object into JSON:", err)
+		job = addDeploymentJob(job)
+		updateDeploymentJobError(job, err.Error())
+
+		envLog.Level = "3"
+		envLog.Message = "Deployment (ID='" + deployment.Id + "') cannot be scheduled: " + err.Error()
+		saveEnvironmentLog(envLog)
 		return
 	}
 
-	fmt.Fprint(w, string(jsonBytes))
+	addDeploymentJob(job)
 
+	envLog.Level = "6"
+	envLog.Message = "New deployment (ID='" + deployment.Id + "') for environment '" + environment.Name + "' has been scheduled on machine ID=" + machineId
+	saveEnvironmentLog(envLog)
 }
 
-func scheduleDeploymentJob(machineId string, environment Environment, deployment Deployment) {
+// Schedules a job that starts replicas from firstReplica to Environment.Replicas of a deployed deployment on a machine, running replicas are kept
+func scheduleScaleOutJob(machineId string, environment Environment, deployment Deployment, firstReplica int) {
 	var job DeploymentJob
 	job.MachineId = machineId
 	job.Status = StatusToDeploy
 	job.DeploymentId = deployment.Id
-	addDeploymentJob(job)
+	job.FirstReplica = firstReplica
 
 	var envLog EnvironmentLog
 	envLog.EnvironmentId = environment.Id
 	envLog.DeploymentId = deployment.Id
-	envLog.Level = "6"
 	envLog.MachineId = machineId
-	envLog.Message = "New deployment (ID='" + deployment.Id + "') for environment '" + environment.Name + "' has been scheduled on machine ID=" + machineId
+
+	//Only new replicas need memory, running ones are counted in machine stats already
+	err := checkMachineMemory(machineId, getRequiredMemory(environment.ResourceLimits)*int64(environment.Replicas-firstReplica+1))
+	if err != nil {
+		job = addDeploymentJob(job)
+		updateDeploymentJobError(job, err.Error())
+
+		envLog.Level = "3"
+		envLog.Message = "New replicas of deployment (ID='" + deployment.Id + "') cannot be scheduled: " + err.Error()
+		saveEnvironmentLog(envLog)
+		return
+	}
+
+	addDeploymentJob(job)
+
+	envLog.Level = "6"
+	envLog.Message = "Replicas from " + strconv.Itoa(firstReplica) + " to " + strconv.Itoa(environment.Replicas) + " of deployment (ID='" + deployment.Id + "') have been scheduled on machine ID=" + machineId
 	saveEnvironmentLog(envLog)
 }
 
@@ -343,7 +484,7 @@ func startDeploymentCheckerWorker() {
 				fmt.Println("Deployment: " + deployment.Id + ": " + " Status: " + deployment.Status)
 
 				//Check if there is already a built image for this deployment
-				images := getImageByDeploymentIdAndStatus(deployment.Id, ImageStatusReady)
+				images := getReadyImagesByDeployment(deployment)
 
 				if len(images) > 0 {
 					//The image has been built and uploaded to a container registry
@@ -359,23 +500,78 @@ func startDeploymentCheckerWorker() {
 								deployImage(images[0], job, deployment)
 							}
 						}
-					} else {
+					} else if len(getDeploymentJobsByDeploymentIdAndStatus(deployment.Id, StatusInProgress)) == 0 {
 						//All DeploymentJobs are finished, update status of Deployment
-						updateDeploymentStatus(deployment, DeploymentStatusFinished)
+						finishDeployment(deployment)
 					}
 				}
 			}
+
+			//Scale-out jobs belong to deployed deployments, so they are started without changing the deployment status
+			for _, job := range getDeploymentJobsByStatus(StatusToDeploy) {
+				if job.MachineId != thisMachine.Id || job.FirstReplica <= 1 {
+					continue
+				}
+
+				deployment := getDeploymentById(job.DeploymentId)
+				if deployment == nil {
+					updateDeploymentJobError(job, "Deployment "+job.DeploymentId+" doesn't exist")
+					continue
+				}
+
+				images := getReadyImagesByDeployment(*deployment)
+				if len(images) == 0 {
+					failDeploymentJob(job, *deployment, "The image of deployment "+deployment.Id+" isn't available anymore")
+					continue
+				}
+
+				deployImage(images[0], job, *deployment)
+			}
 		}()
 	}
 }
 
+// A deployment fails if it has failed on at least one machine
+func finishDeployment(deployment Deployment) {
+	errorMessages := []string{}
+	for _, job := range getDeploymentJobsByDeploymentIdAndStatus(deployment.Id, StatusFailed) {
+		errorMessages = append(errorMessages, "machine "+job.MachineId+": "+job.ErrorMsg)
+	}
+
+	if len(errorMessages) > 0 {
+		updateDeploymentError(deployment, "Deployment failed on "+strings.Join(errorMessages, "; "))
+		return
+	}
+
+	updateDeploymentStatus(deployment, DeploymentStatusFinished)
+}
+
+func updateDeploymentError(deployment Deployment, errorMsg string) error {
+
+	_, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "UPDATE Deployment SET Status = ?, ErrorMsg = ?, UpdatedAt = ? WHERE Id = ?",
+				Arguments: []interface{}{DeploymentStatusFailed, errorMsg, time.Now().UTC().Format(sqliteTimeFormat), deployment.Id},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf("Cannot update a row in Deployment: %s\n", err.Error())
+		return err
+	}
+
+	return nil
+}
+
 func updateDeploymentStatus(deployment Deployment, status string) error {
 
 	_, err := connection.WriteParameterized(
 		[]gorqlite.ParameterizedStatement{
 			{
-				Query:     "UPDATE Deployment SET Status = ? WHERE Id = ?",
-				Arguments: []interface{}{status, deployment.Id},
+				Query:     "UPDATE Deployment SET Status = ?, UpdatedAt = ? WHERE Id = ?",
+				Arguments: []interface{}{status, time.Now().UTC().Format(sqliteTimeFormat), deployment.Id},
 			},
 		},
 	)
@@ -403,28 +599,133 @@ func deployImage(image Image, job DeploymentJob, deployment Deployment) {
 	environment := getEnvironmentById(deployment.EnvironmentId)
 	service := getServiceById(environment.ServiceId)
 
+	//Each replica is a separate container with its own port on this machine
+	//Container name has format "deploymentId.replica_number"
+	//Environment variables are passed in a file, so values don't appear in scripts and logs
+	envFilePath, err := createEnvVarsFile(environment.Id, deployment.Id)
+	if err != nil {
+		failDeploymentJob(job, deployment, "Cannot load environment variables: "+err.Error())
+		return
+	}
+	defer os.Remove(envFilePath)
+
+	//Volumes are created once per machine and shared by all replicas, they survive redeploys
+	volumeArgs, err := createEnvironmentVolumes(*environment, deployment)
+	if err != nil {
+		failDeploymentJob(job, deployment, "Cannot create volumes: "+err.Error())
+		return
+	}
+
+	//Scale-out jobs start only new replicas, running replicas of the deployment keep serving traffic
+	firstReplica := max(job.FirstReplica, 1)
+	isScaleOut := firstReplica > 1
+
+	ports := map[int]string{} //Replica -> port
+	for replica := firstReplica; replica <= environment.Replicas; replica++ {
+		port, err := startReplicaContainer(image, *environment, *service, deployment, replica, envFilePath, volumeArgs)
+		if err != nil {
+			failDeploymentJob(job, deployment, "Cannot start replica "+strconv.Itoa(replica)+": "+err.Error())
+			return
+		}
+		ports[replica] = port
+	}
+
+	//Traffic is switched only to healthy containers, otherwise proxies and containers of the previous deployment stay
+	for replica, port := range ports {
+		err = checkContainerHealth(*environment, thisMachine.VPNIp, port)
+		if err != nil {
+			failDeploymentJob(job, deployment, "Replica "+strconv.Itoa(replica)+" is unhealthy, the previous deployment keeps serving traffic: "+err.Error())
+			return
+		}
+	}
+
+	fmt.Println("Image " + image.Id + " has been started on machine " + job.MachineId + " with " + strconv.Itoa(len(ports)) + " replicas")
+	err = updateDeploymentJobStatus(job, StatusDeployed)
+
+	if err != nil {
+		fmt.Printf(" Cannot update a row in DeploymentJob: %s\n", err.Error())
+		return
+	}
+
+	//Add a Proxy record for each replica, Caddy balances requests between them
+	//New proxies are added before old ones are deleted, so Caddy always has an upstream for the environment
+	for replica, port := range ports {
+		addReplicaProxies(*environment, deployment, replica, port)
+	}
+
+	if isScaleOut {
+		return
+	}
+
+	//Delete proxies of previous deployments on this machine, other machines switch their proxies after their own health checks
+	deleteProxiesIfDeploymentIdNotEqual(deployment.EnvironmentId, deployment.Id, thisMachine.VPNIp)
+
+	//Old containers are stopped after Caddy has reloaded its config and finished requests to them
+	time.Sleep(proxyDrainPeriod)
+
+	stopPreviousContainer(deployment)
+
+}
+
+// Adds a Proxy record for each domain of an environment to one replica on this machine
+func addReplicaProxies(environment Environment, deployment Deployment, replica int, port string) {
+	for _, domain := range environment.Domains {
+		var proxy Proxy
+		proxy.ContainerId = getContainerName(deployment.Id, replica)
+		proxy.ServerPrivateIP = thisMachine.VPNIp
+		proxy.Port = port
+		proxy.Domain = domain
+		proxy.EnvironmentId = deployment.EnvironmentId
+		proxy.DeploymentId = deployment.Id
+		addProxy(&proxy)
+	}
+}
+
+// Removes containers of a deployment that cannot serve traffic and marks its DeploymentJob as failed
+// A failed scale-out job removes only its new replicas
+func failDeploymentJob(job DeploymentJob, deployment Deployment, message string) {
+	fmt.Println("Deployment " + deployment.Id + " failed on machine " + job.MachineId + ": " + message)
+
+	var envLog EnvironmentLog
+	envLog.EnvironmentId = deployment.EnvironmentId
+	envLog.DeploymentId = deployment.Id
+	envLog.Level = "3"
+	envLog.MachineId = thisMachine.Id
+	envLog.Message = message
+	saveEnvironmentLog(envLog)
+
+	if job.FirstReplica > 1 {
+		removeReplicasFrom(deployment.Id, job.FirstReplica)
+	} else {
+		stopAndRemoveContainer(deployment.Id)
+	}
+
+	updateDeploymentJobError(job, message)
+}
+
+// Starts one replica of a deployment and returns a port on this machine
+func startReplicaContainer(image Image, environment Environment, service Service, deployment Deployment, replica int, envFilePath string, volumeArgs string) (string, error) {
 	portInt, err := GetFreePort()
 	if err != nil {
-		fmt.Println("Cannot get a free port on this machine:", err)
+		return "", err
 	}
 	port := strconv.Itoa(portInt)
 
-	//Now we start only one replica but later we will add more replicas
-	//Container name has format "deploymentId.replica_number"
-
 	//Check if it will be a container from a public image
 	var scriptTemplate *template.Template
 
 	if service.ImageName != "" {
 		scriptTemplate = createTemplate("run_container", `
 		#!/bin/sh
-		docker container run -p {{.MACHINE_VPN_IP}}:{{.MACHINE_PORT}}:{{.SERVICE_PORT}} -d --restart unless-stopped --log-driver=journald --name {{.DEPLOYMENT_ID}}.1 {{.IMAGE_NAME}}
+		set -e
+		docker container run -p {{.MACHINE_VPN_IP}}:{{.MACHINE_PORT}}:{{.SERVICE_PORT}} -d --restart unless-stopped --log-driver=journald --env-file {{.ENV_FILE}}{{.VOLUME_ARGS}}{{.RESOURCE_ARGS}} --name {{.CONTAINER_NAME}} {{.IMAGE_NAME}}
 `)
 	} else {
 		scriptTemplate = createTemplate("run_container", `
 		#!/bin/sh
+		set -e
 		docker image pull {{.CONTAINER_REGISTRY_IP}}:7000/{{.IMAGE_ID}}
-		docker container run -p {{.MACHINE_VPN_IP}}:{{.MACHINE_PORT}}:{{.SERVICE_PORT}} -d --restart unless-stopped --log-driver=journald --name {{.DEPLOYMENT_ID}}.1 {{.CONTAINER_REGISTRY_IP}}:7000/{{.IMAGE_ID}}
+		docker container run -p {{.MACHINE_VPN_IP}}:{{.MACHINE_PORT}}:{{.SERVICE_PORT}} -d --restart unless-stopped --log-driver=journald --env-file {{.ENV_FILE}}{{.VOLUME_ARGS}}{{.RESOURCE_ARGS}} --name {{.CONTAINER_NAME}} {{.CONTAINER_REGISTRY_IP}}:7000/{{.IMAGE_ID}}
 `)
 	}
 
@@ -434,18 +735,21 @@ func deployImage(image Image, job DeploymentJob, deployment Deployment) {
 		"IMAGE_ID":              image.Id,
 		"SERVICE_PORT":          environment.Port,
 		"MACHINE_PORT":          port,
-		"DEPLOYMENT_ID":         deployment.Id,
+		"CONTAINER_NAME":        getContainerName(deployment.Id, replica),
+		"ENV_FILE":              envFilePath,
+		"VOLUME_ARGS":           volumeArgs,
+		"RESOURCE_ARGS":         getResourceLimitsArgs(environment.ResourceLimits),
 		"CONTAINER_REGISTRY_IP": containerRegistryIp,
 		"MACHINE_VPN_IP":        thisMachine.VPNIp,
 	}
 
 	if err := scriptTemplate.Execute(&templateBytes, templateData); err != nil {
-		fmt.Println("Cannot execute template for starting a container:", err)
+		return "", err
 	}
 
 	scriptString := templateBytes.String()
 
-	_, err = executeScriptString(scriptString, func(logLine string) {
+	output, err := executeScriptString(scriptString, func(logLine string) {
 		//Save log message
 		var envLog EnvironmentLog
 		envLog.EnvironmentId = environment.Id
@@ -458,59 +762,54 @@ func deployImage(image Image, job DeploymentJob, deployment Deployment) {
 	})
 
 	if err != nil {
-		fmt.Println("Cannot start the image")
-		return
+		return "", fmt.Errorf("%w: %s", err, lastLines(output, 5))
 	}
 
-	fmt.Println("Image " + image.Id + " has been started on machine " + job.MachineId)
-	err = updateDeploymentJobStatus(job, StatusDeployed)
+	return port, nil
+}
 
-	if err != nil {
-		fmt.Printf(" Cannot update a row in DeploymentJob: %s\n", err.Error())
-		return
-	}
+/*Database*/
+func addDeployment(deployment *Deployment) {
 
-	//Delete all proxies with the same EnvironmentId as this deployment
-	deleteProxiesIfDeploymentIdNotEqual(deployment.EnvironmentId, deployment.Id)
+	_, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "INSERT INTO Deployment( Id, Status, EnvironmentId, ImageId, SourceFolder, GitTag, CommitHash, GitRef, CommitAuthor, CommitMessage) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+				Arguments: []interface{}{deployment.Id, deployment.Status, deployment.EnvironmentId, deployment.ImageId, deployment.SourceFolder, deployment.GitTag, deployment.CommitHash, deployment.GitRef, deployment.CommitAuthor, deployment.CommitMessage},
+			},
+		},
+	)
 
-	//Add a Proxy record
-	for _, domain := range environment.Domains {
-		var proxy Proxy
-		proxy.ServerPrivateIP = thisMachine.VPNIp
-		proxy.Port = port
-		proxy.Domain = domain
-		proxy.EnvironmentId = deployment.EnvironmentId
-		proxy.DeploymentId = deployment.Id
-		addProxy(&proxy)
+	if err != nil {
+		fmt.Printf(" Cannot write to Deployment table: %s\n", err.Error())
 	}
 
-	stopPreviousContainer(deployment.EnvironmentId)
-
 }
 
-/*Database*/
-func addDeployment(deployment *Deployment) {
+func updateDeploymentCommitInfo(deployment Deployment) error {
 
 	_, err := connection.WriteParameterized(
 		[]gorqlite.ParameterizedStatement{
 			{
-				Query:     "INSERT INTO Deployment( Id, Status, EnvironmentId, ImageId, SourceFolder) VALUES(?, ?, ?, ?, ?)",
-				Arguments: []interface{}{deployment.Id, deployment.Status, deployment.EnvironmentId, deployment.ImageId, deployment.SourceFolder},
+				Query:     "UPDATE Deployment SET CommitHash = ?, GitRef = ?, CommitAuthor = ?, CommitMessage = ? WHERE Id = ?",
+				Arguments: []interface{}{deployment.CommitHash, deployment.GitRef, deployment.CommitAuthor, deployment.CommitMessage, deployment.Id},
 			},
 		},
 	)
 
 	if err != nil {
-		fmt.Printf(" Cannot write to Deployment table: %s\n", err.Error())
+		fmt.Printf("Cannot update a row in Deployment: %s\n", err.Error())
+		return err
 	}
 
+	return nil
 }
 
 func getDeploymentById(deploymentId string) *Deployment {
 
 	rows, err := connection.QueryOneParameterized(
 		gorqlite.ParameterizedStatement{
-			Query:     "SELECT Id, Status, EnvironmentId, ImageId, SourceFolder from Deployment where id = ?",
+			Query:     "SELECT Id, Status, EnvironmentId, ImageId, SourceFolder, GitTag, CommitHash, GitRef, CommitAuthor, CommitMessage, ErrorMsg from Deployment where id = ?",
 			Arguments: []interface{}{deploymentId},
 		},
 	)
@@ -528,7 +827,7 @@ func getLastDeploymentByEnvironmentId(environmentId string) []Deployment {
 
 	rows, err := connection.QueryOneParameterized(
 		gorqlite.ParameterizedStatement{
-			Query:     "SELECT Id, Status, EnvironmentId, ImageId, SourceFolder from Deployment where EnvironmentId = ? ORDER BY CreatedAt DESC LIMIT 1",
+			Query:     "SELECT Id, Status, EnvironmentId, ImageId, SourceFolder, GitTag, CommitHash, GitRef, CommitAuthor, CommitMessage, ErrorMsg from Deployment where EnvironmentId = ? ORDER BY CreatedAt DESC LIMIT 1",
 			Arguments: []interface{}{environmentId},
 		},
 	)
@@ -537,11 +836,22 @@ func getLastDeploymentByEnvironmentId(environmentId string) []Deployment {
 
 }
 
+// The most recent deployment that runs on at least one machine
+func getDeployedDeployment(environmentId string) *Deployment {
+	for _, deployment := range getDeploymentsByEnvironmentId(environmentId) {
+		if len(getDeploymentJobsByDeploymentIdAndStatus(deployment.Id, StatusDeployed)) > 0 {
+			return &deployment
+		}
+	}
+
+	return nil
+}
+
 func getDeploymentsByEnvironmentId(environmentId string) []Deployment {
 
 	rows, err := connection.QueryOneParameterized(
 		gorqlite.ParameterizedStatement{
-			Query:     "SELECT Id, Status, EnvironmentId, ImageId, SourceFolder from Deployment where EnvironmentId = ? ORDER BY CreatedAt DESC",
+			Query:     "SELECT Id, Status, EnvironmentId, ImageId, SourceFolder, GitTag, CommitHash, GitRef, CommitAuthor, CommitMessage, ErrorMsg from Deployment where EnvironmentId = ? ORDER BY CreatedAt DESC",
 			Arguments: []interface{}{environmentId},
 		},
 	)
@@ -554,7 +864,7 @@ func getDeploymentsByStatus(status string) []Deployment {
 
 	rows, err := connection.QueryOneParameterized(
 		gorqlite.ParameterizedStatement{
-			Query:     "SELECT Id, Status, EnvironmentId, ImageId, SourceFolder from Deployment where Status = ? ORDER BY CreatedAt DESC",
+			Query:     "SELECT Id, Status, EnvironmentId, ImageId, SourceFolder, GitTag, CommitHash, GitRef, CommitAuthor, CommitMessage, ErrorMsg from Deployment where Status = ? ORDER BY CreatedAt DESC",
 			Arguments: []interface{}{status},
 		},
 	)
@@ -576,8 +886,14 @@ func handleQuery(rows gorqlite.QueryResult, err error) []Deployment {
 		var EnvironmentId string
 		var ImageId string
 		var SourceFolder string
-
-		err := rows.Scan(&Id, &Status, &EnvironmentId, &ImageId, &SourceFolder)
+		var GitTag string
+		var CommitHash string
+		var GitRef string
+		var CommitAuthor string
+		var CommitMessage string
+		var ErrorMsg string
+
+		err := rows.Scan(&Id, &Status, &EnvironmentId, &ImageId, &SourceFolder, &GitTag, &CommitHash, &GitRef, &CommitAuthor, &CommitMessage, &ErrorMsg)
 		if err != nil {
 			fmt.Printf(" Cannot run Scan: %s\n", err.Error())
 		}
@@ -587,6 +903,12 @@ func handleQuery(rows gorqlite.QueryResult, err error) []Deployment {
 			EnvironmentId: EnvironmentId,
 			ImageId:       ImageId,
 			SourceFolder:  SourceFolder,
+			GitTag:        GitTag,
+			CommitHash:    CommitHash,
+			GitRef:        GitRef,
+			CommitAuthor:  CommitAuthor,
+			CommitMessage: CommitMessage,
+			ErrorMsg:      ErrorMsg,
 		}
 		deployments = append(deployments, loadedDeployment)
 	}
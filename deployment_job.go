@@ -13,12 +13,15 @@ import (
 const StatusToDeploy = "to_deploy"
 const StatusInProgress = "in_progress"
 const StatusDeployed = "deployed"
+const StatusFailed = "failed"
 
 type DeploymentJob struct {
 	Id           string
 	Status       string
 	DeploymentId string
 	MachineId    string
+	ErrorMsg     string
+	FirstReplica int //Scale-out jobs start replicas from this number and keep running ones, 0 means all replicas
 }
 
 func addDeploymentJob(job DeploymentJob) DeploymentJob {
@@ -33,8 +36,8 @@ func addDeploymentJob(job DeploymentJob) DeploymentJob {
 	_, err = connection.WriteParameterized(
 		[]gorqlite.ParameterizedStatement{
 			{
-				Query:     "INSERT INTO DeploymentJob( Id, Status, DeploymentId, MachineId) VALUES(?, ?, ?, ?)",
-				Arguments: []interface{}{job.Id, job.Status, job.DeploymentId, job.MachineId},
+				Query:     "INSERT INTO DeploymentJob( Id, Status, DeploymentId, MachineId, FirstReplica) VALUES(?, ?, ?, ?, ?)",
+				Arguments: []interface{}{job.Id, job.Status, job.DeploymentId, job.MachineId, job.FirstReplica},
 			},
 		},
 	)
@@ -49,7 +52,7 @@ func getDeploymentJobsByStatus(status string) []DeploymentJob {
 
 	rows, err := connection.QueryOneParameterized(
 		gorqlite.ParameterizedStatement{
-			Query:     "SELECT Id, Status, DeploymentId, MachineId from DeploymentJob WHERE STATUS = ?",
+			Query:     "SELECT Id, Status, DeploymentId, MachineId, ErrorMsg, FirstReplica from DeploymentJob WHERE STATUS = ?",
 			Arguments: []interface{}{status},
 		},
 	)
@@ -57,11 +60,23 @@ func getDeploymentJobsByStatus(status string) []DeploymentJob {
 	return handleDeploymentJobQuery(rows, err)
 }
 
+func getDeploymentJobsByDeploymentId(deploymentId string) []DeploymentJob {
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id, Status, DeploymentId, MachineId, ErrorMsg, FirstReplica from DeploymentJob WHERE DeploymentId = ?",
+			Arguments: []interface{}{deploymentId},
+		},
+	)
+
+	return handleDeploymentJobQuery(rows, err)
+}
+
 func getDeploymentJobsByDeploymentIdAndStatus(deploymentId string, status string) []DeploymentJob {
 
 	rows, err := connection.QueryOneParameterized(
 		gorqlite.ParameterizedStatement{
-			Query:     "SELECT Id, Status, DeploymentId, MachineId from DeploymentJob WHERE DeploymentId = ? AND Status = ?",
+			Query:     "SELECT Id, Status, DeploymentId, MachineId, ErrorMsg, FirstReplica from DeploymentJob WHERE DeploymentId = ? AND Status = ?",
 			Arguments: []interface{}{deploymentId, status},
 		},
 	)
@@ -82,8 +97,10 @@ func handleDeploymentJobQuery(rows gorqlite.QueryResult, err error) []Deployment
 		var Status string
 		var DeploymentId string
 		var MachineId string
+		var ErrorMsg string
+		var FirstReplica int64
 
-		err := rows.Scan(&Id, &Status, &DeploymentId, &MachineId)
+		err := rows.Scan(&Id, &Status, &DeploymentId, &MachineId, &ErrorMsg, &FirstReplica)
 		if err != nil {
 			fmt.Printf(" Cannot run Scan: %s\n", err.Error())
 		}
@@ -92,6 +109,8 @@ func handleDeploymentJobQuery(rows gorqlite.QueryResult, err error) []Deployment
 			Status:       Status,
 			DeploymentId: DeploymentId,
 			MachineId:    MachineId,
+			ErrorMsg:     ErrorMsg,
+			FirstReplica: int(FirstReplica),
 		}
 		jobs = append(jobs, loadedJob)
 	}
@@ -118,3 +137,22 @@ func updateDeploymentJobStatus(job DeploymentJob, status string) error {
 
 	return nil
 }
+
+func updateDeploymentJobError(job DeploymentJob, errorMsg string) error {
+
+	_, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "UPDATE DeploymentJob SET Status = ?, ErrorMsg = ? WHERE Id = ?",
+				Arguments: []interface{}{StatusFailed, errorMsg, job.Id},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf("Cannot update a row in DeploymentJob: %s\n", err.Error())
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,422 @@
+/*
+Environment variables of environments. They are passed to containers and to docker build as build args
+Values of secret variables are encrypted in DB and never returned by API
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/user"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/rqlite/gorqlite"
+)
+
+type EnvVar struct {
+	Id            string
+	EnvironmentId string
+	Name          string
+	Value         string //Empty in API responses for secret variables
+	IsSecret      bool
+}
+
+var envVarNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Variables are exported before docker build, so names that change the shell or the docker client are reserved
+var reservedEnvVarNames = []string{"PATH", "HOME", "USER", "SHELL", "PWD", "OLDPWD", "IFS", "ENV", "BASH_ENV", "CDPATH", "TMPDIR"}
+var reservedEnvVarPrefixes = []string{"DOCKER_", "BUILDKIT_", "BUILDX_", "LD_"}
+
+func handleEnvVarPost(w http.ResponseWriter, r *http.Request) {
+	var envVar EnvVar
+	err := decodeJSONBody(w, r, &envVar, true)
+
+	if err != nil {
+		var mr *malformedRequest
+		if errors.As(err, &mr) {
+			http.Error(w, mr.msg, mr.status)
+		} else {
+			log.Print(err.Error())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	environment := getEnvironmentById(r.PathValue("environmentId"))
+	if environment == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	envVar.EnvironmentId = environment.Id
+
+	err = validateEnvVar(envVar)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, existingEnvVar := range getEnvVarsByEnvironmentId(environment.Id) {
+		if existingEnvVar.Name == envVar.Name {
+			http.Error(w, "Variable "+envVar.Name+" already exists, use PUT /env-var/"+existingEnvVar.Id+" to update it", http.StatusConflict)
+			return
+		}
+	}
+
+	err = addEnvVar(&envVar)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeEnvVarJSON(w, envVar)
+}
+
+func handleEnvVarGet(w http.ResponseWriter, r *http.Request) {
+
+	envVars := getEnvVarsByEnvironmentId(r.PathValue("environmentId"))
+	for index := range envVars {
+		if envVars[index].IsSecret {
+			envVars[index].Value = ""
+		}
+	}
+
+	jsonBytes, err := json.Marshal(envVars)
+	if err != nil {
+		fmt.Println("Cannot convert EnvVar object into JSON:", err)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+func handleEnvVarPut(w http.ResponseWriter, r *http.Request) {
+	var envVar EnvVar
+	err := decodeJSONBody(w, r, &envVar, true)
+
+	if err != nil {
+		var mr *malformedRequest
+		if errors.As(err, &mr) {
+			http.Error(w, mr.msg, mr.status)
+		} else {
+			log.Print(err.Error())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	existingEnvVar := getEnvVarById(r.PathValue("id"))
+	if existingEnvVar == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	envVar.Id = existingEnvVar.Id
+	envVar.EnvironmentId = existingEnvVar.EnvironmentId
+	envVar.Name = existingEnvVar.Name
+
+	err = validateEnvVar(envVar)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = updateEnvVar(envVar)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeEnvVarJSON(w, envVar)
+}
+
+func handleEnvVarDelete(w http.ResponseWriter, r *http.Request) {
+
+	if !deleteEnvVar(r.PathValue("id")) {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprint(w, "")
+}
+
+func writeEnvVarJSON(w http.ResponseWriter, envVar EnvVar) {
+	if envVar.IsSecret {
+		envVar.Value = ""
+	}
+
+	jsonBytes, err := json.Marshal(envVar)
+	if err != nil {
+		fmt.Println("Cannot convert EnvVar object into JSON:", err)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+func validateEnvVar(envVar EnvVar) error {
+	if !envVarNameRegexp.MatchString(envVar.Name) {
+		return errors.New("Name can contain only letters, digits and '_' and cannot start with a digit")
+	}
+
+	if isReservedEnvVarName(envVar.Name) {
+		return errors.New("Name " + envVar.Name + " is reserved, names like PATH, HOME or DOCKER_* change the build environment")
+	}
+
+	//Docker env files don't support multiline values
+	if strings.ContainsAny(envVar.Value, "\r\n") {
+		return errors.New("Value cannot contain line breaks")
+	}
+
+	return nil
+}
+
+func isReservedEnvVarName(name string) bool {
+	name = strings.ToUpper(name)
+	if slices.Contains(reservedEnvVarNames, name) {
+		return true
+	}
+
+	for _, prefix := range reservedEnvVarPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*Deployments*/
+
+// Writes variables into a file for docker run --env-file, the caller should remove the file
+func createEnvVarsFile(environmentId string, fileId string) (string, error) {
+	envVars, err := getDecryptedEnvVarsByEnvironmentId(environmentId)
+	if err != nil {
+		return "", err
+	}
+
+	content := ""
+	for _, envVar := range envVars {
+		content += envVar.Name + "=" + envVar.Value + "\n"
+	}
+
+	return writeEnvVarsFile(fileId+".env", content)
+}
+
+// Writes variables into a shell file that is sourced before docker build, returns "--build-arg NAME" arguments without values
+// Values are passed through the environment of docker build, so they don't appear in build scripts and logs
+func createBuildArgsFile(environmentId string, fileId string) (string, string, error) {
+	envVars, err := getDecryptedEnvVarsByEnvironmentId(environmentId)
+	if err != nil {
+		return "", "", err
+	}
+
+	content := ""
+	buildArgs := ""
+	for _, envVar := range envVars {
+		//Variables saved before names were reserved are passed only to containers
+		if isReservedEnvVarName(envVar.Name) {
+			continue
+		}
+		content += "export " + envVar.Name + "='" + strings.ReplaceAll(envVar.Value, "'", `'\''`) + "'\n"
+		buildArgs += " --build-arg " + envVar.Name
+	}
+
+	filePath, err := writeEnvVarsFile(fileId+".build.env", content)
+	return filePath, buildArgs, err
+}
+
+func writeEnvVarsFile(fileName string, content string) (string, error) {
+	currentUser, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+
+	filePath := currentUser.HomeDir + "/" + fileName
+	err = os.WriteFile(filePath, []byte(content), 0600)
+	if err != nil {
+		return "", err
+	}
+
+	return filePath, nil
+}
+
+func getDecryptedEnvVarsByEnvironmentId(environmentId string) ([]EnvVar, error) {
+	envVars := getEnvVarsByEnvironmentId(environmentId)
+
+	for index, envVar := range envVars {
+		if !envVar.IsSecret {
+			continue
+		}
+
+		value, err := decryptSecret(envVar.Value)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decrypt variable %s: %w", envVar.Name, err)
+		}
+		envVars[index].Value = value
+	}
+
+	return envVars, nil
+}
+
+/*Database*/
+
+func addEnvVar(envVar *EnvVar) error {
+
+	id, err := NanoId(7)
+	if err != nil {
+		fmt.Println("Cannot generate new NanoId for EnvVar:", err)
+		return err
+	}
+
+	envVar.Id = id
+
+	value, err := getEnvVarStoredValue(*envVar)
+	if err != nil {
+		return err
+	}
+
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "INSERT INTO EnvVar( Id, EnvironmentId, Name, Value, IsSecret) VALUES(?, ?, ?, ?, ?)",
+				Arguments: []interface{}{envVar.Id, envVar.EnvironmentId, envVar.Name, value, boolToInt(envVar.IsSecret)},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot write to EnvVar table: %s\n", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func updateEnvVar(envVar EnvVar) error {
+
+	value, err := getEnvVarStoredValue(envVar)
+	if err != nil {
+		return err
+	}
+
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "UPDATE EnvVar SET Value = ?, IsSecret = ? WHERE Id = ?",
+				Arguments: []interface{}{value, boolToInt(envVar.IsSecret), envVar.Id},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf("Cannot update a row in EnvVar: %s\n", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// Secret values are stored encrypted
+func getEnvVarStoredValue(envVar EnvVar) (string, error) {
+	if !envVar.IsSecret {
+		return envVar.Value, nil
+	}
+
+	return encryptSecret(envVar.Value)
+}
+
+func deleteEnvVarsByEnvironmentId(environmentId string) bool {
+	_, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "DELETE FROM EnvVar WHERE EnvironmentId = ?",
+				Arguments: []interface{}{environmentId},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot delete records from EnvVar table: %s\n", err.Error())
+		return false
+	}
+
+	return true
+}
+
+func deleteEnvVar(envVarId string) bool {
+	_, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "DELETE FROM EnvVar WHERE Id = ?",
+				Arguments: []interface{}{envVarId},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot delete a record from EnvVar table: %s\n", err.Error())
+		return false
+	}
+
+	return true
+}
+
+func getEnvVarById(envVarId string) *EnvVar {
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id, EnvironmentId, Name, Value, IsSecret from EnvVar WHERE Id = ?",
+			Arguments: []interface{}{envVarId},
+		},
+	)
+
+	envVars := handleEnvVarQuery(rows, err)
+	if len(envVars) == 0 {
+		return nil
+	}
+
+	return &envVars[0]
+}
+
+func getEnvVarsByEnvironmentId(environmentId string) []EnvVar {
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id, EnvironmentId, Name, Value, IsSecret from EnvVar WHERE EnvironmentId = ? ORDER BY Name",
+			Arguments: []interface{}{environmentId},
+		},
+	)
+
+	return handleEnvVarQuery(rows, err)
+}
+
+func handleEnvVarQuery(rows gorqlite.QueryResult, err error) []EnvVar {
+
+	var envVars = []EnvVar{}
+
+	if err != nil {
+		fmt.Printf(" Cannot read from EnvVar table: %s\n", err.Error())
+	}
+
+	for rows.Next() {
+		var envVar EnvVar
+		var isSecret int64
+
+		err := rows.Scan(&envVar.Id, &envVar.EnvironmentId, &envVar.Name, &envVar.Value, &isSecret)
+		if err != nil {
+			fmt.Printf(" Cannot run Scan: %s\n", err.Error())
+		}
+		envVar.IsSecret = isSecret == 1
+
+		envVars = append(envVars, envVar)
+	}
+
+	return envVars
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"path"
 	"strings"
 
 	"github.com/rqlite/gorqlite"
@@ -15,14 +16,31 @@ type Environment struct {
 	Id                   string
 	Name                 string
 	Branch               string
-	GitTag               string
+	GitTag               string //Pattern of Git tags to deploy, for example "v*"
 	Domains              []string
 	MachineIds           []string
 	Port                 string
 	ServiceId            string
 	LastDeploymentStatus string
+	Replicas             int //Number of containers on each machine from MachineIds, 1 by default
+	MachineCount         int //Number of machines the scheduler picks if MachineIds are empty, 1 by default
 
-	VolumeId string
+	//A new deployment gets traffic only after its containers respond to GET HealthCheckPath, empty path disables checks
+	HealthCheckPath    string
+	HealthCheckStatus  int //Expected HTTP status, 200 by default
+	HealthCheckTimeout int //Timeout of one request in seconds, 5 by default
+	HealthCheckRetries int //Number of attempts with 3 seconds between them, 10 by default
+
+	ImageRetention int //Number of built images we keep for rollbacks, 2 by default
+
+	//Limits of each replica
+	ResourceLimits
+
+	//Replicas are changed by the autoscaler between MinReplicas and MaxReplicas
+	AutoscaleSettings
+
+	//Retention and ingestion limits of container logs
+	LogSettings
 }
 
 func handleEnvironmentPost(w http.ResponseWriter, r *http.Request) {
@@ -40,7 +58,35 @@ func handleEnvironmentPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	addEnvironment(&environment)
+	//The branch is passed to git clone
+	if environment.Branch != "" && !isValidGitRefName(environment.Branch) {
+		http.Error(w, "Invalid Branch, use a Git branch name with letters, digits and . _ / + -", http.StatusBadRequest)
+		return
+	}
+
+	err = validateResourceLimits(environment.ResourceLimits)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = validateAutoscaleSettings(environment.AutoscaleSettings)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = validateLogSettings(environment.LogSettings)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = addEnvironment(&environment)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 
 	jsonBytes, err := json.Marshal(environment)
 	if err != nil {
@@ -81,6 +127,30 @@ func handleEnvironmentByServiceIdPut(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	//The branch is passed to git clone
+	if environment.Branch != "" && !isValidGitRefName(environment.Branch) {
+		http.Error(w, "Invalid Branch, use a Git branch name with letters, digits and . _ / + -", http.StatusBadRequest)
+		return
+	}
+
+	err = validateResourceLimits(environment.ResourceLimits)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = validateAutoscaleSettings(environment.AutoscaleSettings)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = validateLogSettings(environment.LogSettings)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	if !updateEnvironment(environment) {
 		fmt.Println("Cannot update a record from Environment table")
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -105,11 +175,11 @@ func handleEnvironmentDelete(w http.ResponseWriter, r *http.Request) {
 
 /*Database*/
 
-func addEnvironment(environment *Environment) {
+func addEnvironment(environment *Environment) error {
 	id, err := NanoId(7)
 	if err != nil {
 		fmt.Println("Cannot generate new NanoId for Environment:", err)
-		return
+		return err
 	}
 
 	environment.Id = id
@@ -127,184 +197,174 @@ func addEnvironment(environment *Environment) {
 		}
 	}
 
-	//Check if we should add to Environment.MachineIds the first machine because there is no MachineIds in the request body
+	if environment.Replicas < 1 {
+		environment.Replicas = 1
+	}
+
+	//The scheduler picks workload machines if there is no MachineIds in the request body
 	if len(environment.MachineIds) == 0 {
-		machines := getMachines()
-		if len(machines) > 0 {
-			environment.MachineIds = append(environment.MachineIds, machines[0].Id)
+		environment.MachineIds, err = scheduleEnvironmentMachines(*environment, []string{})
+		if err != nil {
+			return err
 		}
 	}
 
 	_, err = connection.WriteParameterized(
 		[]gorqlite.ParameterizedStatement{
 			{
-				Query:     "INSERT INTO Environment( Id, ServiceId, Name, Branch, Domains, Port, MachineIds, GitTag) VALUES(?, ?, ?, ?, ?, ?, ?, ?)",
-				Arguments: []interface{}{environment.Id, environment.ServiceId, environment.Name, environment.Branch, strings.Join(environment.Domains, ";"), environment.Port, strings.Join(environment.MachineIds, ";"), environment.GitTag},
+				Query:     "INSERT INTO Environment( Id, ServiceId, Name, Branch, Domains, Port, MachineIds, GitTag, Replicas, HealthCheckPath, HealthCheckStatus, HealthCheckTimeout, HealthCheckRetries, ImageRetention, CPULimit, MemoryLimit, CPUReservation, MemoryReservation, MachineCount, MinReplicas, MaxReplicas, ScaleOutCPU, ScaleInCPU, ScaleOutMemory, ScaleInMemory, ScaleOutRequestRate, ScaleInRequestRate, ScaleCooldown, LogRetentionDays, LogRetentionRows, LogRateLimit) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+				Arguments: []interface{}{environment.Id, environment.ServiceId, environment.Name, environment.Branch, strings.Join(environment.Domains, ";"), environment.Port, strings.Join(environment.MachineIds, ";"), environment.GitTag, environment.Replicas, environment.HealthCheckPath, environment.HealthCheckStatus, environment.HealthCheckTimeout, environment.HealthCheckRetries, environment.ImageRetention, environment.CPULimit, environment.MemoryLimit, environment.CPUReservation, environment.MemoryReservation, environment.MachineCount, environment.MinReplicas, environment.MaxReplicas, environment.ScaleOutCPU, environment.ScaleInCPU, environment.ScaleOutMemory, environment.ScaleInMemory, environment.ScaleOutRequestRate, environment.ScaleInRequestRate, environment.ScaleCooldown, environment.LogRetentionDays, environment.LogRetentionRows, environment.LogRateLimit},
 			},
 		},
 	)
 
 	if err != nil {
 		fmt.Printf(" Cannot write to Environment table: %s\n", err.Error())
-	} else {
-		//Create a new table to store logs for this environment
-		createEnvLogsTableIfNeeded(environment.Id)
+		return err
 	}
+
+	//Create a new table to store logs for this environment
+	createEnvLogsTableIfNeeded(environment.Id)
+
+	return nil
 }
 
 func loadEnvironmentsByServiceId(serviceId string) []Environment {
-	var environments = []Environment{}
 
 	rows, err := connection.QueryOneParameterized(
 		gorqlite.ParameterizedStatement{
-			Query:     "SELECT Id, ServiceId, Name, Branch, Domains, Port, MachineIds, GitTag from Environment where ServiceId = ?",
+			Query:     "SELECT " + environmentColumns + " from Environment where ServiceId = ?",
 			Arguments: []interface{}{serviceId},
 		},
 	)
 
-	if err != nil {
-		fmt.Printf(" Cannot read from Environment table: %s\n", err.Error())
-	}
-
-	for rows.Next() {
-		var Id string
-		var Name string
-		var Branch string
-		var Domains string
-		var Port string
-		var ServiceId string
-		var MachineIds string
-		var GitTag string
-
-		err := rows.Scan(&Id, &ServiceId, &Name, &Branch, &Domains, &Port, &MachineIds, &GitTag)
-		if err != nil {
-			fmt.Printf(" Cannot run Scan: %s\n", err.Error())
-		}
-		loadedEnvironment := Environment{
-			Id:         Id,
-			ServiceId:  ServiceId,
-			Name:       Name,
-			Branch:     Branch,
-			Domains:    strings.Split(Domains, ";"),
-			Port:       Port,
-			MachineIds: strings.Split(MachineIds, ";"),
-			GitTag:     GitTag,
-		}
+	environments := handleEnvironmentQuery(rows, err)
 
+	for index, environment := range environments {
 		//Get a status of the most recent deployment
-		deployments := getLastDeploymentByEnvironmentId(Id)
+		deployments := getLastDeploymentByEnvironmentId(environment.Id)
 		if len(deployments) > 0 {
-			loadedEnvironment.LastDeploymentStatus = deployments[0].Status
+			environments[index].LastDeploymentStatus = deployments[0].Status
 		} else {
-			loadedEnvironment.LastDeploymentStatus = "no deployments"
+			environments[index].LastDeploymentStatus = "no deployments"
 		}
-
-		environments = append(environments, loadedEnvironment)
 	}
 
 	return environments
 }
 
-func getEnvironmentById(environmentId string) *Environment {
+func getEnvironments() []Environment {
 
 	rows, err := connection.QueryOneParameterized(
 		gorqlite.ParameterizedStatement{
-			Query:     "SELECT Id, ServiceId, Name, Branch, Domains, Port, MachineIds, GitTag from Environment where Id = ?",
-			Arguments: []interface{}{environmentId},
+			Query:     "SELECT " + environmentColumns + " from Environment",
+			Arguments: []interface{}{},
 		},
 	)
 
-	if err != nil {
-		fmt.Printf(" Cannot read from Environment table: %s\n", err.Error())
-		return nil
-	}
-
-	if rows.NumRows() == 0 {
-		return nil
-	}
+	return handleEnvironmentQuery(rows, err)
+}
 
-	rows.Next()
+func getEnvironmentById(environmentId string) *Environment {
 
-	var Id string
-	var Name string
-	var Branch string
-	var Domains string
-	var Port string
-	var ServiceId string
-	var MachineIds string
-	var GitTag string
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT " + environmentColumns + " from Environment where Id = ?",
+			Arguments: []interface{}{environmentId},
+		},
+	)
 
-	err = rows.Scan(&Id, &ServiceId, &Name, &Branch, &Domains, &Port, &MachineIds, &GitTag)
-	if err != nil {
-		fmt.Printf(" Cannot run Scan: %s\n", err.Error())
-	}
-	loadedEnvironment := Environment{
-		Id:         Id,
-		ServiceId:  ServiceId,
-		Name:       Name,
-		Branch:     Branch,
-		Domains:    strings.Split(Domains, ";"),
-		Port:       Port,
-		MachineIds: strings.Split(MachineIds, ";"),
-		GitTag:     GitTag,
+	environments := handleEnvironmentQuery(rows, err)
+	if len(environments) == 0 {
+		return nil
 	}
-	return &loadedEnvironment
 
+	return &environments[0]
 }
 
 func getEnvironmentByServiceIdAndName(serviceId string, branchName string) *Environment {
 
 	rows, err := connection.QueryOneParameterized(
 		gorqlite.ParameterizedStatement{
-			Query:     "SELECT Id, ServiceId, Name, Branch, Domains, Port, MachineIds, GitTag from Environment where ServiceId = ? AND Branch = ?",
+			Query:     "SELECT " + environmentColumns + " from Environment where ServiceId = ? AND Branch = ?",
 			Arguments: []interface{}{serviceId, branchName},
 		},
 	)
 
-	if err != nil {
-		fmt.Printf(" Cannot read from Environment table: %s\n", err.Error())
+	environments := handleEnvironmentQuery(rows, err)
+	if len(environments) == 0 {
 		return nil
 	}
 
-	if rows.NumRows() == 0 {
-		return nil
-	}
+	return &environments[0]
+}
 
-	rows.Next()
+const environmentColumns = "Id, ServiceId, Name, Branch, Domains, Port, MachineIds, GitTag, Replicas, HealthCheckPath, HealthCheckStatus, HealthCheckTimeout, HealthCheckRetries, ImageRetention, CPULimit, MemoryLimit, CPUReservation, MemoryReservation, MachineCount, MinReplicas, MaxReplicas, ScaleOutCPU, ScaleInCPU, ScaleOutMemory, ScaleInMemory, ScaleOutRequestRate, ScaleInRequestRate, ScaleCooldown, LogRetentionDays, LogRetentionRows, LogRateLimit"
 
-	var Id string
-	var Name string
-	var Branch string
-	var Domains string
-	var Port string
-	var ServiceId string
-	var MachineIds string
-	var GitTag string
+func handleEnvironmentQuery(rows gorqlite.QueryResult, err error) []Environment {
+	var environments = []Environment{}
 
-	err = rows.Scan(&Id, &ServiceId, &Name, &Branch, &Domains, &Port, &MachineIds, &GitTag)
 	if err != nil {
-		fmt.Printf(" Cannot run Scan: %s\n", err.Error())
+		fmt.Printf(" Cannot read from Environment table: %s\n", err.Error())
+		return environments
 	}
-	loadedEnvironment := Environment{
-		Id:         Id,
-		ServiceId:  ServiceId,
-		Name:       Name,
-		Branch:     Branch,
-		Domains:    strings.Split(Domains, ";"),
-		Port:       Port,
-		MachineIds: strings.Split(MachineIds, ";"),
-		GitTag:     GitTag,
+
+	for rows.Next() {
+		var environment Environment
+		var Domains string
+		var MachineIds string
+
+		err := rows.Scan(&environment.Id, &environment.ServiceId, &environment.Name, &environment.Branch, &Domains, &environment.Port, &MachineIds, &environment.GitTag, &environment.Replicas, &environment.HealthCheckPath, &environment.HealthCheckStatus, &environment.HealthCheckTimeout, &environment.HealthCheckRetries, &environment.ImageRetention, &environment.CPULimit, &environment.MemoryLimit, &environment.CPUReservation, &environment.MemoryReservation, &environment.MachineCount, &environment.MinReplicas, &environment.MaxReplicas, &environment.ScaleOutCPU, &environment.ScaleInCPU, &environment.ScaleOutMemory, &environment.ScaleInMemory, &environment.ScaleOutRequestRate, &environment.ScaleInRequestRate, &environment.ScaleCooldown, &environment.LogRetentionDays, &environment.LogRetentionRows, &environment.LogRateLimit)
+		if err != nil {
+			fmt.Printf(" Cannot run Scan: %s\n", err.Error())
+		}
+
+		environment.Domains = strings.Split(Domains, ";")
+		environment.MachineIds = strings.Split(MachineIds, ";")
+		if MachineIds == "" {
+			environment.MachineIds = []string{}
+		}
+		environment.Replicas = max(environment.Replicas, 1)
+
+		environments = append(environments, environment)
 	}
-	return &loadedEnvironment
 
+	return environments
+}
+
+// GitTag of an environment is a pattern like "v*", so we match tags in Go instead of SQL
+func getEnvironmentsByServiceIdAndTag(serviceId string, tagName string) []Environment {
+	var environments = []Environment{}
+
+	for _, environment := range loadEnvironmentsByServiceId(serviceId) {
+		if environment.GitTag == "" {
+			continue
+		}
+
+		isMatched, err := path.Match(environment.GitTag, tagName)
+		if err != nil {
+			fmt.Printf(" Invalid GitTag pattern '%s' in environment %s: %s\n", environment.GitTag, environment.Id, err.Error())
+			continue
+		}
+
+		if isMatched {
+			environments = append(environments, environment)
+		}
+	}
+
+	return environments
 }
 
 func updateEnvironment(environment Environment) (result bool) {
+	if environment.Replicas < 1 {
+		environment.Replicas = 1
+	}
+
 	_, err := connection.WriteParameterized(
 		[]gorqlite.ParameterizedStatement{
 			{
-				Query:     "UPDATE Environment SET Name = ?, Branch = ?, Domains = ?, Port = ?, MachineIds = ?, GitTag = ? WHERE Id = ?",
-				Arguments: []interface{}{environment.Name, environment.Branch, strings.Join(environment.Domains, ";"), environment.Port, strings.Join(environment.MachineIds, ";"), environment.GitTag, environment.Id},
+				Query:     "UPDATE Environment SET Name = ?, Branch = ?, Domains = ?, Port = ?, MachineIds = ?, GitTag = ?, Replicas = ?, HealthCheckPath = ?, HealthCheckStatus = ?, HealthCheckTimeout = ?, HealthCheckRetries = ?, ImageRetention = ?, CPULimit = ?, MemoryLimit = ?, CPUReservation = ?, MemoryReservation = ?, MachineCount = ?, MinReplicas = ?, MaxReplicas = ?, ScaleOutCPU = ?, ScaleInCPU = ?, ScaleOutMemory = ?, ScaleInMemory = ?, ScaleOutRequestRate = ?, ScaleInRequestRate = ?, ScaleCooldown = ?, LogRetentionDays = ?, LogRetentionRows = ?, LogRateLimit = ? WHERE Id = ?",
+				Arguments: []interface{}{environment.Name, environment.Branch, strings.Join(environment.Domains, ";"), environment.Port, strings.Join(environment.MachineIds, ";"), environment.GitTag, environment.Replicas, environment.HealthCheckPath, environment.HealthCheckStatus, environment.HealthCheckTimeout, environment.HealthCheckRetries, environment.ImageRetention, environment.CPULimit, environment.MemoryLimit, environment.CPUReservation, environment.MemoryReservation, environment.MachineCount, environment.MinReplicas, environment.MaxReplicas, environment.ScaleOutCPU, environment.ScaleInCPU, environment.ScaleOutMemory, environment.ScaleInMemory, environment.ScaleOutRequestRate, environment.ScaleInRequestRate, environment.ScaleCooldown, environment.LogRetentionDays, environment.LogRetentionRows, environment.LogRateLimit, environment.Id},
 			},
 		},
 	)
@@ -340,6 +400,8 @@ func deleteEnvironment(environmentId string) (result bool) {
 	//Remove a proxy record to update Caddyfile
 	deleteProxyByEnvironmentId(environmentId)
 
+	deleteEnvVarsByEnvironmentId(environmentId)
+
 	_, err := connection.WriteParameterized(
 		[]gorqlite.ParameterizedStatement{
 			{
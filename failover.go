@@ -0,0 +1,198 @@
+/*
+Failover of workloads. The lighthouse moves environments and databases from machines that stay offline longer than a grace period
+Containers on moved machines are removed by ContainerJobs and DatabaseJobs when these machines are back online
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"time"
+)
+
+const defaultFailoverGracePeriod = time.Minute * 2
+
+// Machine ID -> time when the reconciler noticed the machine is offline, kept in memory only, so a restarted lighthouse waits a full grace period again
+var offlineMachinesSince = map[string]time.Time{}
+
+// Machines whose workloads have been moved already, a machine is removed from the list when it's back online.
+// A machine is added only after all its workloads have been moved, otherwise the failover is retried on the next check
+var failedOverMachineIds = map[string]bool{}
+
+func startFailoverReconciler() {
+
+	// Only lighthouses ping machines and move workloads
+	if !slices.Contains(thisMachine.Types, MachineTypeLighthouse) {
+		return
+	}
+
+	gracePeriod := defaultFailoverGracePeriod
+	gracePeriodEnv, isGracePeriodEnvExists := os.LookupEnv("TURBOCLOUD_FAILOVER_GRACE_PERIOD")
+	if isGracePeriodEnvExists {
+		parsedGracePeriod, err := time.ParseDuration(gracePeriodEnv)
+		if err != nil {
+			fmt.Println("Invalid TURBOCLOUD_FAILOVER_GRACE_PERIOD, it should be a duration like 2m:", err)
+		} else {
+			gracePeriod = parsedGracePeriod
+		}
+	}
+
+	//Checks run one after another, so a slow failover isn't started twice
+	for range time.Tick(time.Second * 10) {
+		reconcileOfflineMachines(gracePeriod)
+	}
+}
+
+func reconcileOfflineMachines(gracePeriod time.Duration) {
+	for _, machine := range getMachines() {
+		if machine.Status != MachineStatusOffline {
+			delete(offlineMachinesSince, machine.Id)
+			if failedOverMachineIds[machine.Id] && machine.Status == MachineStatusOnline {
+				fmt.Println("Machine " + machine.Name + " is back online")
+				delete(failedOverMachineIds, machine.Id)
+			}
+			continue
+		}
+
+		offlineSince, isFound := offlineMachinesSince[machine.Id]
+		if !isFound {
+			offlineMachinesSince[machine.Id] = time.Now()
+			continue
+		}
+
+		if failedOverMachineIds[machine.Id] || time.Since(offlineSince) < gracePeriod {
+			continue
+		}
+
+		if failoverMachine(machine, offlineSince) {
+			failedOverMachineIds[machine.Id] = true
+		}
+	}
+}
+
+// Moves environments and databases from an offline machine, returns false if some of them cannot be moved.
+// Moved workloads don't use the machine anymore, so a retry moves only the remaining ones
+func failoverMachine(machine Machine, offlineSince time.Time) bool {
+	fmt.Println("Machine " + machine.Name + " has been offline since " + offlineSince.Format(time.RFC3339) + ", moving its workloads")
+
+	isMoved := true
+
+	for _, environment := range getEnvironments() {
+		if !slices.Contains(environment.MachineIds, machine.Id) {
+			continue
+		}
+
+		var envLog EnvironmentLog
+		envLog.EnvironmentId = environment.Id
+		envLog.MachineId = thisMachine.Id
+		envLog.Level = "4"
+		envLog.Message = "Failover: machine " + machine.Name + " (ID=" + machine.Id + ") has been offline since " + offlineSince.Format(time.RFC3339) + ", moving the environment to other machines"
+		saveEnvironmentLog(envLog)
+
+		//The scheduler keeps online machines only, so the offline machine is replaced and its proxies are removed
+		_, err := replaceEnvironmentMachines(environment)
+		if err != nil {
+			envLog.Level = "3"
+			envLog.Message = "Failover: cannot move the environment from machine " + machine.Name + ", it will be retried: " + err.Error()
+			saveEnvironmentLog(envLog)
+			isMoved = false
+		}
+	}
+
+	for _, database := range getAllDatabase() {
+		if !slices.Contains(database.MachineIds, machine.Id) || database.Status == DatabaseStatusToDelete {
+			continue
+		}
+
+		err := failoverDatabase(database, machine)
+		if err != nil {
+			fmt.Println("Failover: cannot move Database " + database.Id + " from machine " + machine.Name + ", it will be retried: " + err.Error())
+			isMoved = false
+		}
+	}
+
+	return isMoved
+}
+
+// Starts a database on a new machine, the data is restored from the last backup that isn't stored on the offline machine
+func failoverDatabase(database Database, offlineMachine Machine) error {
+	machineIds := []string{}
+	for _, machineId := range database.MachineIds {
+		if machineId != offlineMachine.Id {
+			machineIds = append(machineIds, machineId)
+		}
+	}
+
+	newMachineIds, err := scheduleMachines(getRequiredMemory(database.ResourceLimits), len(database.MachineIds), machineIds)
+	if err != nil {
+		return err
+	}
+
+	addedMachineIds := []string{}
+	for _, machineId := range newMachineIds {
+		if !slices.Contains(machineIds, machineId) {
+			addedMachineIds = append(addedMachineIds, machineId)
+		}
+	}
+
+	//Clients connect to the primary container, if it was on the offline machine, the first started new container becomes the primary one
+	primaryJob := getDatabasePrimaryJob(database)
+	isPrimaryMoved := primaryJob == nil || primaryJob.MachineId == offlineMachine.Id
+	hostPort := database.HostPort
+	if isPrimaryMoved {
+		hostPort = ""
+	}
+
+	status := database.Status
+	if len(addedMachineIds) > 0 {
+		status = DatabasetatusStartingContainers
+	}
+
+	err = updateDatabasePlacement(database.Id, newMachineIds, hostPort, status)
+	if err != nil {
+		return err
+	}
+
+	for _, job := range getDatabaseJobsByDatabaseId(database.Id) {
+		if job.MachineId == offlineMachine.Id && job.Status != DatabaseJobStatusRemoved {
+			updateDatabaseJobStatus(job, DatabaseJobStatusToRemove)
+		}
+	}
+
+	for _, machineId := range addedMachineIds {
+		var job DatabaseJob
+		job.MachineId = machineId
+		job.Status = StatusToDeploy
+		job.DatabaseId = database.Id
+		addDatabaseJob(job)
+	}
+
+	fmt.Println("Failover: Database " + database.Id + " has been moved from machine " + offlineMachine.Name + " to machines " + fmt.Sprint(addedMachineIds))
+
+	if !isPrimaryMoved || len(addedMachineIds) == 0 {
+		return nil
+	}
+
+	//Backups are sorted from the newest one, local files on the offline machine cannot be loaded
+	for _, backup := range getBackupsByDatabaseId(database.Id) {
+		if backup.Status != BackupStatusFinished || (backup.TargetType != BackupTargetS3 && backup.MachineId == offlineMachine.Id) {
+			continue
+		}
+
+		var restore DatabaseRestore
+		restore.DatabaseId = database.Id
+		restore.BackupId = backup.Id
+		restore.Status = RestoreStatusPlanned
+		if !addDatabaseRestore(&restore) {
+			return fmt.Errorf("cannot schedule a restore of backup %s", backup.Id)
+		}
+
+		fmt.Println("Failover: Database " + database.Id + " will be restored from backup " + backup.Id)
+		return nil
+	}
+
+	fmt.Println("Failover: Database " + database.Id + " has no backups outside of machine " + offlineMachine.Name + ", it starts with empty data")
+	return nil
+}
@@ -0,0 +1,76 @@
+/*
+Health checks of new containers. A deployment switches proxies and stops previous containers only after all its replicas are healthy
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultHealthCheckStatus = http.StatusOK
+const defaultHealthCheckTimeout = 5
+const defaultHealthCheckRetries = 10
+const healthCheckInterval = time.Second * 3
+
+// Returns nil if a container responds with the expected status or if health checks are disabled for an environment
+func checkContainerHealth(environment Environment, ip string, port string) error {
+	if environment.HealthCheckPath == "" {
+		return nil
+	}
+
+	expectedStatus := environment.HealthCheckStatus
+	if expectedStatus == 0 {
+		expectedStatus = defaultHealthCheckStatus
+	}
+
+	timeout := environment.HealthCheckTimeout
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+
+	retries := environment.HealthCheckRetries
+	if retries <= 0 {
+		retries = defaultHealthCheckRetries
+	}
+
+	path := environment.HealthCheckPath
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	url := "http://" + ip + ":" + port + path
+
+	client := &http.Client{
+		Timeout: time.Duration(timeout) * time.Second,
+		//Redirects (for example, to HTTPS) shouldn't be followed, we check a status of the container itself
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	var lastError error
+	for attempt := 1; attempt <= retries; attempt++ {
+		response, err := client.Get(url)
+		if err != nil {
+			lastError = err
+		} else {
+			response.Body.Close()
+			if response.StatusCode == expectedStatus {
+				return nil
+			}
+			lastError = fmt.Errorf("expected status %d, got %d", expectedStatus, response.StatusCode)
+		}
+
+		fmt.Println("Health check " + strconv.Itoa(attempt) + "/" + strconv.Itoa(retries) + " of " + url + " failed: " + lastError.Error())
+
+		if attempt < retries {
+			time.Sleep(healthCheckInterval)
+		}
+	}
+
+	return fmt.Errorf("health check of %s failed after %d attempts: %w", url, retries, lastError)
+}
@@ -118,11 +118,32 @@ func executeScriptString(scriptString string, logReceivedCallback func(string))
 	}
 
 	cmd := exec.Command("/bin/sh", fileName)
+	cmdOutput, err := runCommand(cmd, logReceivedCallback)
 
+	removeErr := os.Remove(fileName) //remove the script file
+	if removeErr != nil {
+		fmt.Printf(" Cannot remove script: %s\n", removeErr.Error())
+	}
+
+	return cmdOutput, err
+}
+
+// Runs a program without a shell, so arguments from webhooks and users cannot be interpreted as shell syntax
+func executeCommand(dir string, logReceivedCallback func(string), name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	return runCommand(cmd, logReceivedCallback)
+}
+
+// Streams stdout and stderr of a command line by line to logReceivedCallback and returns the whole output
+func runCommand(cmd *exec.Cmd, logReceivedCallback func(string)) (string, error) {
 	stdout, _ := cmd.StdoutPipe()
 	stderr, _ := cmd.StderrPipe()
 
-	cmd.Start()
+	err := cmd.Start()
+	if err != nil {
+		return "", err
+	}
 
 	var wg sync.WaitGroup
 	outch := make(chan string, 10)
@@ -164,14 +185,32 @@ func executeScriptString(scriptString string, logReceivedCallback func(string))
 
 	wg.Wait()
 
-	err = os.Remove(fileName) //remove the script file
-	if err != nil {
-		fmt.Printf(" Cannot remove script: %s\n", err.Error())
+	//Wait returns an error if the script exits with a non-zero code, the code of the last command by default or of a failed command with "set -e"
+	waitErr := cmd.Wait()
+	if waitErr != nil {
+		return cmdOutput, fmt.Errorf("%s failed: %w", cmd.Path, waitErr)
 	}
 
 	return cmdOutput, nil
 }
 
+// Returns last lines of a script output, we store them as an error message when a script fails
+func lastLines(output string, count int) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) > count {
+		lines = lines[len(lines)-count:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// SQLite has no boolean type, we store booleans as 0 and 1
+func boolToInt(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
+
 // GetFreePort asks the kernel for a free open port that is ready to use.
 func GetFreePort() (port int, err error) {
 	var a *net.TCPAddr
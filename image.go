@@ -8,8 +8,13 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"os"
+	"os/exec"
 	"os/user"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/rqlite/gorqlite"
 )
@@ -18,6 +23,9 @@ const ImageStatusToBuild = "to_build"
 const ImageStatusBuilding = "building"
 const ImageStatusReady = "ready"
 const ImageStatusError = "error"
+const ImageStatusRemoved = "removed" //Removed by image retention, it cannot be used for rollbacks
+
+const defaultImageRetention = 2
 
 type Image struct {
 	Id            string
@@ -57,8 +65,27 @@ func updateImageStatus(image Image, status string) error {
 	_, err := connection.WriteParameterized(
 		[]gorqlite.ParameterizedStatement{
 			{
-				Query:     "UPDATE Image SET Status = ? WHERE Id = ?",
-				Arguments: []interface{}{status, image.Id},
+				Query:     "UPDATE Image SET Status = ?, UpdatedAt = ? WHERE Id = ?",
+				Arguments: []interface{}{status, time.Now().UTC().Format(sqliteTimeFormat), image.Id},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf("Cannot update a row in Image: %s\n", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func updateImageError(image Image, errorMsg string) error {
+
+	_, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "UPDATE Image SET Status = ?, ErrorMsg = ?, UpdatedAt = ? WHERE Id = ?",
+				Arguments: []interface{}{ImageStatusError, errorMsg, time.Now().UTC().Format(sqliteTimeFormat), image.Id},
 			},
 		},
 	)
@@ -150,6 +177,18 @@ func getImageByDeploymentIdAndStatus(deploymentId string, status string) []Image
 
 }
 
+// Rollbacks reuse an image of another deployment, so we look for an image by Deployment.ImageId first
+func getReadyImagesByDeployment(deployment Deployment) []Image {
+	if deployment.ImageId != "" {
+		image := getImageById(deployment.ImageId)
+		if image != nil && image.Status == ImageStatusReady {
+			return []Image{*image}
+		}
+	}
+
+	return getImageByDeploymentIdAndStatus(deployment.Id, ImageStatusReady)
+}
+
 func getImagesByEnvironmentId(environmentId string) []Image {
 
 	var images = []Image{}
@@ -226,34 +265,24 @@ func buildImage(image Image, deployment Deployment) {
 	//Get service
 	service := getServiceById(environment.ServiceId)
 
-	//Get previous image that we should remove
-	//We keep only last 2 images
-	images := getImagesByEnvironmentId(deployment.EnvironmentId)
-	rmImageCmd := ""
-	if len(images) > 2 {
-		rmImageCmd = "docker image rm " + images[2].Id
-		rmImageCmd += "\ndocker image rm " + containerRegistryIp + ":7000/" + images[2].Id
+	//Deployments from Git tags check out the tag instead of the environment branch
+	gitRef := environment.Branch
+	if deployment.GitTag != "" {
+		gitRef = deployment.GitTag
 	}
 
 	sourceFolder := randomId
-	gitCloneCMD := `git clone --recurse-submodules -b ` + environment.Branch + ` ` + service.GitURL + ` ` + sourceFolder
+	isGitClone := deployment.SourceFolder == ""
 
-	if deployment.SourceFolder != "" {
+	if !isGitClone {
 		sourceFolder = deployment.SourceFolder
-		gitCloneCMD = ""
 	}
 
-	scriptTemplate := createTemplate("caddyfile", `
-	#!/bin/sh
-	cd {{.HOME_DIR}}
-	{{.GIT_CLONE_CMD}}
-	docker build {{.LOCAL_FOLDER}} -t {{.IMAGE_ID}}
-	docker image tag {{.IMAGE_ID}} {{.CONTAINER_REGISTRY_IP}}:7000/{{.IMAGE_ID}}
-	docker image push {{.CONTAINER_REGISTRY_IP}}:7000/{{.IMAGE_ID}}
-	#docker manifest inspect --insecure {{.CONTAINER_REGISTRY_IP}}:7000/{{.IMAGE_ID}}
-	rm -rf {{.LOCAL_FOLDER}}
-	{{.RM_OLD_IMAGE_CMD}}
-`)
+	//Refs are validated when webhooks and environments are saved, older records are checked here as well
+	if isGitClone && !isValidGitRefName(gitRef) {
+		failImageBuild(image, deployment, "Invalid Git branch or tag name: "+strconv.Quote(gitRef))
+		return
+	}
 
 	currentUser, err := user.Current()
 	if err != nil {
@@ -262,14 +291,68 @@ func buildImage(image Image, deployment Deployment) {
 
 	homeDir := currentUser.HomeDir
 
+	saveBuildLog := func(logLine string) {
+		//Save log message
+		var envLog EnvironmentLog
+		envLog.EnvironmentId = environment.Id
+		envLog.DeploymentId = deployment.Id
+		envLog.Level = "6"
+		envLog.MachineId = thisMachine.Id
+		envLog.Message = logLine
+		saveEnvironmentLog(envLog)
+		////////////////////////
+	}
+
+	//Clone the repository first to read commit details before the build
+	//git runs without a shell, "--" stops option parsing before the URL
+	if isGitClone {
+		output, err := executeCommand(homeDir, saveBuildLog, "git", "clone", "--recurse-submodules", "-b", gitRef, "--", service.GitURL, sourceFolder)
+		if err != nil {
+			failImageBuild(image, deployment, "Cannot clone the repository: "+lastLines(output, 5))
+			return
+		}
+	}
+
+	sourcePath := sourceFolder
+	if !filepath.IsAbs(sourcePath) {
+		sourcePath = filepath.Join(homeDir, sourceFolder)
+	}
+	loadCommitInfo(&deployment, sourcePath, gitRef)
+
+	//Environment variables are available as build args, values are exported from a file before docker build
+	buildArgsFilePath, buildArgs, err := createBuildArgsFile(environment.Id, image.Id)
+	if err != nil {
+		failImageBuild(image, deployment, "Cannot load environment variables: "+err.Error())
+		return
+	}
+	defer os.Remove(buildArgsFilePath)
+
+	//The build stops on the first failed command, the source folder is removed in any case
+	scriptTemplate := createTemplate("caddyfile", `
+	#!/bin/sh
+	cd {{.HOME_DIR}}
+	build() {
+		set -e
+		. {{.BUILD_ARGS_FILE}}
+		docker build {{.LOCAL_FOLDER}}{{.BUILD_ARGS}} -t {{.IMAGE_ID}}
+		docker image tag {{.IMAGE_ID}} {{.CONTAINER_REGISTRY_IP}}:7000/{{.IMAGE_ID}}
+		docker image push {{.CONTAINER_REGISTRY_IP}}:7000/{{.IMAGE_ID}}
+	}
+	( build )
+	BUILD_EXIT_CODE=$?
+	#docker manifest inspect --insecure {{.CONTAINER_REGISTRY_IP}}:7000/{{.IMAGE_ID}}
+	rm -rf {{.LOCAL_FOLDER}}
+	exit $BUILD_EXIT_CODE
+`)
+
 	var templateBytes bytes.Buffer
 	templateData := map[string]string{
-		"GIT_CLONE_CMD":         gitCloneCMD,
 		"HOME_DIR":              homeDir,
 		"LOCAL_FOLDER":          sourceFolder,
 		"IMAGE_ID":              image.Id,
 		"CONTAINER_REGISTRY_IP": containerRegistryIp,
-		"RM_OLD_IMAGE_CMD":      rmImageCmd,
+		"BUILD_ARGS_FILE":       buildArgsFilePath,
+		"BUILD_ARGS":            buildArgs,
 	}
 
 	if err := scriptTemplate.Execute(&templateBytes, templateData); err != nil {
@@ -278,19 +361,9 @@ func buildImage(image Image, deployment Deployment) {
 
 	scriptString := templateBytes.String()
 
-	_, err = executeScriptString(scriptString, func(logLine string) {
-		//Save log message
-		var envLog EnvironmentLog
-		envLog.EnvironmentId = environment.Id
-		envLog.DeploymentId = deployment.Id
-		envLog.Level = "6"
-		envLog.MachineId = thisMachine.Id
-		envLog.Message = logLine
-		saveEnvironmentLog(envLog)
-		////////////////////////
-	})
+	output, err := executeScriptString(scriptString, saveBuildLog)
 	if err != nil {
-		fmt.Println("Cannot build the image")
+		failImageBuild(image, deployment, "Cannot build the image: "+lastLines(output, 5))
 		return
 	}
 
@@ -305,8 +378,101 @@ func buildImage(image Image, deployment Deployment) {
 
 	updateDeploymentStatus(deployment, DeploymentStatusStartingContainers)
 
+	//Old images are removed only after the new one is ready, a failed build keeps all of them
+	removeOldImages(*environment, image)
+
 	if err != nil {
 		fmt.Printf(" Cannot update a row in Deployment: %s\n", err.Error())
 		return
 	}
 }
+
+// Keeps Environment.ImageRetention ready images including the new one, older images cannot be used for rollbacks
+// The image of the latest deployed deployment serves traffic, it's never removed and isn't counted (it can be old after a rollback)
+func removeOldImages(environment Environment, newImage Image) {
+	imageRetention := environment.ImageRetention
+	if imageRetention <= 0 {
+		imageRetention = defaultImageRetention
+	}
+
+	deployedImageId := ""
+	deployedDeployment := getDeployedDeployment(environment.Id)
+	if deployedDeployment != nil {
+		deployedImageId = deployedDeployment.ImageId
+	}
+
+	previousImages := 0
+	for _, previousImage := range getImagesByEnvironmentId(environment.Id) {
+		if previousImage.Id == newImage.Id || previousImage.Id == deployedImageId || previousImage.Status != ImageStatusReady {
+			continue
+		}
+
+		previousImages++
+		if previousImages < imageRetention {
+			continue
+		}
+
+		updateImageStatus(previousImage, ImageStatusRemoved)
+
+		_, err := exec.Command("docker", "image", "rm", previousImage.Id, containerRegistryIp+":7000/"+previousImage.Id).CombinedOutput()
+		if err != nil {
+			fmt.Println("Cannot remove image "+previousImage.Id+":", err)
+		}
+	}
+}
+
+// A failed build stops the pipeline, containers of the previous deployment keep running
+func failImageBuild(image Image, deployment Deployment, errorMsg string) {
+	fmt.Println("Image " + image.Id + " has not been built: " + errorMsg)
+
+	var envLog EnvironmentLog
+	envLog.EnvironmentId = deployment.EnvironmentId
+	envLog.DeploymentId = deployment.Id
+	envLog.Level = "3"
+	envLog.MachineId = thisMachine.Id
+	envLog.Message = errorMsg
+	saveEnvironmentLog(envLog)
+
+	updateImageError(image, errorMsg)
+	updateDeploymentError(deployment, errorMsg)
+}
+
+// Fills commit details that haven't been received from a webhook payload
+// The commit hash is always read from the clone, a branch can move after the webhook, so details of another commit are replaced
+// Deployments from local folders may have no .git folder, in this case we keep details from the payload
+func loadCommitInfo(deployment *Deployment, sourcePath string, gitRef string) {
+
+	if deployment.GitRef == "" && gitRef != "" && deployment.SourceFolder == "" {
+		if deployment.GitTag != "" {
+			deployment.GitRef = GitRefTagPrefix + gitRef
+		} else {
+			deployment.GitRef = GitRefBranchPrefix + gitRef
+		}
+	}
+
+	out, err := exec.Command("git", "-C", sourcePath, "rev-parse", "HEAD").Output()
+	if err != nil {
+		fmt.Println("Cannot get a commit hash with git rev-parse:", err)
+	} else if commitHash := strings.TrimSpace(string(out)); commitHash != deployment.CommitHash {
+		deployment.CommitHash = commitHash
+		deployment.CommitAuthor = ""
+		deployment.CommitMessage = ""
+	}
+
+	if deployment.CommitAuthor == "" || deployment.CommitMessage == "" {
+		out, err := exec.Command("git", "-C", sourcePath, "log", "-1", "--format=%an <%ae>%n%B").Output()
+		if err != nil {
+			fmt.Println("Cannot get commit details with git log:", err)
+		} else {
+			author, message, _ := strings.Cut(string(out), "\n")
+			if deployment.CommitAuthor == "" {
+				deployment.CommitAuthor = strings.TrimSpace(author)
+			}
+			if deployment.CommitMessage == "" {
+				deployment.CommitMessage = strings.TrimSpace(message)
+			}
+		}
+	}
+
+	updateDeploymentCommitInfo(*deployment)
+}
@@ -137,7 +137,7 @@ func removeImage(imageId string, environmentId string) {
 		////////////////////////
 	})
 	if err != nil {
-		fmt.Println("Cannot remove an image with ID %s", imageId)
+		fmt.Printf("Cannot remove an image with ID %s\n", imageId)
 		return
 	}
 }
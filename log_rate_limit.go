@@ -0,0 +1,116 @@
+/*
+Rate limits of container logs. Each log line is a replicated rqlite write, so every machine counts lines of each environment per minute
+and drops lines above LogRateLimit. The number of dropped lines is saved to the environment logs when the next minute starts
+*/
+
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+const logRateLimitWindow = time.Minute
+
+// Deployments and settings of environments are cached, so log lines don't need database reads
+const logTargetCacheTTL = time.Minute
+
+type logTarget struct {
+	EnvironmentId string
+	ImageId       string
+	RateLimit     int //Lines per second
+	LoadedAt      time.Time
+}
+
+type logRateLimitWindowState struct {
+	StartedAt time.Time
+	Lines     int
+	Dropped   int
+}
+
+var logTargetsMutex sync.Mutex
+var logTargets = map[string]logTarget{} //Deployment ID -> environment of its logs
+
+var logRateLimitsMutex sync.Mutex
+var logRateLimits = map[string]*logRateLimitWindowState{} //Environment ID -> lines in the current window
+
+// Returns nil if the deployment or its environment doesn't exist
+func getLogTarget(deploymentId string) *logTarget {
+	logTargetsMutex.Lock()
+	target, isCached := logTargets[deploymentId]
+	logTargetsMutex.Unlock()
+
+	if isCached && time.Since(target.LoadedAt) < logTargetCacheTTL {
+		return &target
+	}
+
+	deployment := getDeploymentById(deploymentId)
+	if deployment == nil {
+		return nil
+	}
+
+	environment := getEnvironmentById(deployment.EnvironmentId)
+	if environment == nil {
+		return nil
+	}
+
+	target = logTarget{
+		EnvironmentId: environment.Id,
+		ImageId:       deployment.ImageId,
+		RateLimit:     getLogSettings(*environment).LogRateLimit,
+		LoadedAt:      time.Now(),
+	}
+
+	logTargetsMutex.Lock()
+	logTargets[deploymentId] = target
+	for cachedDeploymentId, cachedTarget := range logTargets {
+		if time.Since(cachedTarget.LoadedAt) > logTargetCacheTTL {
+			delete(logTargets, cachedDeploymentId)
+		}
+	}
+	logTargetsMutex.Unlock()
+
+	return &target
+}
+
+// Returns false if a log line of the environment should be dropped
+func allowEnvironmentLog(target logTarget) bool {
+	now := time.Now()
+
+	logRateLimitsMutex.Lock()
+	state := logRateLimits[target.EnvironmentId]
+	if state == nil {
+		state = &logRateLimitWindowState{StartedAt: now}
+		logRateLimits[target.EnvironmentId] = state
+	}
+
+	droppedInLastWindow := 0
+	if now.Sub(state.StartedAt) >= logRateLimitWindow {
+		droppedInLastWindow = state.Dropped
+		*state = logRateLimitWindowState{StartedAt: now}
+	}
+
+	state.Lines++
+	isAllowed := state.Lines <= target.RateLimit*int(logRateLimitWindow/time.Second)
+	if !isAllowed {
+		state.Dropped++
+	}
+	logRateLimitsMutex.Unlock()
+
+	if !isAllowed {
+		observeDroppedLogs(target.EnvironmentId)
+	}
+
+	if droppedInLastWindow > 0 {
+		var envLog EnvironmentLog
+		envLog.EnvironmentId = target.EnvironmentId
+		envLog.ImageId = target.ImageId
+		envLog.MachineId = thisMachine.Id
+		envLog.Level = "4"
+		envLog.Message = "Dropped " + strconv.Itoa(droppedInLastWindow) + " log lines on machine " + thisMachine.Name + ", the environment exceeded LogRateLimit of " + strconv.Itoa(target.RateLimit) + " lines per second"
+		saveEnvironmentLog(envLog)
+	}
+
+	return isAllowed
+}
@@ -0,0 +1,266 @@
+/*
+Retention of environment logs. The lighthouse deletes logs older than LogRetentionDays and logs above LogRetentionRows from EnvLogs{environmentId},
+merges search indexes after deletes and drops log tables of deleted environments
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rqlite/gorqlite"
+)
+
+const logCompactorInterval = time.Minute * 10
+
+const defaultLogRetentionDays = 7
+const defaultLogRetentionRows = 100000
+const defaultLogRateLimit = 100
+
+// Pages of the search index merged after each compaction, merges are incremental so a big index isn't rewritten at once
+const logSearchMergePages = 500
+
+type LogSettings struct {
+	LogRetentionDays int //Logs older than this number of days are deleted, 7 by default
+	LogRetentionRows int //Only this number of the newest logs is kept, 100000 by default
+	LogRateLimit     int //Container log lines per second on each machine, averaged over a minute, 100 by default
+}
+
+func validateLogSettings(settings LogSettings) error {
+	if settings.LogRetentionDays < 0 {
+		return errors.New("LogRetentionDays should be positive, 0 means 7 days")
+	}
+
+	if settings.LogRetentionRows < 0 {
+		return errors.New("LogRetentionRows should be positive, 0 means 100000 logs")
+	}
+
+	if settings.LogRateLimit < 0 {
+		return errors.New("LogRateLimit should be positive, 0 means 100 lines per second")
+	}
+
+	return nil
+}
+
+// Settings equal to 0 are replaced with defaults
+func getLogSettings(environment Environment) LogSettings {
+	settings := environment.LogSettings
+
+	if settings.LogRetentionDays == 0 {
+		settings.LogRetentionDays = defaultLogRetentionDays
+	}
+	if settings.LogRetentionRows == 0 {
+		settings.LogRetentionRows = defaultLogRetentionRows
+	}
+	if settings.LogRateLimit == 0 {
+		settings.LogRateLimit = defaultLogRateLimit
+	}
+
+	return settings
+}
+
+func startLogCompactor() {
+
+	// Deletes are replicated to all machines, so only lighthouses run them
+	if !slices.Contains(thisMachine.Types, MachineTypeLighthouse) {
+		return
+	}
+
+	for range time.Tick(logCompactorInterval) {
+		for _, environment := range getEnvironments() {
+			compactEnvironmentLogs(environment)
+		}
+
+		dropDeletedEnvironmentLogs()
+	}
+}
+
+// getEnvironments returns an empty list on errors, so tables are dropped only after a successful read shows that the environment is gone
+func dropDeletedEnvironmentLogs() {
+	//Tables are listed before environments, so a table of an environment that is being created is never dropped
+	logTables, err := getEnvLogsTables()
+	if err != nil {
+		fmt.Printf(" Cannot read log tables: %s\n", err.Error())
+		return
+	}
+
+	environmentIds, err := getEnvironmentIds()
+	if err != nil {
+		fmt.Printf(" Cannot read environments, log tables of deleted environments are kept: %s\n", err.Error())
+		return
+	}
+
+	for _, environmentId := range logTables {
+		if slices.Contains(environmentIds, environmentId) {
+			continue
+		}
+
+		//Checked once more right before the drop, an error keeps the tables
+		isDeleted, err := isEnvironmentDeleted(environmentId)
+		if err != nil {
+			fmt.Printf(" Cannot check environment %s, its log tables are kept: %s\n", environmentId, err.Error())
+			continue
+		}
+
+		if isDeleted {
+			dropEnvLogsTables(environmentId)
+		}
+	}
+}
+
+func compactEnvironmentLogs(environment Environment) {
+	settings := getLogSettings(environment)
+	logsTable := "EnvLogs" + environment.Id
+	searchTable := "EnvLogsSearch" + environment.Id
+
+	cutoff := time.Now().AddDate(0, 0, -settings.LogRetentionDays).UnixMicro()
+
+	results, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "DELETE FROM " + logsTable + " WHERE PublishedAt < ?",
+				Arguments: []interface{}{cutoff},
+			},
+			{
+				Query:     "DELETE FROM " + logsTable + " WHERE rowid IN (SELECT rowid FROM " + logsTable + " ORDER BY PublishedAt DESC, Id DESC LIMIT -1 OFFSET ?)",
+				Arguments: []interface{}{settings.LogRetentionRows},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot delete old logs from %s table: %s\n", logsTable, err.Error())
+		return
+	}
+
+	var deletedLogs int64
+	for _, result := range results {
+		deletedLogs += result.RowsAffected
+	}
+
+	if deletedLogs == 0 {
+		return
+	}
+
+	//Deleted logs stay in the search index as tombstones until its segments are merged.
+	//VACUUM isn't used because it can change rowids that the search index refers to
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "INSERT INTO " + searchTable + " (" + searchTable + ", rank) VALUES ('merge', ?)",
+				Arguments: []interface{}{logSearchMergePages},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot merge %s index: %s\n", searchTable, err.Error())
+	}
+}
+
+func getEnvironmentIds() ([]string, error) {
+	environmentIds := []string{}
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id FROM Environment",
+			Arguments: []interface{}{},
+		},
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var id string
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		environmentIds = append(environmentIds, id)
+	}
+
+	return environmentIds, nil
+}
+
+func isEnvironmentDeleted(environmentId string) (bool, error) {
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT COUNT(*) FROM Environment WHERE Id = ?",
+			Arguments: []interface{}{environmentId},
+		},
+	)
+
+	if err != nil {
+		return false, err
+	}
+
+	if !rows.Next() {
+		return false, errors.New("no result for COUNT query")
+	}
+
+	var count int64
+	err = rows.Scan(&count)
+	if err != nil {
+		return false, err
+	}
+
+	return count == 0, nil
+}
+
+// Returns environment IDs of all EnvLogs{environmentId} tables
+func getEnvLogsTables() ([]string, error) {
+	environmentIds := []string{}
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT name FROM sqlite_master WHERE type = 'table' AND name LIKE 'EnvLogs%'",
+			Arguments: []interface{}{},
+		},
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var name string
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+
+		//EnvLogsSearch{environmentId} and its shadow tables are dropped together with EnvLogs{environmentId}
+		if strings.HasPrefix(name, "EnvLogsSearch") {
+			continue
+		}
+
+		environmentIds = append(environmentIds, strings.TrimPrefix(name, "EnvLogs"))
+	}
+
+	return environmentIds, nil
+}
+
+func dropEnvLogsTables(environmentId string) {
+	_, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "DROP TABLE IF EXISTS EnvLogsSearch" + environmentId,
+				Arguments: []interface{}{},
+			},
+			{
+				Query:     "DROP TABLE IF EXISTS EnvLogs" + environmentId,
+				Arguments: []interface{}{},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot drop log tables of environment %s: %s\n", environmentId, err.Error())
+	}
+}
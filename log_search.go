@@ -0,0 +1,291 @@
+/*
+Log search of environments. GET /logs/environment/{environmentId} filters EnvLogs{environmentId} by level, deployment, machine, image and time,
+finds messages by substring (?contains=) or with a full-text FTS5 query (?q=) and returns pages of logs with an opaque cursor
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rqlite/gorqlite"
+)
+
+const defaultLogsPageSize = 100
+const maxLogsPageSize = 1000
+
+// Level stores syslog priorities, names can be used instead of numbers in filters
+var logLevelPriorities = map[string]int{"emerg": 0, "alert": 1, "crit": 2, "err": 3, "error": 3, "warning": 4, "warn": 4, "notice": 5, "info": 6, "debug": 7}
+
+type LogFilter struct {
+	DeploymentId string
+	MachineId    string
+	ImageId      string
+	Levels       []string //Exact priorities
+	MaxLevel     string   //This priority and more severe ones
+	Contains     string
+	Query        string //FTS5 query
+}
+
+type LogsPage struct {
+	Logs       []EnvironmentLog
+	NextCursor string //Empty on the last page
+}
+
+// Position of the last log on a page, logs are ordered by PublishedAt and Id because PublishedAt isn't unique
+type logCursor struct {
+	PublishedAt int64
+	Id          string
+}
+
+func handleLogsEnvironmentSearchGet(w http.ResponseWriter, r *http.Request) {
+	environment := getEnvironmentById(r.PathValue("environmentId"))
+	if environment == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	filter, err := parseLogFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var from, to int64
+	if r.URL.Query().Get("from") != "" {
+		fromTime, err := parseStatsTime(r.URL.Query().Get("from"))
+		if err != nil {
+			http.Error(w, "Invalid from, use RFC3339 or Unix seconds", http.StatusBadRequest)
+			return
+		}
+		from = fromTime.UnixMicro()
+	}
+	if r.URL.Query().Get("to") != "" {
+		toTime, err := parseStatsTime(r.URL.Query().Get("to"))
+		if err != nil {
+			http.Error(w, "Invalid to, use RFC3339 or Unix seconds", http.StatusBadRequest)
+			return
+		}
+		to = toTime.UnixMicro()
+	}
+
+	pageSize := defaultLogsPageSize
+	if r.URL.Query().Get("limit") != "" {
+		pageSize, err = strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || pageSize <= 0 || pageSize > maxLogsPageSize {
+			http.Error(w, "Invalid limit, it should be between 1 and "+strconv.Itoa(maxLogsPageSize), http.StatusBadRequest)
+			return
+		}
+	}
+
+	order := strings.ToLower(r.URL.Query().Get("order"))
+	if order == "" {
+		order = "desc"
+	}
+	if order != "asc" && order != "desc" {
+		http.Error(w, "Invalid order, use 'asc' or 'desc'", http.StatusBadRequest)
+		return
+	}
+
+	var cursor *logCursor
+	if r.URL.Query().Get("cursor") != "" {
+		cursor, err = decodeLogCursor(r.URL.Query().Get("cursor"))
+		if err != nil {
+			http.Error(w, "Invalid cursor, use NextCursor from the previous page", http.StatusBadRequest)
+			return
+		}
+	}
+
+	logsPage, err := searchLogs(environment.Id, filter, from, to, cursor, pageSize, order)
+	if err != nil {
+		//Most errors come from FTS5 query syntax, like unbalanced quotes or a trailing AND
+		if strings.Contains(err.Error(), "fts5") {
+			http.Error(w, "Invalid search query: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(logsPage)
+	if err != nil {
+		fmt.Println("Cannot convert LogsPage object into JSON:", err)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+// Parses ?deploymentId=&machineId=&imageId=&level=&maxLevel=&contains=&q=, level is a comma-separated list
+func parseLogFilter(r *http.Request) (LogFilter, error) {
+	filter := LogFilter{
+		DeploymentId: r.URL.Query().Get("deploymentId"),
+		MachineId:    r.URL.Query().Get("machineId"),
+		ImageId:      r.URL.Query().Get("imageId"),
+		Contains:     r.URL.Query().Get("contains"),
+		Query:        strings.TrimSpace(r.URL.Query().Get("q")),
+	}
+
+	if r.URL.Query().Get("level") != "" {
+		for _, level := range strings.Split(r.URL.Query().Get("level"), ",") {
+			priority, err := parseLogLevel(level)
+			if err != nil {
+				return filter, err
+			}
+			filter.Levels = append(filter.Levels, priority)
+		}
+	}
+
+	if r.URL.Query().Get("maxLevel") != "" {
+		priority, err := parseLogLevel(r.URL.Query().Get("maxLevel"))
+		if err != nil {
+			return filter, err
+		}
+		filter.MaxLevel = priority
+	}
+
+	return filter, nil
+}
+
+func parseLogLevel(level string) (string, error) {
+	level = strings.ToLower(strings.TrimSpace(level))
+
+	priority, err := strconv.Atoi(level)
+	if err == nil && priority >= 0 && priority <= 7 {
+		return strconv.Itoa(priority), nil
+	}
+
+	priority, isName := logLevelPriorities[level]
+	if !isName {
+		return "", errors.New("Invalid level '" + level + "', use a syslog priority from 0 to 7 or a name like error, warning or info")
+	}
+
+	return strconv.Itoa(priority), nil
+}
+
+// Adds filter conditions to a query on EnvLogs{environmentId} that already has a WHERE clause
+func appendLogFilterConditions(query string, arguments []interface{}, environmentId string, filter LogFilter) (string, []interface{}) {
+	if filter.DeploymentId != "" {
+		query += " AND DeploymentId = ?"
+		arguments = append(arguments, filter.DeploymentId)
+	}
+
+	if filter.MachineId != "" {
+		query += " AND MachineId = ?"
+		arguments = append(arguments, filter.MachineId)
+	}
+
+	if filter.ImageId != "" {
+		query += " AND ImageId = ?"
+		arguments = append(arguments, filter.ImageId)
+	}
+
+	if len(filter.Levels) > 0 {
+		query += " AND Level IN (?" + strings.Repeat(", ?", len(filter.Levels)-1) + ")"
+		for _, level := range filter.Levels {
+			arguments = append(arguments, level)
+		}
+	}
+
+	if filter.MaxLevel != "" {
+		//A text argument would be greater than any integer in SQLite, so the priority is passed as a number
+		maxPriority, _ := strconv.Atoi(filter.MaxLevel)
+		query += " AND Level != '' AND CAST(Level AS INTEGER) <= ?"
+		arguments = append(arguments, maxPriority)
+	}
+
+	if filter.Contains != "" {
+		query += " AND Message LIKE ? ESCAPE '\\'"
+		arguments = append(arguments, "%"+escapeLikePattern(filter.Contains)+"%")
+	}
+
+	if filter.Query != "" {
+		query += " AND rowid IN (SELECT rowid FROM EnvLogsSearch" + environmentId + " WHERE EnvLogsSearch" + environmentId + " MATCH ?)"
+		arguments = append(arguments, filter.Query)
+	}
+
+	return query, arguments
+}
+
+func escapeLikePattern(value string) string {
+	return strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(value)
+}
+
+// from and to are PublishedAt timestamps in microseconds, 0 means no limit. order is asc or desc
+func searchLogs(environmentId string, filter LogFilter, from int64, to int64, cursor *logCursor, pageSize int, order string) (LogsPage, error) {
+	query := "SELECT Id, Message, EnvironmentId, ImageId, MachineId, DeploymentId, Level, PublishedAt from EnvLogs" + environmentId + " WHERE 1 = 1"
+	query, arguments := appendLogFilterConditions(query, []interface{}{}, environmentId, filter)
+
+	if from > 0 {
+		query += " AND PublishedAt >= ?"
+		arguments = append(arguments, from)
+	}
+
+	if to > 0 {
+		query += " AND PublishedAt <= ?"
+		arguments = append(arguments, to)
+	}
+
+	if cursor != nil {
+		comparison := "<"
+		if order == "asc" {
+			comparison = ">"
+		}
+		query += " AND (PublishedAt " + comparison + " ? OR (PublishedAt = ? AND Id " + comparison + " ?))"
+		arguments = append(arguments, cursor.PublishedAt, cursor.PublishedAt, cursor.Id)
+	}
+
+	//One more log shows if there is a next page
+	query += " ORDER BY PublishedAt " + strings.ToUpper(order) + ", Id " + strings.ToUpper(order) + " LIMIT " + strconv.Itoa(pageSize+1)
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     query,
+			Arguments: arguments,
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot search logs in EnvLogs%s table: %s\n", environmentId, err.Error())
+		return LogsPage{}, err
+	}
+
+	logsPage := LogsPage{Logs: handleLogsQuery(rows, err)}
+	if len(logsPage.Logs) > pageSize {
+		logsPage.Logs = logsPage.Logs[:pageSize]
+		lastLog := logsPage.Logs[pageSize-1]
+		logsPage.NextCursor = encodeLogCursor(logCursor{PublishedAt: lastLog.PublishedAt, Id: lastLog.Id})
+	}
+
+	return logsPage, nil
+}
+
+func encodeLogCursor(cursor logCursor) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(cursor.PublishedAt, 10) + ":" + cursor.Id))
+}
+
+func decodeLogCursor(value string) (*logCursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	publishedAt, id, isFound := strings.Cut(string(decoded), ":")
+	if !isFound || id == "" {
+		return nil, errors.New("cursor should contain PublishedAt and Id")
+	}
+
+	cursor := logCursor{Id: id}
+	cursor.PublishedAt, err = strconv.ParseInt(publishedAt, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cursor, nil
+}
@@ -0,0 +1,176 @@
+/*
+Live logs of environments. GET /logs/environment/{environmentId}/stream sends new EnvironmentLog entries as Server-Sent Events.
+Logs are written by all machines, so the stream polls EnvLogs{environmentId}
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rqlite/gorqlite"
+)
+
+const logStreamPollInterval = time.Second
+const logStreamKeepAliveInterval = time.Second * 15
+const logStreamBatchSize = 500
+
+// Logs from other machines can be saved later than newer logs, so each poll looks back this many microseconds and skips logs that have been sent
+const logStreamOverlap = int64(10 * time.Second / time.Microsecond)
+
+// Sends one log to a client, the stream stops when it returns an error
+type logSender func(environmentLog EnvironmentLog) error
+
+func handleLogsEnvironmentStreamGet(w http.ResponseWriter, r *http.Request) {
+	environment := getEnvironmentById(r.PathValue("environmentId"))
+	if environment == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	filter, err := parseLogFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	//EventSource sends Last-Event-ID on reconnects, ?after= works for the first request
+	after := time.Now().UnixMicro()
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = r.URL.Query().Get("after")
+	}
+	if lastEventId != "" {
+		parsedAfter, err := strconv.ParseInt(lastEventId, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid Last-Event-ID, it should be a PublishedAt timestamp in microseconds", http.StatusBadRequest)
+			return
+		}
+		after = parsedAfter
+	}
+
+	streamLogsOverSSE(w, r, environment.Id, after, filter)
+}
+
+func streamLogsOverSSE(w http.ResponseWriter, r *http.Request, environmentId string, after int64, filter LogFilter) {
+	controller := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	err := controller.Flush()
+	if err != nil {
+		fmt.Println("Cannot stream logs, response cannot be flushed:", err)
+		return
+	}
+
+	send := func(environmentLog EnvironmentLog) error {
+		jsonBytes, err := json.Marshal(environmentLog)
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(w, "id: %d\nevent: log\ndata: %s\n\n", environmentLog.PublishedAt, jsonBytes)
+		if err != nil {
+			return err
+		}
+
+		return controller.Flush()
+	}
+
+	keepAlive := func() error {
+		_, err := fmt.Fprint(w, ": keep-alive\n\n")
+		if err != nil {
+			return err
+		}
+
+		return controller.Flush()
+	}
+
+	streamLogs(r.Context().Done(), environmentId, after, filter, send, keepAlive)
+}
+
+// Polls logs newer than after until done is closed or a client cannot receive logs anymore
+func streamLogs(done <-chan struct{}, environmentId string, after int64, filter LogFilter, send logSender, keepAlive func() error) {
+	cursor := after
+	sentLogs := map[string]int64{} //Log ID -> PublishedAt of logs sent during the overlap
+	isBatchFull := false
+
+	pollTicker := time.NewTicker(logStreamPollInterval)
+	defer pollTicker.Stop()
+	keepAliveTicker := time.NewTicker(logStreamKeepAliveInterval)
+	defer keepAliveTicker.Stop()
+
+	for {
+		if isBatchFull {
+			select {
+			case <-done:
+				return
+			default:
+			}
+		} else {
+			select {
+			case <-done:
+				return
+			case <-keepAliveTicker.C:
+				if keepAlive() != nil {
+					return
+				}
+				continue
+			case <-pollTicker.C:
+			}
+		}
+
+		//A full batch means there are more logs, they are loaded right away without looking back
+		from := max(after, cursor-logStreamOverlap)
+		if isBatchFull {
+			from = cursor
+		}
+
+		environmentLogs := getLogsForStream(environmentId, from, filter)
+		isBatchFull = len(environmentLogs) == logStreamBatchSize
+
+		for _, environmentLog := range environmentLogs {
+			if _, isSent := sentLogs[environmentLog.Id]; isSent || environmentLog.PublishedAt <= after {
+				continue
+			}
+
+			if send(environmentLog) != nil {
+				return
+			}
+
+			sentLogs[environmentLog.Id] = environmentLog.PublishedAt
+			cursor = max(cursor, environmentLog.PublishedAt)
+		}
+
+		for id, publishedAt := range sentLogs {
+			if publishedAt < cursor-logStreamOverlap {
+				delete(sentLogs, id)
+			}
+		}
+	}
+}
+
+func getLogsForStream(environmentId string, from int64, filter LogFilter) []EnvironmentLog {
+
+	query := "SELECT Id, Message, EnvironmentId, ImageId, MachineId, DeploymentId, Level, PublishedAt from EnvLogs" + environmentId + " WHERE PublishedAt >= ?"
+	arguments := []interface{}{from}
+
+	query, arguments = appendLogFilterConditions(query, arguments, environmentId, filter)
+	query += " ORDER BY PublishedAt ASC LIMIT " + strconv.Itoa(logStreamBatchSize)
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     query,
+			Arguments: arguments,
+		},
+	)
+
+	return handleLogsQuery(rows, err)
+}
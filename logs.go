@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/rqlite/gorqlite"
@@ -123,7 +122,7 @@ func saveEnvironmentLog(environmentLog EnvironmentLog) {
 		deployment := getDeploymentById(environmentLog.DeploymentId)
 		if deployment != nil {
 			environmentLog.EnvironmentId = deployment.EnvironmentId
-			environmentLog.DeploymentId = deployment.ImageId
+			environmentLog.ImageId = deployment.ImageId
 		}
 	}
 
@@ -169,9 +168,24 @@ func handleDockerLogs() {
 			var envLog EnvironmentLog
 			envLog.MachineId = thisMachine.Id
 
-			strArray := strings.Split(log.ContainerName, ".")
-			if len(strArray) > 0 {
-				envLog.DeploymentId = strArray[0]
+			//All replicas of a deployment write logs to the same environment
+			deploymentId, _, isDeployment := parseContainerName(log.ContainerName)
+			if !isDeployment {
+				return
+			}
+			envLog.DeploymentId = deploymentId
+
+			//The environment is taken from a cache, so log lines don't read Deployment and Environment tables
+			target := getLogTarget(deploymentId)
+			if target == nil {
+				return
+			}
+			envLog.EnvironmentId = target.EnvironmentId
+			envLog.ImageId = target.ImageId
+
+			//Chatty containers shouldn't fill the Raft log of all machines
+			if !allowEnvironmentLog(*target) {
+				return
 			}
 
 			timestamp, _ := strconv.ParseInt(log.Timestamp, 10, 64)
@@ -161,44 +161,11 @@ func handleMachineStatsGet(w http.ResponseWriter, r *http.Request) {
 	machines := getMachines()
 
 	for _, machine := range machines {
-
-		rows, err := connection.QueryOneParameterized(
-			gorqlite.ParameterizedStatement{
-				Query:     "SELECT * from Stats" + machine.Id + " ORDER BY CreatedAt DESC LIMIT 1",
-				Arguments: []interface{}{},
-			},
-		)
-
-		if err != nil {
-			fmt.Printf(" Cannot read from %s table: %s\n", "Stats"+machine.Id, err.Error())
-		}
-
-		rows.Next()
-
-		var Id string
-		var CPUUsage int64
-		var AvailableMemory int64
-		var TotalMemory int64
-		var AvailableDisk int64
-		var TotalDisk int64
-		var CreatedAt string
-
-		err = rows.Scan(&Id, &CPUUsage, &AvailableMemory, &TotalMemory, &AvailableDisk, &TotalDisk, &CreatedAt)
-		if err != nil {
-			fmt.Printf(" Cannot run Scan: %s\n", err.Error())
-		}
-		loadedStats := MachineStats{
-			Id:              Id,
-			MachineId:       machine.Id,
-			CPUUsage:        CPUUsage,
-			AvailableMemory: AvailableMemory,
-			TotalMemory:     TotalMemory,
-			AvailableDisk:   AvailableDisk,
-			TotalDisk:       TotalDisk,
-			CreatedAt:       CreatedAt,
+		loadedStats := getLastMachineStats(machine.Id)
+		if loadedStats == nil {
+			loadedStats = &MachineStats{MachineId: machine.Id}
 		}
-		stats = append(stats, loadedStats)
-
+		stats = append(stats, *loadedStats)
 	}
 
 	jsonBytes, err := json.Marshal(stats)
@@ -331,6 +298,22 @@ func getMachinesWithType(machineType string) []Machine {
 	return handleMachineQuery(rows, err)
 }
 
+func getMachineById(machineId string) *Machine {
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id, VPNIp, PublicIp, CloudPrivateIp, Name, Types, Status, Domains, JoinURL, PublicSSHKey from Machine WHERE Id = ?",
+			Arguments: []interface{}{machineId},
+		},
+	)
+
+	machines := handleMachineQuery(rows, err)
+	if len(machines) == 0 {
+		return nil
+	}
+
+	return &machines[0]
+}
+
 func getMachinesByVPNIp(vpnIp string) []Machine {
 	rows, err := connection.QueryOneParameterized(
 		gorqlite.ParameterizedStatement{
@@ -719,6 +702,22 @@ func createZipArchive(newMachine Machine, joinSecret string, homeDir string) {
 		fmt.Println("Cannot copy host.crt to the archive: ", err)
 	}
 
+	//Adding the secret key, new machines decrypt secret environment variables with it
+	secretKeyFile, err := os.Open(getSecretKeyPath())
+	if err != nil {
+		fmt.Println("Cannot open the secret key to add to an archive: ", err)
+	} else {
+		defer secretKeyFile.Close()
+
+		w1, err = zipWriter.Create("secret.key")
+		if err != nil {
+			fmt.Println("Cannot create records for secret.key in the archive: ", err)
+		}
+		if _, err := io.Copy(w1, secretKeyFile); err != nil {
+			fmt.Println("Cannot copy secret.key to the archive: ", err)
+		}
+	}
+
 	fmt.Println("Closing zip with join certificates")
 	zipWriter.Close()
 
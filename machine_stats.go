@@ -0,0 +1,160 @@
+/*
+History of machine stats. Raw samples of Stats{machineId} are compacted into hourly (StatsHourly{machineId}) and daily (StatsDaily{machineId}) aggregates,
+each machine rolls up and purges its own tables. GET /machine/{id}/stats reads the finest table that still covers the requested range
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rqlite/gorqlite"
+)
+
+const machineStatsRollupInterval = time.Minute * 10
+
+// Raw samples are written every 5 seconds, so they are kept for a short time only
+const rawMachineStatsRetention = time.Hour * 24
+const hourlyMachineStatsRetention = time.Hour * 24 * 30
+const dailyMachineStatsRetention = time.Hour * 24 * 365
+
+// Averages of hourly and daily aggregates are weighted by the number of raw samples
+const aggregatedMachineStatsColumns = "SUM(CPUUsage * Samples) / SUM(Samples), MAX(MaxCPUUsage), CAST(SUM(UsedMemory * Samples) / SUM(Samples) AS INTEGER), MAX(MaxUsedMemory), MAX(TotalMemory), " +
+	"CAST(SUM(UsedDisk * Samples) / SUM(Samples) AS INTEGER), MAX(MaxUsedDisk), MAX(TotalDisk), SUM(Samples)"
+
+// Stats of a machine aggregated to a bucket, memory is in MB and disk in bytes like in MachineStats
+type MachineStatsBucket struct {
+	Time          string
+	CPUUsage      float64
+	MaxCPUUsage   int64
+	UsedMemory    int64
+	MaxUsedMemory int64
+	TotalMemory   int64
+	UsedDisk      int64
+	MaxUsedDisk   int64
+	TotalDisk     int64
+	Samples       int64
+}
+
+func handleMachineStatsHistoryGet(w http.ResponseWriter, r *http.Request) {
+	//Machine ID is a part of table names, so only IDs of existing machines are accepted
+	machine := getMachineById(r.PathValue("id"))
+	if machine == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	statsRange, err := parseStatsRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(getMachineStatsBuckets(machine.Id, statsRange))
+	if err != nil {
+		fmt.Println("Cannot convert MachineStatsBucket object into JSON:", err)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+func startMachineStatsRollupWorker() {
+	for range time.Tick(machineStatsRollupInterval) {
+		rollupMachineStats()
+	}
+}
+
+// Aggregates complete hours and days, the bucket start is used as Id, so buckets that exist already are skipped
+func rollupMachineStats() {
+	now := time.Now().UTC()
+	currentHour := now.Truncate(time.Hour)
+	currentDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	rawTable := "Stats" + thisMachine.Id
+	hourlyTable := "StatsHourly" + thisMachine.Id
+	dailyTable := "StatsDaily" + thisMachine.Id
+
+	_, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query: "INSERT OR IGNORE INTO " + hourlyTable + " (Id, CPUUsage, MaxCPUUsage, UsedMemory, MaxUsedMemory, TotalMemory, UsedDisk, MaxUsedDisk, TotalDisk, Samples, CreatedAt) " +
+					"SELECT strftime('%Y-%m-%d %H:00:00', CreatedAt) AS Bucket, AVG(CPUUsage), MAX(CPUUsage), CAST(AVG(TotalMemory - AvailableMemory) AS INTEGER), MAX(TotalMemory - AvailableMemory), MAX(TotalMemory), " +
+					"CAST(AVG(TotalDisk - AvailableDisk) AS INTEGER), MAX(TotalDisk - AvailableDisk), MAX(TotalDisk), COUNT(*), strftime('%Y-%m-%d %H:00:00', CreatedAt) " +
+					"FROM " + rawTable + " WHERE CreatedAt < ? GROUP BY Bucket",
+				Arguments: []interface{}{currentHour.Format(sqliteTimeFormat)},
+			},
+			{
+				Query: "INSERT OR IGNORE INTO " + dailyTable + " (Id, CPUUsage, MaxCPUUsage, UsedMemory, MaxUsedMemory, TotalMemory, UsedDisk, MaxUsedDisk, TotalDisk, Samples, CreatedAt) " +
+					"SELECT strftime('%Y-%m-%d 00:00:00', CreatedAt) AS Bucket, " + aggregatedMachineStatsColumns + ", strftime('%Y-%m-%d 00:00:00', CreatedAt) " +
+					"FROM " + hourlyTable + " WHERE CreatedAt < ? GROUP BY Bucket",
+				Arguments: []interface{}{currentDay.Format(sqliteTimeFormat)},
+			},
+			{
+				Query:     "DELETE FROM " + rawTable + " WHERE CreatedAt < ?",
+				Arguments: []interface{}{now.Add(-rawMachineStatsRetention).Format(sqliteTimeFormat)},
+			},
+			{
+				Query:     "DELETE FROM " + hourlyTable + " WHERE CreatedAt < ?",
+				Arguments: []interface{}{now.Add(-hourlyMachineStatsRetention).Format(sqliteTimeFormat)},
+			},
+			{
+				Query:     "DELETE FROM " + dailyTable + " WHERE CreatedAt < ?",
+				Arguments: []interface{}{now.Add(-dailyMachineStatsRetention).Format(sqliteTimeFormat)},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot roll up machine stats: %s\n", err.Error())
+	}
+}
+
+// Buckets of statsRange.Step seconds, raw samples are used while they cover statsRange.From, then hourly and daily aggregates
+func getMachineStatsBuckets(machineId string, statsRange StatsRange) []MachineStatsBucket {
+	now := time.Now().UTC()
+	bucket := "datetime((CAST(strftime('%s', CreatedAt) AS INTEGER) / ?) * ?, 'unixepoch') AS Bucket"
+
+	var query string
+	switch {
+	case !statsRange.From.Before(now.Add(-rawMachineStatsRetention)):
+		query = "SELECT " + bucket + ", AVG(CPUUsage), MAX(CPUUsage), CAST(AVG(TotalMemory - AvailableMemory) AS INTEGER), MAX(TotalMemory - AvailableMemory), MAX(TotalMemory), " +
+			"CAST(AVG(TotalDisk - AvailableDisk) AS INTEGER), MAX(TotalDisk - AvailableDisk), MAX(TotalDisk), COUNT(*) FROM Stats" + machineId
+	case !statsRange.From.Before(now.Add(-hourlyMachineStatsRetention)):
+		query = "SELECT " + bucket + ", " + aggregatedMachineStatsColumns + " FROM StatsHourly" + machineId
+	default:
+		query = "SELECT " + bucket + ", " + aggregatedMachineStatsColumns + " FROM StatsDaily" + machineId
+	}
+
+	query += " WHERE CreatedAt >= ? AND CreatedAt < ? GROUP BY Bucket ORDER BY Bucket"
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     query,
+			Arguments: []interface{}{statsRange.Step, statsRange.Step, statsRange.From.Format(sqliteTimeFormat), statsRange.To.Format(sqliteTimeFormat)},
+		},
+	)
+
+	var buckets = []MachineStatsBucket{}
+
+	if err != nil {
+		fmt.Printf(" Cannot read stats of machine %s: %s\n", machineId, err.Error())
+		return buckets
+	}
+
+	for rows.Next() {
+		var loadedBucket MachineStatsBucket
+
+		err := rows.Scan(&loadedBucket.Time, &loadedBucket.CPUUsage, &loadedBucket.MaxCPUUsage, &loadedBucket.UsedMemory, &loadedBucket.MaxUsedMemory, &loadedBucket.TotalMemory, &loadedBucket.UsedDisk, &loadedBucket.MaxUsedDisk, &loadedBucket.TotalDisk, &loadedBucket.Samples)
+		if err != nil {
+			fmt.Printf(" Cannot run Scan: %s\n", err.Error())
+		}
+
+		buckets = append(buckets, loadedBucket)
+	}
+
+	return buckets
+}
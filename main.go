@@ -27,7 +27,13 @@ func use(r *http.ServeMux, middlewares ...func(next http.Handler) http.Handler)
 
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("New request: %s %s", r.Method, r.URL.String())
+		//loggingMiddleware runs before authMiddleware, so API tokens from ?access_token= are redacted here
+		requestURL := *r.URL
+		if query := requestURL.Query(); query.Has("access_token") {
+			query.Set("access_token", "redacted")
+			requestURL.RawQuery = query.Encode()
+		}
+		log.Printf("New request: %s %s", r.Method, requestURL.String())
 		next.ServeHTTP(w, r)
 	})
 }
@@ -39,7 +45,7 @@ func CORSMiddleware(next http.Handler) http.Handler {
 		if slices.Contains(allowedOrigins, origin) {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
 			w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "*")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
 		}
 		next.ServeHTTP(w, r)
 
@@ -54,6 +60,7 @@ func main() {
 	loadInfoFromVPNCert()
 	databaseInit()
 	loadMachineInfo()
+	loadSecretKey()
 
 	registryEnv, isRegistryEnvExists := os.LookupEnv("TURBOCLOUD_CONTAINER_REGISTRY")
 	if isRegistryEnvExists {
@@ -75,6 +82,7 @@ func main() {
 	mux.HandleFunc("POST /service", handleServicePost)
 	mux.HandleFunc("GET /service", handleServiceGet)
 	mux.HandleFunc("DELETE /service/{id}", handleServiceDelete)
+	mux.HandleFunc("POST /service/{id}/webhook-secret", handleServiceWebhookSecretPost)
 
 	//Environment routes
 	mux.HandleFunc("POST /environment", handleEnvironmentPost)
@@ -82,6 +90,21 @@ func main() {
 	mux.HandleFunc("PUT /environment", handleEnvironmentByServiceIdPut)
 	mux.HandleFunc("DELETE /environment/{id}", handleEnvironmentDelete)
 	mux.HandleFunc("GET /environment/{environmentId}/deployments", handleEnvironmentDeploymentsGet)
+	mux.HandleFunc("POST /environment/{id}/rollback/{deploymentId}", handleEnvironmentRollbackPost)
+	mux.HandleFunc("POST /environment/{id}/placement", handleEnvironmentPlacementPost)
+	mux.HandleFunc("GET /environment/{environmentId}/stats", handleEnvironmentStatsGet)
+
+	//Environment variables
+	mux.HandleFunc("POST /environment/{environmentId}/env-var", handleEnvVarPost)
+	mux.HandleFunc("GET /environment/{environmentId}/env-var", handleEnvVarGet)
+	mux.HandleFunc("PUT /env-var/{id}", handleEnvVarPut)
+	mux.HandleFunc("DELETE /env-var/{id}", handleEnvVarDelete)
+
+	//Volume routes
+	mux.HandleFunc("POST /environment/{environmentId}/volume", handleVolumePost)
+	mux.HandleFunc("GET /environment/{environmentId}/volume", handleEnvironmentVolumeGet)
+	mux.HandleFunc("GET /volume", handleVolumeGet)
+	mux.HandleFunc("DELETE /volume/{id}", handleVolumeDelete)
 
 	//Deployment routes
 	mux.HandleFunc("GET /deploy/environment/{environmentId}", handleEnvironmentDeploymentGet)
@@ -94,17 +117,50 @@ func main() {
 	mux.HandleFunc("GET /join/{machineId}/{secret}", handleJoinGet)
 	mux.HandleFunc("GET /public-ssh-keys", handlePublicSSHKeysGet)
 	mux.HandleFunc("GET /machine/stats", handleMachineStatsGet)
+	mux.HandleFunc("GET /machine/{id}/stats", handleMachineStatsHistoryGet)
 	mux.HandleFunc("DELETE /machine/{id}", handleMachineDelete)
 
 	//Database routes
 	mux.HandleFunc("POST /database", handleDatabasePost)
 	mux.HandleFunc("GET /database", handleDatabaseGet)
+	mux.HandleFunc("GET /database/template", handleDatabaseTemplateGet)
 	mux.HandleFunc("DELETE /database/{id}", handleDatabaseDelete)
 
+	//Backup routes
+	mux.HandleFunc("PUT /database/{id}/backup-config", handleBackupConfigPut)
+	mux.HandleFunc("GET /database/{id}/backup-config", handleBackupConfigGet)
+	mux.HandleFunc("DELETE /database/{id}/backup-config", handleBackupConfigDelete)
+	mux.HandleFunc("POST /database/{id}/backup", handleDatabaseBackupPost)
+	mux.HandleFunc("GET /database/{id}/backup", handleDatabaseBackupGet)
+	mux.HandleFunc("GET /database/{id}/restore", handleDatabaseRestoreGet)
+	mux.HandleFunc("POST /backup/{id}/restore", handleBackupRestorePost)
+	mux.HandleFunc("GET /backup/{id}/file/{secret}", handleBackupFileGet)
+
 	//Logs
 	mux.HandleFunc("GET /logs/environment/{environmentId}/{before_after}/{timestamp}", handleLogsEnvironmentGet)
-
-	wrapped := use(mux, loggingMiddleware, CORSMiddleware)
+	mux.HandleFunc("GET /logs/environment/{environmentId}/stream", handleLogsEnvironmentStreamGet)
+	mux.HandleFunc("GET /logs/environment/{environmentId}", handleLogsEnvironmentSearchGet)
+
+	//Alerts
+	mux.HandleFunc("POST /alert-channel", handleAlertChannelPost)
+	mux.HandleFunc("GET /alert-channel", handleAlertChannelGet)
+	mux.HandleFunc("DELETE /alert-channel/{id}", handleAlertChannelDelete)
+	mux.HandleFunc("POST /alert-channel/{id}/test", handleAlertChannelTestPost)
+	mux.HandleFunc("POST /alert-rule", handleAlertRulePost)
+	mux.HandleFunc("GET /alert-rule", handleAlertRuleGet)
+	mux.HandleFunc("DELETE /alert-rule/{id}", handleAlertRuleDelete)
+	mux.HandleFunc("GET /alert", handleAlertGet)
+
+	//Prometheus metrics
+	mux.HandleFunc("GET /metrics", handleMetricsGet)
+
+	//API token routes
+	mux.HandleFunc("POST /token", handleApiTokenPost)
+	mux.HandleFunc("GET /token", handleApiTokenGet)
+	mux.HandleFunc("DELETE /token/{id}", handleApiTokenDelete)
+
+	//authMiddleware goes first so CORS headers are set on 401 responses as well, metricsMiddleware goes last to count all requests
+	wrapped := use(mux, authMiddleware, loggingMiddleware, CORSMiddleware, metricsMiddleware)
 
 	port_env, is_port_env_exists := os.LookupEnv("TURBOCLOUD_AGENT_PORT")
 	if is_port_env_exists {
@@ -114,15 +170,29 @@ func main() {
 	}
 
 	go startDeploymentCheckerWorker()
+	go startDatabaseCheckerWorker()
+	go startBackupWorker()
+
+	//Caddy sends access logs to the agent on balancers, the listener should be started before Caddy config is generated
+	if slices.Contains(thisMachine.Types, MachineTypeBalancer) {
+		startAccessLogListener()
+	}
 
 	reloadProxyServer()
 	go startProxyCheckerWorker()
 
 	go loadMachineStats()
+	go startMachineStatsRollupWorker()
 	go pingMachines()
+	go startFailoverReconciler()
+	go startContainerStatsWorker()
+	go startAutoscaler()
+	go startAlertEvaluator()
+	go startLogCompactor()
 
 	go startContainerJobsCheckerWorker()
 	go startImageJobsCheckerWorker()
+	go startVolumeJobsCheckerWorker()
 
 	go handleDockerLogs()
 
@@ -0,0 +1,345 @@
+/*
+Prometheus metrics in the text exposition format. Machine, deployment, build and job metrics are read from DB on each scrape,
+so they are the same on every agent and scraping one lighthouse is enough. HTTP and rqlite write metrics are collected in memory by each agent
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rqlite/gorqlite"
+)
+
+// Upper bounds of histogram buckets in seconds
+var httpDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+var dbWriteDurationBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+type histogram struct {
+	Buckets []float64
+	Counts  []int64 //Cumulative counts for each bucket
+	Sum     float64
+	Count   int64
+}
+
+type metricsRegistry struct {
+	mutex                sync.Mutex
+	httpRequests         map[string]int64      //Labels -> number of requests
+	httpRequestDurations map[string]*histogram //Labels -> durations
+	dbWriteDuration      *histogram
+	dbWriteErrors        int64
+	droppedLogs          map[string]int64 //Environment ID -> log lines dropped by rate limits
+}
+
+var metrics = metricsRegistry{
+	httpRequests:         map[string]int64{},
+	httpRequestDurations: map[string]*histogram{},
+	dbWriteDuration:      newHistogram(dbWriteDurationBuckets),
+	droppedLogs:          map[string]int64{},
+}
+
+// Keeps the response status for metricsMiddleware
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush is used by streaming responses
+func (w *statusResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Used by http.ResponseController to reach the original writer
+func (w *statusResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{Buckets: buckets, Counts: make([]int64, len(buckets))}
+}
+
+func (h *histogram) observe(value float64) {
+	for index, bucket := range h.Buckets {
+		if value <= bucket {
+			h.Counts[index]++
+		}
+	}
+	h.Sum += value
+	h.Count++
+}
+
+// Requests are labeled with the route pattern instead of the path, so IDs in paths don't create new series
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		writer := &statusResponseWriter{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(writer, r)
+
+		//Patterns are "METHOD /path", the method is a separate label
+		route := r.Pattern
+		if _, path, hasMethod := strings.Cut(route, " "); hasMethod {
+			route = path
+		}
+		if route == "" {
+			route = "unmatched"
+		}
+		labels := formatMetricLabels("method", r.Method, "route", route)
+
+		metrics.mutex.Lock()
+		defer metrics.mutex.Unlock()
+
+		metrics.httpRequests[formatMetricLabels("method", r.Method, "route", route, "status", strconv.Itoa(writer.status))]++
+		if metrics.httpRequestDurations[labels] == nil {
+			metrics.httpRequestDurations[labels] = newHistogram(httpDurationBuckets)
+		}
+		metrics.httpRequestDurations[labels].observe(time.Since(start).Seconds())
+	})
+}
+
+func observeDBWrite(duration time.Duration, err error) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	metrics.dbWriteDuration.observe(duration.Seconds())
+	if err != nil {
+		metrics.dbWriteErrors++
+	}
+}
+
+func observeDroppedLogs(environmentId string) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	metrics.droppedLogs[environmentId]++
+}
+
+func handleMetricsGet(w http.ResponseWriter, r *http.Request) {
+	var builder strings.Builder
+
+	writeMachineMetrics(&builder)
+	writeDeploymentMetrics(&builder)
+	writeJobMetrics(&builder)
+	writeAgentMetrics(&builder)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprint(w, builder.String())
+}
+
+func writeMachineMetrics(builder *strings.Builder) {
+	machines := getMachines()
+
+	writeMetricHeader(builder, "turbocloud_machine_up", "gauge", "1 if the machine is online, 0 otherwise")
+	for _, machine := range machines {
+		up := 0.0
+		if machine.Status == MachineStatusOnline {
+			up = 1
+		}
+		writeMetric(builder, "turbocloud_machine_up", formatMetricLabels("machine_id", machine.Id, "machine_name", machine.Name, "status", machine.Status), up)
+	}
+
+	machineStats := map[string]*MachineStats{}
+	for _, machine := range machines {
+		machineStats[machine.Id] = getLastMachineStats(machine.Id)
+	}
+
+	gauges := []struct {
+		name  string
+		help  string
+		value func(stats *MachineStats) float64
+	}{
+		{"turbocloud_machine_cpu_usage_percent", "CPU usage from the last machine stats", func(stats *MachineStats) float64 { return float64(stats.CPUUsage) }},
+		{"turbocloud_machine_memory_available_bytes", "Available memory from the last machine stats", func(stats *MachineStats) float64 { return float64(stats.AvailableMemory) * 1024 * 1024 }},
+		{"turbocloud_machine_memory_total_bytes", "Total memory from the last machine stats", func(stats *MachineStats) float64 { return float64(stats.TotalMemory) * 1024 * 1024 }},
+		{"turbocloud_machine_disk_available_bytes", "Available disk space from the last machine stats", func(stats *MachineStats) float64 { return float64(stats.AvailableDisk) }},
+		{"turbocloud_machine_disk_total_bytes", "Total disk space from the last machine stats", func(stats *MachineStats) float64 { return float64(stats.TotalDisk) }},
+	}
+
+	for _, gauge := range gauges {
+		writeMetricHeader(builder, gauge.name, "gauge", gauge.help)
+		for _, machine := range machines {
+			if machineStats[machine.Id] != nil {
+				writeMetric(builder, gauge.name, formatMetricLabels("machine_id", machine.Id, "machine_name", machine.Name), gauge.value(machineStats[machine.Id]))
+			}
+		}
+	}
+}
+
+// Durations are counted from CreatedAt to the last status change of finished and failed deployments and images
+func writeDeploymentMetrics(builder *strings.Builder) {
+	tables := []struct {
+		table         string
+		metric        string
+		help          string
+		finalStatuses []string
+	}{
+		{"Deployment", "turbocloud_deployments", "deployments", []string{DeploymentStatusFinished, DeploymentStatusFailed}},
+		{"Image", "turbocloud_builds", "image builds", []string{ImageStatusReady, ImageStatusError}},
+	}
+
+	for _, table := range tables {
+		rows, err := connection.QueryOneParameterized(
+			gorqlite.ParameterizedStatement{
+				Query:     "SELECT Status, COUNT(*), SUM(CASE WHEN UpdatedAt != '' THEN strftime('%s', UpdatedAt) - strftime('%s', CreatedAt) ELSE 0 END), SUM(CASE WHEN UpdatedAt != '' THEN 1 ELSE 0 END) from " + table.table + " GROUP BY Status",
+				Arguments: []interface{}{},
+			},
+		)
+
+		if err != nil {
+			fmt.Printf(" Cannot read from %s table: %s\n", table.table, err.Error())
+			continue
+		}
+
+		counts := map[string]float64{}
+		durationSums := map[string]float64{}
+		durationCounts := map[string]float64{}
+		for rows.Next() {
+			var status string
+			var count, durationSum, durationCount int64
+			err := rows.Scan(&status, &count, &durationSum, &durationCount)
+			if err != nil {
+				fmt.Printf(" Cannot run Scan: %s\n", err.Error())
+				continue
+			}
+			counts[status] = float64(count)
+			durationSums[status] = float64(durationSum)
+			durationCounts[status] = float64(durationCount)
+		}
+
+		writeMetricHeader(builder, table.metric+"_total", "counter", "Number of "+table.help+" by status")
+		for _, status := range sortedMetricKeys(counts) {
+			writeMetric(builder, table.metric+"_total", formatMetricLabels("status", status), counts[status])
+		}
+
+		writeMetricHeader(builder, table.metric+"_duration_seconds", "summary", "Duration of finished and failed "+table.help)
+		for _, status := range table.finalStatuses {
+			writeMetric(builder, table.metric+"_duration_seconds_sum", formatMetricLabels("status", status), durationSums[status])
+			writeMetric(builder, table.metric+"_duration_seconds_count", formatMetricLabels("status", status), durationCounts[status])
+		}
+	}
+}
+
+func writeJobMetrics(builder *strings.Builder) {
+	writeMetricHeader(builder, "turbocloud_jobs", "gauge", "Number of jobs by type and status")
+
+	for _, table := range []string{"DeploymentJob", "ContainerJob", "ImageJob"} {
+		rows, err := connection.QueryOneParameterized(
+			gorqlite.ParameterizedStatement{
+				Query:     "SELECT Status, COUNT(*) from " + table + " GROUP BY Status ORDER BY Status",
+				Arguments: []interface{}{},
+			},
+		)
+
+		if err != nil {
+			fmt.Printf(" Cannot read from %s table: %s\n", table, err.Error())
+			continue
+		}
+
+		for rows.Next() {
+			var status string
+			var count int64
+			err := rows.Scan(&status, &count)
+			if err != nil {
+				fmt.Printf(" Cannot run Scan: %s\n", err.Error())
+				continue
+			}
+			writeMetric(builder, "turbocloud_jobs", formatMetricLabels("type", table, "status", status), float64(count))
+		}
+	}
+}
+
+func writeAgentMetrics(builder *strings.Builder) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	writeMetricHeader(builder, "turbocloud_http_requests_total", "counter", "HTTP requests handled by this agent")
+	for _, labels := range sortedMetricKeys(metrics.httpRequests) {
+		writeMetric(builder, "turbocloud_http_requests_total", labels, float64(metrics.httpRequests[labels]))
+	}
+
+	writeMetricHeader(builder, "turbocloud_http_request_duration_seconds", "histogram", "Duration of HTTP requests handled by this agent")
+	for _, labels := range sortedMetricKeys(metrics.httpRequestDurations) {
+		writeHistogram(builder, "turbocloud_http_request_duration_seconds", labels, metrics.httpRequestDurations[labels])
+	}
+
+	writeMetricHeader(builder, "turbocloud_rqlite_write_duration_seconds", "histogram", "Duration of rqlite writes made by this agent")
+	writeHistogram(builder, "turbocloud_rqlite_write_duration_seconds", "", metrics.dbWriteDuration)
+
+	writeMetricHeader(builder, "turbocloud_rqlite_write_errors_total", "counter", "Failed rqlite writes made by this agent")
+	writeMetric(builder, "turbocloud_rqlite_write_errors_total", "", float64(metrics.dbWriteErrors))
+
+	writeMetricHeader(builder, "turbocloud_logs_dropped_total", "counter", "Container log lines dropped by LogRateLimit on this agent")
+	for _, environmentId := range sortedMetricKeys(metrics.droppedLogs) {
+		writeMetric(builder, "turbocloud_logs_dropped_total", formatMetricLabels("environment_id", environmentId), float64(metrics.droppedLogs[environmentId]))
+	}
+}
+
+func writeMetricHeader(builder *strings.Builder, name string, metricType string, help string) {
+	builder.WriteString("# HELP " + name + " " + help + "\n")
+	builder.WriteString("# TYPE " + name + " " + metricType + "\n")
+}
+
+func writeMetric(builder *strings.Builder, name string, labels string, value float64) {
+	builder.WriteString(name)
+	if labels != "" {
+		builder.WriteString("{" + labels + "}")
+	}
+	builder.WriteString(" " + formatMetricValue(value) + "\n")
+}
+
+func writeHistogram(builder *strings.Builder, name string, labels string, h *histogram) {
+	separator := ""
+	if labels != "" {
+		separator = ","
+	}
+
+	for index, bucket := range h.Buckets {
+		writeMetric(builder, name+"_bucket", labels+separator+formatMetricLabels("le", formatMetricValue(bucket)), float64(h.Counts[index]))
+	}
+	writeMetric(builder, name+"_bucket", labels+separator+formatMetricLabels("le", "+Inf"), float64(h.Count))
+	writeMetric(builder, name+"_sum", labels, h.Sum)
+	writeMetric(builder, name+"_count", labels, float64(h.Count))
+}
+
+// Pairs of label names and values -> name1="value1",name2="value2"
+func formatMetricLabels(namesAndValues ...string) string {
+	labels := []string{}
+	for index := 0; index+1 < len(namesAndValues); index += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(namesAndValues[index+1])
+		labels = append(labels, namesAndValues[index]+`="`+value+`"`)
+	}
+
+	return strings.Join(labels, ",")
+}
+
+func formatMetricValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedMetricKeys[V any](values map[string]V) []string {
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -26,8 +26,9 @@ type Proxy struct {
 }
 
 type CaddyRecord struct {
-	ReverseProxy string
-	Domain       string
+	ReverseProxy     string
+	Domain           string
+	AccessLogAddress string //Caddy sends access logs to the agent to count request rates, empty if the agent doesn't listen
 }
 
 func handleProxyPost(w http.ResponseWriter, r *http.Request) {
@@ -165,6 +166,9 @@ func reloadProxyServer() {
 			var caddyRecord CaddyRecord
 			caddyRecord.Domain = proxy.Domain
 			caddyRecord.ReverseProxy = proxy.ServerPrivateIP + ":" + proxy.Port
+			if isAccessLogListening.Load() {
+				caddyRecord.AccessLogAddress = accessLogAddress
+			}
 			caddyRecords = append(caddyRecords, caddyRecord)
 		} else {
 			caddyRecords[idx].ReverseProxy += " " + proxy.ServerPrivateIP + ":" + proxy.Port
@@ -187,6 +191,12 @@ func reloadProxyServer() {
         }
 
     reverse_proxy * {{.ReverseProxy}}
+{{ if .AccessLogAddress }}
+    log {
+        output net {{.AccessLogAddress}}
+        format json
+    }
+{{ end }}
 }
 
 {{ end }}
@@ -321,12 +331,12 @@ func getAllProxies() []Proxy {
 	return proxies
 }
 
-func deleteProxiesIfDeploymentIdNotEqual(environmentId string, deploymentId string) (result bool) {
+func deleteProxiesIfDeploymentIdNotEqual(environmentId string, deploymentId string, serverPrivateIP string) (result bool) {
 
 	_, err := connection.WriteParameterized(
 		[]gorqlite.ParameterizedStatement{{
-			Query:     "DELETE FROM Proxy WHERE EnvironmentId = ? AND DeploymentId != ?",
-			Arguments: []interface{}{environmentId, deploymentId},
+			Query:     "DELETE FROM Proxy WHERE EnvironmentId = ? AND DeploymentId != ? AND ServerPrivateIP = ?",
+			Arguments: []interface{}{environmentId, deploymentId, serverPrivateIP},
 		},
 		},
 	)
@@ -338,6 +348,37 @@ func deleteProxiesIfDeploymentIdNotEqual(environmentId string, deploymentId stri
 
 	return true
 }
+
+func deleteProxiesByContainerId(containerId string, serverPrivateIP string) (result bool) {
+	_, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "DELETE FROM Proxy WHERE ContainerId = ? AND ServerPrivateIP = ?",
+				Arguments: []interface{}{containerId, serverPrivateIP},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot delete records from Proxy table by ContainerId: %s\n", err.Error())
+		return false
+	}
+
+	return true
+}
+
+// Removes proxies of an environment that point to machines it doesn't run on anymore
+func deleteProxiesIfServerPrivateIPNotIn(environmentId string, serverPrivateIPs []string) {
+	for _, proxy := range getAllProxies() {
+		if proxy.EnvironmentId == environmentId && !slices.Contains(serverPrivateIPs, proxy.ServerPrivateIP) {
+			deleteProxy(proxy.Id)
+		}
+	}
+}
+
+// Caddy reloads its config every 2 seconds, containers are stopped only after their proxies have been deleted for this long
+const proxyDrainPeriod = time.Second * 5
+
 func startProxyCheckerWorker() {
 	//We get proxy from DB with timestamp > timestamp_of_last_check
 	//If there are some new proxies - call reloadProxy()
@@ -0,0 +1,193 @@
+/*
+Request rates of environments. Caddy on the balancer sends JSON access logs to the agent over a local TCP connection,
+the agent counts requests per domain and saves them to RequestStats for each environment
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rqlite/gorqlite"
+)
+
+const accessLogAddress = "127.0.0.1:5446"
+const requestStatsInterval = time.Second * 30
+const requestStatsRetention = "-1 day"
+
+// Caddy configs reference the access log listener only after it has been started, otherwise Caddy cannot load a config
+var isAccessLogListening atomic.Bool
+
+var requestCounts = map[string]int64{}
+var requestCountsMutex sync.Mutex
+
+type RequestStats struct {
+	Id            string
+	EnvironmentId string
+	Requests      int64
+	Seconds       int64 //Length of the interval the requests have been counted in
+	CreatedAt     string
+}
+
+type CaddyAccessLog struct {
+	Request struct {
+		Host string `json:"host"`
+	} `json:"request"`
+}
+
+func startAccessLogListener() {
+	listener, err := net.Listen("tcp", accessLogAddress)
+	if err != nil {
+		fmt.Println("Cannot start access log listener, request rates won't be collected:", err)
+		return
+	}
+
+	isAccessLogListening.Store(true)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				fmt.Println("Cannot accept access log connection:", err)
+				continue
+			}
+			go readAccessLogs(conn)
+		}
+	}()
+
+	go startRequestStatsWorker()
+}
+
+func readAccessLogs(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		accessLog := CaddyAccessLog{}
+		if json.Unmarshal(scanner.Bytes(), &accessLog) != nil || accessLog.Request.Host == "" {
+			continue
+		}
+
+		host, _, isFound := strings.Cut(accessLog.Request.Host, ":")
+		if !isFound {
+			host = accessLog.Request.Host
+		}
+
+		requestCountsMutex.Lock()
+		requestCounts[strings.ToLower(host)]++
+		requestCountsMutex.Unlock()
+	}
+}
+
+func startRequestStatsWorker() {
+	lastSavedAt := time.Now()
+
+	for range time.Tick(requestStatsInterval) {
+		requestCountsMutex.Lock()
+		counts := requestCounts
+		requestCounts = map[string]int64{}
+		requestCountsMutex.Unlock()
+
+		seconds := int64(time.Since(lastSavedAt).Seconds())
+		lastSavedAt = time.Now()
+
+		//Environments with proxies get a row even without requests, so their rate goes down to 0
+		environmentIds := map[string]bool{}
+		for _, proxy := range getAllProxies() {
+			environmentIds[proxy.EnvironmentId] = true
+		}
+
+		for _, environment := range getEnvironments() {
+			if !environmentIds[environment.Id] {
+				continue
+			}
+
+			var requests int64
+			for _, domain := range environment.Domains {
+				requests += counts[strings.ToLower(domain)]
+			}
+			addRequestStats(&RequestStats{EnvironmentId: environment.Id, Requests: requests, Seconds: seconds})
+		}
+
+		deleteOldRequestStats()
+	}
+}
+
+/*Database*/
+
+func addRequestStats(stats *RequestStats) {
+	id, err := NanoId(7)
+	if err != nil {
+		fmt.Println("Cannot generate new NanoId for RequestStats:", err)
+		return
+	}
+
+	stats.Id = id
+
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "INSERT INTO RequestStats( Id, EnvironmentId, Requests, Seconds) VALUES(?, ?, ?, ?)",
+				Arguments: []interface{}{stats.Id, stats.EnvironmentId, stats.Requests, stats.Seconds},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot write to RequestStats table: %s\n", err.Error())
+	}
+}
+
+func deleteOldRequestStats() {
+	_, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "DELETE FROM RequestStats WHERE CreatedAt < datetime('now', ?)",
+				Arguments: []interface{}{requestStatsRetention},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot delete records from RequestStats table: %s\n", err.Error())
+	}
+}
+
+// Requests per second of an environment during the last seconds, 0 if there are no stats
+func getRecentRequestRate(environmentId string, seconds int) float64 {
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT SUM(Requests), SUM(Seconds) from RequestStats WHERE EnvironmentId = ? AND CreatedAt >= datetime('now', ?)",
+			Arguments: []interface{}{environmentId, "-" + strconv.Itoa(seconds) + " seconds"},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot read from RequestStats table: %s\n", err.Error())
+		return 0
+	}
+
+	var requests int64
+	var totalSeconds int64
+	if rows.Next() {
+		err = rows.Scan(&requests, &totalSeconds)
+		if err != nil {
+			fmt.Printf(" Cannot run Scan: %s\n", err.Error())
+		}
+	}
+
+	if totalSeconds == 0 {
+		return 0
+	}
+
+	return float64(requests) / float64(totalSeconds)
+}
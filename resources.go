@@ -0,0 +1,121 @@
+/*
+CPU and memory limits of containers. Environments and databases pass them to docker run, deployments check free memory of machines before scheduling
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/rqlite/gorqlite"
+)
+
+// Docker doesn't start containers with less memory
+const minMemoryLimit = 6
+
+type ResourceLimits struct {
+	CPULimit          float64 //Number of CPUs, for example 0.5, 0 means no limit
+	MemoryLimit       int64   //MB, a container is killed if it uses more, 0 means no limit
+	CPUReservation    float64 //Share of CPUs a container gets when CPUs are busy, 1 equals one CPU, 0 means the default share
+	MemoryReservation int64   //MB, a soft limit used when a machine is low on memory and for placement
+}
+
+func validateResourceLimits(limits ResourceLimits) error {
+	if limits.CPULimit < 0 || limits.CPUReservation < 0 || limits.MemoryLimit < 0 || limits.MemoryReservation < 0 {
+		return errors.New("CPU and memory limits cannot be negative")
+	}
+
+	if limits.MemoryLimit > 0 && limits.MemoryLimit < minMemoryLimit {
+		return errors.New("MemoryLimit should be at least " + strconv.Itoa(minMemoryLimit) + " MB")
+	}
+
+	if limits.MemoryLimit > 0 && limits.MemoryReservation > limits.MemoryLimit {
+		return errors.New("MemoryReservation cannot be greater than MemoryLimit")
+	}
+
+	if limits.CPULimit > 0 && limits.CPUReservation > limits.CPULimit {
+		return errors.New("CPUReservation cannot be greater than CPULimit")
+	}
+
+	return nil
+}
+
+// Returns arguments for docker run, for example " --cpus=0.5 --memory=512m"
+func getResourceLimitsArgs(limits ResourceLimits) string {
+	args := ""
+
+	if limits.CPULimit > 0 {
+		args += " --cpus=" + strconv.FormatFloat(limits.CPULimit, 'f', -1, 64)
+	}
+
+	if limits.CPUReservation > 0 {
+		//Docker has no CPU reservations, a relative weight is the closest option (1024 is the weight of one CPU)
+		args += " --cpu-shares=" + strconv.Itoa(max(int(limits.CPUReservation*1024), 2))
+	}
+
+	if limits.MemoryLimit > 0 {
+		args += " --memory=" + strconv.FormatInt(limits.MemoryLimit, 10) + "m"
+	}
+
+	if limits.MemoryReservation > 0 {
+		args += " --memory-reservation=" + strconv.FormatInt(limits.MemoryReservation, 10) + "m"
+	}
+
+	return args
+}
+
+// Memory in MB a container needs on a machine, a reservation is used if it's set, 0 if there are no limits
+func getRequiredMemory(limits ResourceLimits) int64 {
+	if limits.MemoryReservation > 0 {
+		return limits.MemoryReservation
+	}
+
+	return limits.MemoryLimit
+}
+
+// Returns an error if the last stats of a machine show less available memory than required, machines without stats are not checked
+func checkMachineMemory(machineId string, requiredMemory int64) error {
+	if requiredMemory <= 0 {
+		return nil
+	}
+
+	stats := getLastMachineStats(machineId)
+	if stats == nil {
+		return nil
+	}
+
+	if stats.AvailableMemory < requiredMemory {
+		return fmt.Errorf("not enough memory on machine %s: %d MB required, %d MB available", machineId, requiredMemory, stats.AvailableMemory)
+	}
+
+	return nil
+}
+
+func getLastMachineStats(machineId string) *MachineStats {
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id, CPUUsage, AvailableMemory, TotalMemory, AvailableDisk, TotalDisk, CreatedAt from Stats" + machineId + " ORDER BY CreatedAt DESC LIMIT 1",
+			Arguments: []interface{}{},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot read from %s table: %s\n", "Stats"+machineId, err.Error())
+		return nil
+	}
+
+	if !rows.Next() {
+		return nil
+	}
+
+	stats := MachineStats{MachineId: machineId}
+	err = rows.Scan(&stats.Id, &stats.CPUUsage, &stats.AvailableMemory, &stats.TotalMemory, &stats.AvailableDisk, &stats.TotalDisk, &stats.CreatedAt)
+	if err != nil {
+		fmt.Printf(" Cannot run Scan: %s\n", err.Error())
+		return nil
+	}
+
+	return &stats
+}
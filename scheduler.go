@@ -0,0 +1,245 @@
+/*
+Placement of environments. The scheduler picks online workload machines using the last rows of Stats{machineId} and resource requests of environments
+Machines of an environment are different, all replicas of the environment run on each of them. Machines with fewer placed replicas are preferred to spread workloads
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+const defaultMachineCount = 1
+
+// Machines with less free disk (bytes) or higher CPU usage (%) don't get new workloads
+const minSchedulingDisk = 1024 * 1024 * 1024
+const maxSchedulingCPUUsage = 90
+
+type schedulingCandidate struct {
+	Machine        Machine
+	Stats          MachineStats
+	PlacedReplicas int
+}
+
+// Re-places an environment on machines picked by the scheduler
+func handleEnvironmentPlacementPost(w http.ResponseWriter, r *http.Request) {
+	environment := getEnvironmentById(r.PathValue("id"))
+	if environment == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	_, err := replaceEnvironmentMachines(*environment)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(getEnvironmentById(environment.Id))
+	if err != nil {
+		fmt.Println("Cannot convert Environment object into JSON:", err)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+// Returns MachineIds for an environment, machines from currentMachineIds that are still online workload machines are kept
+func scheduleEnvironmentMachines(environment Environment, currentMachineIds []string) ([]string, error) {
+	machineCount := max(environment.MachineCount, len(currentMachineIds), defaultMachineCount)
+	requiredMemory := getRequiredMemory(environment.ResourceLimits) * int64(max(environment.Replicas, 1))
+
+	machineIds, err := scheduleMachines(requiredMemory, machineCount, currentMachineIds)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(machineIds) < machineCount {
+		fmt.Printf("Only %d of %d machines are available for environment %s\n", len(machineIds), machineCount, environment.Id)
+	}
+
+	return machineIds, nil
+}
+
+// Picks up to machineCount machines with requiredMemory (MB) available, machines from currentMachineIds that are still online workload machines are kept
+func scheduleMachines(requiredMemory int64, machineCount int, currentMachineIds []string) ([]string, error) {
+	placedReplicas := getPlacedReplicas()
+
+	machineIds := []string{}
+	candidates := []schedulingCandidate{}
+	rejectReasons := []string{}
+
+	for _, machine := range getMachinesWithType(MachineTypeWorkload) {
+		if machine.Status != MachineStatusOnline {
+			continue
+		}
+
+		//Running replicas already use resources of current machines, so these machines are kept without checks
+		if slices.Contains(currentMachineIds, machine.Id) {
+			machineIds = append(machineIds, machine.Id)
+			continue
+		}
+
+		stats := getLastMachineStats(machine.Id)
+		if stats == nil {
+			rejectReasons = append(rejectReasons, machine.Name+": no stats")
+			continue
+		}
+
+		if stats.AvailableMemory < requiredMemory {
+			rejectReasons = append(rejectReasons, machine.Name+": "+strconv.FormatInt(stats.AvailableMemory, 10)+" MB of memory available")
+			continue
+		}
+
+		if stats.AvailableDisk < minSchedulingDisk {
+			rejectReasons = append(rejectReasons, machine.Name+": not enough disk space")
+			continue
+		}
+
+		if stats.CPUUsage > maxSchedulingCPUUsage {
+			rejectReasons = append(rejectReasons, machine.Name+": CPU usage "+strconv.FormatInt(stats.CPUUsage, 10)+"%")
+			continue
+		}
+
+		candidates = append(candidates, schedulingCandidate{Machine: machine, Stats: *stats, PlacedReplicas: placedReplicas[machine.Id]})
+	}
+
+	//Spread first, then memory left after placement, then CPU usage
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].PlacedReplicas != candidates[j].PlacedReplicas {
+			return candidates[i].PlacedReplicas < candidates[j].PlacedReplicas
+		}
+		if candidates[i].Stats.AvailableMemory != candidates[j].Stats.AvailableMemory {
+			return candidates[i].Stats.AvailableMemory > candidates[j].Stats.AvailableMemory
+		}
+		return candidates[i].Stats.CPUUsage < candidates[j].Stats.CPUUsage
+	})
+
+	for _, candidate := range candidates {
+		if len(machineIds) >= machineCount {
+			break
+		}
+		machineIds = append(machineIds, candidate.Machine.Id)
+	}
+
+	if len(machineIds) == 0 {
+		message := "No online workload machines are available"
+		if len(rejectReasons) > 0 {
+			message += " (" + fmt.Sprint(rejectReasons) + ")"
+		}
+		return nil, errors.New(message)
+	}
+
+	return machineIds, nil
+}
+
+// Number of replicas each machine runs for all environments and databases
+func getPlacedReplicas() map[string]int {
+	placedReplicas := map[string]int{}
+
+	for _, environment := range getEnvironments() {
+		for _, machineId := range environment.MachineIds {
+			placedReplicas[machineId] += environment.Replicas
+		}
+	}
+
+	for _, database := range getAllDatabase() {
+		for _, machineId := range database.MachineIds {
+			placedReplicas[machineId]++
+		}
+	}
+
+	return placedReplicas
+}
+
+// Moves an environment from machines that cannot run it anymore (offline, deleted or not workload machines) to new ones
+// The last deployed image is started on new machines, containers and proxies on removed machines are removed
+// Returns true if MachineIds of the environment have been changed
+func replaceEnvironmentMachines(environment Environment) (bool, error) {
+	machineIds, err := scheduleEnvironmentMachines(environment, environment.MachineIds)
+	if err != nil {
+		return false, err
+	}
+
+	addedMachineIds := []string{}
+	for _, machineId := range machineIds {
+		if !slices.Contains(environment.MachineIds, machineId) {
+			addedMachineIds = append(addedMachineIds, machineId)
+		}
+	}
+
+	removedMachineIds := []string{}
+	for _, machineId := range environment.MachineIds {
+		if !slices.Contains(machineIds, machineId) {
+			removedMachineIds = append(removedMachineIds, machineId)
+		}
+	}
+
+	if len(addedMachineIds) == 0 && len(removedMachineIds) == 0 {
+		return false, nil
+	}
+
+	environment.MachineIds = machineIds
+	if !updateEnvironment(environment) {
+		return false, errors.New("cannot update environment " + environment.Id)
+	}
+
+	var envLog EnvironmentLog
+	envLog.EnvironmentId = environment.Id
+	envLog.Level = "4"
+	envLog.MachineId = thisMachine.Id
+	envLog.Message = "Environment has been moved from machines " + fmt.Sprint(removedMachineIds) + " to machines " + fmt.Sprint(addedMachineIds)
+	saveEnvironmentLog(envLog)
+
+	//Removed machines can be offline, so their proxies are removed here and containers are removed by ContainerJobs when machines are back
+	machineIPs := []string{}
+	for _, machineId := range machineIds {
+		machine := getMachineById(machineId)
+		if machine != nil {
+			machineIPs = append(machineIPs, machine.VPNIp)
+		}
+	}
+	deleteProxiesIfServerPrivateIPNotIn(environment.Id, machineIPs)
+
+	for _, machineId := range removedMachineIds {
+		var job ContainerJob
+		job.MachineId = machineId
+		job.Status = ContainerJobStatusPlanned
+		job.JobType = ContainerJobTypeDelete
+		job.EnvironmentId = environment.Id
+		addContainerJob(job)
+	}
+
+	if len(addedMachineIds) > 0 {
+		deployment, image := getLastDeployedDeployment(environment.Id)
+		if deployment != nil {
+			_, err = redeployImage(environment, *deployment, *image, addedMachineIds, "Starting deployment ID='"+deployment.Id+"' on new machines "+fmt.Sprint(addedMachineIds))
+			if err != nil {
+				return true, err
+			}
+		}
+	}
+
+	return true, nil
+}
+
+// The most recent deployment that runs on at least one machine and whose image is still available
+func getLastDeployedDeployment(environmentId string) (*Deployment, *Image) {
+	deployment := getDeployedDeployment(environmentId)
+	if deployment == nil {
+		return nil, nil
+	}
+
+	images := getReadyImagesByDeployment(*deployment)
+	if len(images) == 0 {
+		return nil, nil
+	}
+
+	return deployment, &images[0]
+}
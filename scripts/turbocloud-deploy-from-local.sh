@@ -80,6 +80,9 @@ status_code=$(curl --write-out %{http_code} --silent --output /dev/null localhos
 echo "Checking that TurboCloud API is available"
 echo "Response code to GET /hey: $status_code"
 
+echo "Loading an API token from the server"
+api_token=$(ssh root@$public_ip 'cat $HOME/.turbocloud_api_token')
+
 echo "Checking if this is the first deployment from this folder"
 echo "TurboCloud stores service id and environment id in .turbocloud inside a project's root folder."
 
@@ -93,7 +96,7 @@ if test -f .turbocloud; then
     echo "Deploying an environment with ID $environmentId in service with ID $serviceId"
 
     #Check if there is a service and environment in VPN, if no - we should create a new service and environment
-    response=$(curl -s "http://localhost:5445/service/$serviceId/environment")
+    response=$(curl -s -H "Authorization: Bearer $api_token" "http://localhost:5445/service/$serviceId/environment")
 
     # Check if the environmentId exists in the JSON response
     if [[ "$response" == *"$environmentId"* ]]; then
@@ -111,7 +114,7 @@ if [ "$environmentId" = "" ]; then
   echo "No TurboCloud config file has been found or EnvironmentId hasn't be specified."
 
   echo "Creating a service for this project."
-  serviceId=$(curl -d '{"Name":"'"$folder_name"'", "GitURL":"", "ProjectId":""}' -H "Content-Type: application/json" -X POST http://localhost:5445/service | sed -n 's|.*"Id": *"\([^"]*\)".*|\1|p')
+  serviceId=$(curl -d '{"Name":"'"$folder_name"'", "GitURL":"", "ProjectId":""}' -H "Content-Type: application/json" -H "Authorization: Bearer $api_token" -X POST http://localhost:5445/service | sed -n 's|.*"Id": *"\([^"]*\)".*|\1|p')
   echo "New service has been created with Id: $serviceId"
 
   echo "Creating an environment."
@@ -123,6 +126,7 @@ if [ "$environmentId" = "" ]; then
 
   environmentId=$(curl -s -X POST http://localhost:5445/environment \
   -H "Content-Type: application/json" \
+  -H "Authorization: Bearer $api_token" \
   -d '{"Name":"prod","Branch":"","Port":"'"$project_port"'",'$domains',"MachineIds":[],"GitTag":"","ServiceId":"'"$serviceId"'"}' | \
   sed -n 's|.*"Id":[[:space:]]*"\([^"]*\)".*|\1|p')
   
@@ -138,6 +142,7 @@ echo "Scheduling a deployment. Your project should be online within seconds/minu
 
 deploymentId=$(curl -s -X POST "http://localhost:5445/deploy/environment/$environmentId" \
   -H "Content-Type: application/json" \
+  -H "Authorization: Bearer $api_token" \
   -d "{\"SourceFolder\":\"$server_project_folder\"}" | \
   sed -n 's|.*"Id":[[:space:]]*"\([^"]*\)".*|\1|p')
 
@@ -203,6 +203,10 @@ if [ "$url_download_vpn_certs" != "" ]; then
     sudo mv ca.crt /etc/nebula/ca.crt
     sudo mv host.crt /etc/nebula/host.crt
     sudo mv host.key /etc/nebula/host.key
+    if [ -f secret.key ]; then
+        mv secret.key $HOME/.turbocloud_secret_key
+        chmod 600 $HOME/.turbocloud_secret_key
+    fi
 
     sudo rm turbocloud-join-vpn.zip
 
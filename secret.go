@@ -0,0 +1,135 @@
+/*
+Encryption of secrets stored in rqlite. All machines share one key, the lighthouse generates it and sends it to new machines in the join archive
+*/
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"slices"
+	"strings"
+)
+
+const SecretKeyFileName = ".turbocloud_secret_key"
+
+// AES-256 key, nil if this machine has no key
+var secretKey []byte
+
+// Loads the key from TURBOCLOUD_SECRET_KEY or $HOME/.turbocloud_secret_key, the lighthouse generates a new key if there is no key yet
+func loadSecretKey() {
+	keyHex, isKeyEnvExists := os.LookupEnv("TURBOCLOUD_SECRET_KEY")
+
+	if !isKeyEnvExists {
+		keyPath := getSecretKeyPath()
+		keyBytes, err := os.ReadFile(keyPath)
+
+		if err != nil && os.IsNotExist(err) && slices.Contains(thisMachine.Types, MachineTypeLighthouse) {
+			keyHex, err = generateSecretKey(keyPath)
+			if err != nil {
+				fmt.Println("Cannot generate a secret key:", err)
+				return
+			}
+			fmt.Println("A new secret key has been saved to " + keyPath)
+		} else if err != nil {
+			fmt.Println("Cannot load a secret key, secret environment variables cannot be used on this machine:", err)
+			return
+		} else {
+			keyHex = string(keyBytes)
+		}
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(keyHex))
+	if err != nil || len(key) != 32 {
+		fmt.Println("Invalid secret key, it should be 32 bytes in hex")
+		return
+	}
+
+	secretKey = key
+}
+
+func generateSecretKey(keyPath string) (string, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+
+	keyHex := hex.EncodeToString(key)
+	err := os.WriteFile(keyPath, []byte(keyHex), 0600)
+	if err != nil {
+		return "", err
+	}
+
+	return keyHex, nil
+}
+
+func getSecretKeyPath() string {
+	currentUser, err := user.Current()
+	if err != nil {
+		fmt.Println("Cannot get home directory, secret.go:", err)
+		return SecretKeyFileName
+	}
+
+	return currentUser.HomeDir + "/" + SecretKeyFileName
+}
+
+// Returns base64 of nonce + AES-GCM ciphertext
+func encryptSecret(plaintext string) (string, error) {
+	gcm, err := getSecretCipher()
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	ciphertext := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+func decryptSecret(encrypted string) (string, error) {
+	gcm, err := getSecretCipher()
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return "", errors.New("encrypted secret is too short")
+	}
+
+	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", errors.New("cannot decrypt a secret, check that all machines have the same secret key")
+	}
+
+	return string(plaintext), nil
+}
+
+func getSecretCipher() (cipher.AEAD, error) {
+	if secretKey == nil {
+		return nil, errors.New("no secret key on machine '" + thisMachine.Name + "', copy " + SecretKeyFileName + " from the lighthouse machine")
+	}
+
+	block, err := aes.NewCipher(secretKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -11,11 +11,12 @@ import (
 )
 
 type Service struct {
-	Id        string
-	Name      string
-	GitURL    string
-	ImageName string
-	ProjectId string
+	Id            string
+	Name          string
+	GitURL        string
+	ImageName     string
+	ProjectId     string
+	WebhookSecret string //Secret to verify signatures of webhooks from GitHub/Bitbucket
 }
 
 func handleServicePost(w http.ResponseWriter, r *http.Request) {
@@ -56,6 +57,30 @@ func handleServiceGet(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, string(jsonBytes))
 }
 
+func handleServiceWebhookSecretPost(w http.ResponseWriter, r *http.Request) {
+
+	serviceId := r.PathValue("id")
+
+	service := getServiceById(serviceId)
+	if service == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	if !updateServiceWebhookSecret(service) {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(service)
+	if err != nil {
+		fmt.Println("Cannot convert Service object into JSON:", err)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonBytes))
+}
+
 func handleServiceDelete(w http.ResponseWriter, r *http.Request) {
 
 	serviceId := r.PathValue("id")
@@ -83,6 +108,15 @@ func addService(service *Service) {
 
 	service.Id = id
 
+	if service.WebhookSecret == "" {
+		webhookSecret, err := NanoId(32)
+		if err != nil {
+			fmt.Println("Cannot generate a webhook secret for Service:", err)
+			return
+		}
+		service.WebhookSecret = webhookSecret
+	}
+
 	//Save Environemnts and generate string with environment IDs to save in DB
 	/*environemntIds := []string{}
 	for envIndex := range service.Environments {
@@ -96,8 +130,8 @@ func addService(service *Service) {
 	_, err = connection.WriteParameterized(
 		[]gorqlite.ParameterizedStatement{
 			{
-				Query:     "INSERT INTO Service( Id, Name, ProjectId, GitURL, ImageName) VALUES(?, ?, ?, ?, ?)",
-				Arguments: []interface{}{service.Id, service.Name, service.ProjectId, service.GitURL, service.ImageName},
+				Query:     "INSERT INTO Service( Id, Name, ProjectId, GitURL, ImageName, WebhookSecret) VALUES(?, ?, ?, ?, ?, ?)",
+				Arguments: []interface{}{service.Id, service.Name, service.ProjectId, service.GitURL, service.ImageName, service.WebhookSecret},
 			},
 		},
 	)
@@ -113,7 +147,7 @@ func getAllServices() []Service {
 
 	rows, err := connection.QueryOneParameterized(
 		gorqlite.ParameterizedStatement{
-			Query:     "SELECT Id, Name, ProjectId, GitURL, ImageName from Service",
+			Query:     "SELECT Id, Name, ProjectId, GitURL, ImageName, WebhookSecret from Service",
 			Arguments: []interface{}{},
 		},
 	)
@@ -128,8 +162,9 @@ func getAllServices() []Service {
 		var ProjectId string
 		var GitURL string
 		var ImageName string
+		var WebhookSecret string
 
-		err := rows.Scan(&Id, &Name, &ProjectId, &GitURL, &ImageName)
+		err := rows.Scan(&Id, &Name, &ProjectId, &GitURL, &ImageName, &WebhookSecret)
 		if err != nil {
 			fmt.Printf(" Cannot run Scan: %s\n", err.Error())
 		}
@@ -142,11 +177,12 @@ func getAllServices() []Service {
 		}*/
 
 		loadedService := Service{
-			Id:        Id,
-			Name:      Name,
-			ProjectId: ProjectId,
-			GitURL:    GitURL,
-			ImageName: ImageName,
+			Id:            Id,
+			Name:          Name,
+			ProjectId:     ProjectId,
+			GitURL:        GitURL,
+			ImageName:     ImageName,
+			WebhookSecret: WebhookSecret,
 		}
 		services = append(services, loadedService)
 	}
@@ -157,7 +193,7 @@ func getServiceById(serviceId string) *Service {
 
 	rows, err := connection.QueryOneParameterized(
 		gorqlite.ParameterizedStatement{
-			Query:     "SELECT Id, Name, ProjectId, GitURL, ImageName from Service where Id = ?",
+			Query:     "SELECT Id, Name, ProjectId, GitURL, ImageName, WebhookSecret from Service where Id = ?",
 			Arguments: []interface{}{serviceId},
 		},
 	)
@@ -178,22 +214,97 @@ func getServiceById(serviceId string) *Service {
 	var ProjectId string
 	var GitURL string
 	var ImageName string
+	var WebhookSecret string
 
-	err = rows.Scan(&Id, &Name, &ProjectId, &GitURL, &ImageName)
+	err = rows.Scan(&Id, &Name, &ProjectId, &GitURL, &ImageName, &WebhookSecret)
 	if err != nil {
 		fmt.Printf(" Cannot run Scan: %s\n", err.Error())
 	}
 	loadedService := Service{
-		Id:        Id,
-		Name:      Name,
-		ProjectId: ProjectId,
-		GitURL:    GitURL,
-		ImageName: ImageName,
+		Id:            Id,
+		Name:          Name,
+		ProjectId:     ProjectId,
+		GitURL:        GitURL,
+		ImageName:     ImageName,
+		WebhookSecret: WebhookSecret,
 	}
 	return &loadedService
 
 }
 
+func updateServiceWebhookSecret(service *Service) (result bool) {
+
+	webhookSecret, err := NanoId(32)
+	if err != nil {
+		fmt.Println("Cannot generate a webhook secret for Service:", err)
+		return false
+	}
+
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "UPDATE Service SET WebhookSecret = ? WHERE Id = ?",
+				Arguments: []interface{}{webhookSecret, service.Id},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot update a record in Service table: %s\n", err.Error())
+		return false
+	}
+
+	service.WebhookSecret = webhookSecret
+	return true
+}
+
+// Services created before webhook signatures were verified have no secret, their webhooks are rejected until the new secret is set in the Git provider
+func addMissingWebhookSecrets() {
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id from Service WHERE WebhookSecret IS NULL OR WebhookSecret = ''",
+			Arguments: []interface{}{},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot read from Service table: %s\n", err.Error())
+		return
+	}
+
+	for rows.Next() {
+		var serviceId string
+		err := rows.Scan(&serviceId)
+		if err != nil {
+			fmt.Printf(" Cannot run Scan: %s\n", err.Error())
+			continue
+		}
+
+		webhookSecret, err := NanoId(32)
+		if err != nil {
+			fmt.Println("Cannot generate a webhook secret for Service:", err)
+			return
+		}
+
+		//Other machines can run the same migration, the first generated secret is kept
+		_, err = connection.WriteParameterized(
+			[]gorqlite.ParameterizedStatement{
+				{
+					Query:     "UPDATE Service SET WebhookSecret = ? WHERE Id = ? AND (WebhookSecret IS NULL OR WebhookSecret = '')",
+					Arguments: []interface{}{webhookSecret, serviceId},
+				},
+			},
+		)
+
+		if err != nil {
+			fmt.Printf(" Cannot update a record in Service table: %s\n", err.Error())
+			continue
+		}
+
+		fmt.Println("Service " + serviceId + " got a webhook secret, get it with GET /service and set it in the webhook settings of the Git provider")
+	}
+}
+
 func deleteService(serviceId string) (result bool) {
 
 	//Delete all environments
@@ -0,0 +1,79 @@
+/*
+Time ranges of stats endpoints. from and to are RFC3339 timestamps or Unix seconds, step is the length of one bucket in seconds
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const defaultStatsRange = time.Hour
+const maxStatsBuckets = 1000
+
+// SQLite format of CURRENT_TIMESTAMP, all stats tables store CreatedAt in UTC
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+type StatsRange struct {
+	From time.Time
+	To   time.Time
+	Step int64
+}
+
+// Parses ?from=&to=&step=, the last hour is returned by default and step is picked to get about 60 buckets
+func parseStatsRange(r *http.Request) (StatsRange, error) {
+	var statsRange StatsRange
+	var err error
+
+	statsRange.To = time.Now().UTC()
+	if r.URL.Query().Get("to") != "" {
+		statsRange.To, err = parseStatsTime(r.URL.Query().Get("to"))
+		if err != nil {
+			return statsRange, errors.New("Invalid to, use RFC3339 or Unix seconds")
+		}
+	}
+
+	statsRange.From = statsRange.To.Add(-defaultStatsRange)
+	if r.URL.Query().Get("from") != "" {
+		statsRange.From, err = parseStatsTime(r.URL.Query().Get("from"))
+		if err != nil {
+			return statsRange, errors.New("Invalid from, use RFC3339 or Unix seconds")
+		}
+	}
+
+	if !statsRange.From.Before(statsRange.To) {
+		return statsRange, errors.New("from should be before to")
+	}
+
+	rangeSeconds := int64(statsRange.To.Sub(statsRange.From).Seconds())
+	statsRange.Step = max(rangeSeconds/60, 1)
+	if r.URL.Query().Get("step") != "" {
+		statsRange.Step, err = strconv.ParseInt(r.URL.Query().Get("step"), 10, 64)
+		if err != nil || statsRange.Step <= 0 {
+			return statsRange, errors.New("Invalid step, it should be a positive number of seconds")
+		}
+	}
+
+	if rangeSeconds/statsRange.Step > maxStatsBuckets {
+		return statsRange, errors.New("Too many buckets, increase step or use a shorter range (max " + strconv.Itoa(maxStatsBuckets) + " buckets)")
+	}
+
+	return statsRange, nil
+}
+
+func parseStatsTime(value string) (time.Time, error) {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err == nil {
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+
+	parsedTime, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return parsedTime.UTC(), nil
+}
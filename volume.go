@@ -0,0 +1,352 @@
+/*
+Persistent volumes of environments. Docker volumes are created on each machine of an environment and mounted into all replicas
+Volumes survive redeploys and deleted environments, they are removed only by VolumeJobs scheduled with DELETE /volume/{id}
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+
+	"github.com/rqlite/gorqlite"
+)
+
+const VolumeStatusActive = "active"
+const VolumeStatusToDelete = "scheduled_to_delete"
+const VolumeStatusDeleteFailed = "delete_failed"
+
+type Volume struct {
+	Id            string
+	EnvironmentId string
+	Name          string
+	ContainerPath string //Absolute path inside containers, for example "/app/uploads"
+	Status        string
+}
+
+var volumeNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+var volumeContainerPathRegexp = regexp.MustCompile(`^/[A-Za-z0-9_./-]*$`)
+
+func handleVolumePost(w http.ResponseWriter, r *http.Request) {
+	var volume Volume
+	err := decodeJSONBody(w, r, &volume, true)
+
+	if err != nil {
+		var mr *malformedRequest
+		if errors.As(err, &mr) {
+			http.Error(w, mr.msg, mr.status)
+		} else {
+			log.Print(err.Error())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	environment := getEnvironmentById(r.PathValue("environmentId"))
+	if environment == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	volume.EnvironmentId = environment.Id
+	volume.Status = VolumeStatusActive
+
+	err = validateVolume(volume)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, existingVolume := range getVolumesByEnvironmentId(environment.Id) {
+		if existingVolume.Name == volume.Name || existingVolume.ContainerPath == volume.ContainerPath {
+			http.Error(w, "Volume "+existingVolume.Name+" with path "+existingVolume.ContainerPath+" already exists", http.StatusConflict)
+			return
+		}
+	}
+
+	err = addVolume(&volume)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(volume)
+	if err != nil {
+		fmt.Println("Cannot convert Volume object into JSON:", err)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+func handleVolumeGet(w http.ResponseWriter, r *http.Request) {
+
+	jsonBytes, err := json.Marshal(getVolumes())
+	if err != nil {
+		fmt.Println("Cannot convert Volume object into JSON:", err)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+func handleEnvironmentVolumeGet(w http.ResponseWriter, r *http.Request) {
+
+	jsonBytes, err := json.Marshal(getVolumesByEnvironmentId(r.PathValue("environmentId")))
+	if err != nil {
+		fmt.Println("Cannot convert Volume object into JSON:", err)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonBytes))
+}
+
+// Volumes are removed from all machines because MachineIds of an environment could change after volumes were created
+func handleVolumeDelete(w http.ResponseWriter, r *http.Request) {
+
+	volume := getVolumeById(r.PathValue("id"))
+	if volume == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	if volume.Status == VolumeStatusToDelete {
+		http.Error(w, "Volume is being deleted already", http.StatusConflict)
+		return
+	}
+
+	//Jobs of a failed attempt are replaced with new ones
+	deleteVolumeJobsByVolumeId(volume.Id)
+
+	err := updateVolumeStatus(volume.Id, VolumeStatusToDelete)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for _, machine := range getMachines() {
+		var job VolumeJob
+		job.MachineId = machine.Id
+		job.Status = VolumeJobStatusPlanned
+		job.JobType = VolumeJobTypeDelete
+		job.VolumeId = volume.Id
+		addVolumeJob(job)
+	}
+
+	fmt.Fprint(w, "")
+}
+
+func validateVolume(volume Volume) error {
+	if !volumeNameRegexp.MatchString(volume.Name) {
+		return errors.New("Name can contain only letters, digits, '_', '.' and '-'")
+	}
+
+	if !volumeContainerPathRegexp.MatchString(volume.ContainerPath) || volume.ContainerPath == "/" {
+		return errors.New("ContainerPath should be an absolute path, for example /app/uploads")
+	}
+
+	return nil
+}
+
+// Docker volume names don't depend on user-defined names, so a volume can be recreated with the same name while the old one is being deleted
+func getVolumeDockerName(volumeId string) string {
+	return "volume-" + volumeId
+}
+
+/*Deployments*/
+
+// Creates active volumes of an environment on this machine (existing volumes are kept) and returns "-v" arguments for docker run
+func createEnvironmentVolumes(environment Environment, deployment Deployment) (string, error) {
+	volumes := getVolumesByEnvironmentIdAndStatus(environment.Id, VolumeStatusActive)
+	if len(volumes) == 0 {
+		return "", nil
+	}
+
+	scriptTemplate := createTemplate("create_volumes", `
+	#!/bin/sh
+	set -e
+	{{ range . }}
+	docker volume create --label turbocloud.environment={{.EnvironmentId}} {{.DockerName}}
+	{{ end }}
+`)
+
+	type volumeTemplateData struct {
+		EnvironmentId string
+		DockerName    string
+	}
+
+	templateData := []volumeTemplateData{}
+	volumeArgs := ""
+	for _, volume := range volumes {
+		templateData = append(templateData, volumeTemplateData{EnvironmentId: volume.EnvironmentId, DockerName: getVolumeDockerName(volume.Id)})
+		volumeArgs += " -v " + getVolumeDockerName(volume.Id) + ":" + volume.ContainerPath
+	}
+
+	var templateBytes bytes.Buffer
+	if err := scriptTemplate.Execute(&templateBytes, templateData); err != nil {
+		return "", err
+	}
+
+	output, err := executeScriptString(templateBytes.String(), func(logLine string) {
+		//Save log message
+		var envLog EnvironmentLog
+		envLog.EnvironmentId = environment.Id
+		envLog.DeploymentId = deployment.Id
+		envLog.Level = "6"
+		envLog.MachineId = thisMachine.Id
+		envLog.Message = logLine
+		saveEnvironmentLog(envLog)
+		////////////////////////
+	})
+
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, lastLines(output, 5))
+	}
+
+	return volumeArgs, nil
+}
+
+/*Database*/
+
+func addVolume(volume *Volume) error {
+
+	id, err := NanoId(7)
+	if err != nil {
+		fmt.Println("Cannot generate new NanoId for Volume:", err)
+		return err
+	}
+
+	volume.Id = id
+
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "INSERT INTO Volume( Id, EnvironmentId, Name, ContainerPath, Status) VALUES(?, ?, ?, ?, ?)",
+				Arguments: []interface{}{volume.Id, volume.EnvironmentId, volume.Name, volume.ContainerPath, volume.Status},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot write to Volume table: %s\n", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func updateVolumeStatus(volumeId string, status string) error {
+
+	_, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "UPDATE Volume SET Status = ? WHERE Id = ?",
+				Arguments: []interface{}{status, volumeId},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf("Cannot update a row in Volume: %s\n", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func deleteVolume(volumeId string) bool {
+	_, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "DELETE FROM Volume WHERE Id = ?",
+				Arguments: []interface{}{volumeId},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot delete a record from Volume table: %s\n", err.Error())
+		return false
+	}
+
+	return true
+}
+
+func getVolumes() []Volume {
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id, EnvironmentId, Name, ContainerPath, Status from Volume ORDER BY CreatedAt ASC",
+			Arguments: []interface{}{},
+		},
+	)
+
+	return handleVolumeQuery(rows, err)
+}
+
+func getVolumeById(volumeId string) *Volume {
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id, EnvironmentId, Name, ContainerPath, Status from Volume WHERE Id = ?",
+			Arguments: []interface{}{volumeId},
+		},
+	)
+
+	volumes := handleVolumeQuery(rows, err)
+	if len(volumes) == 0 {
+		return nil
+	}
+
+	return &volumes[0]
+}
+
+func getVolumesByEnvironmentId(environmentId string) []Volume {
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id, EnvironmentId, Name, ContainerPath, Status from Volume WHERE EnvironmentId = ? ORDER BY CreatedAt ASC",
+			Arguments: []interface{}{environmentId},
+		},
+	)
+
+	return handleVolumeQuery(rows, err)
+}
+
+func getVolumesByEnvironmentIdAndStatus(environmentId string, status string) []Volume {
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id, EnvironmentId, Name, ContainerPath, Status from Volume WHERE EnvironmentId = ? AND Status = ? ORDER BY CreatedAt ASC",
+			Arguments: []interface{}{environmentId, status},
+		},
+	)
+
+	return handleVolumeQuery(rows, err)
+}
+
+func handleVolumeQuery(rows gorqlite.QueryResult, err error) []Volume {
+
+	var volumes = []Volume{}
+
+	if err != nil {
+		fmt.Printf(" Cannot read from Volume table: %s\n", err.Error())
+	}
+
+	for rows.Next() {
+		var volume Volume
+
+		err := rows.Scan(&volume.Id, &volume.EnvironmentId, &volume.Name, &volume.ContainerPath, &volume.Status)
+		if err != nil {
+			fmt.Printf(" Cannot run Scan: %s\n", err.Error())
+		}
+
+		volumes = append(volumes, volume)
+	}
+
+	return volumes
+}
@@ -0,0 +1,213 @@
+/*
+Volume jobs. Each machine removes its own copy of a Docker volume, the Volume record is deleted when all machines are done
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/rqlite/gorqlite"
+)
+
+const VolumeJobTypeDelete = "volume_del"
+
+const VolumeJobStatusPlanned = "planned"
+const VolumeJobStatusInProgress = "in_progress"
+const VolumeJobStatusFinished = "finished"
+const VolumeJobStatusFailed = "failed"
+
+type VolumeJob struct {
+	Id        string
+	Status    string
+	VolumeId  string
+	MachineId string
+	JobType   string
+	ErrorMsg  string
+}
+
+func addVolumeJob(job VolumeJob) VolumeJob {
+	id, err := NanoId(7)
+	if err != nil {
+		fmt.Println("Cannot generate new NanoId for VolumeJob:", err)
+		return job
+	}
+
+	job.Id = id
+
+	_, err = connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "INSERT INTO VolumeJob( Id, Status, VolumeId, MachineId, JobType, ErrorMsg) VALUES(?, ?, ?, ?, ?, ?)",
+				Arguments: []interface{}{job.Id, job.Status, job.VolumeId, job.MachineId, job.JobType, job.ErrorMsg},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot write to VolumeJob table: %s\n", err.Error())
+	}
+
+	fmt.Printf("New VolumeJob is scheduled for VolumeId %s\n", job.VolumeId)
+
+	return job
+}
+
+func startVolumeJobsCheckerWorker() {
+	for range time.Tick(time.Second * 5) {
+		go func() {
+			volumeJobs := getVolumeJobsByMachineIdAndStatusAndJobType(thisMachine.Id, VolumeJobStatusPlanned, VolumeJobTypeDelete)
+			if len(volumeJobs) > 0 {
+				fmt.Printf("Found %d VolumeJobs with status %s\n", len(volumeJobs), VolumeJobStatusPlanned)
+				for _, volumeJob := range volumeJobs {
+					runVolumeDeleteJob(volumeJob)
+				}
+			}
+		}()
+	}
+}
+
+func runVolumeDeleteJob(job VolumeJob) {
+	//Mark the job right away, so the next tick doesn't pick it up again
+	err := updateVolumeJobStatus(job, VolumeJobStatusInProgress, "")
+	if err != nil {
+		return
+	}
+
+	err = removeDockerVolume(job.VolumeId)
+	if err != nil {
+		fmt.Println("Cannot remove volume " + job.VolumeId + " on machine " + thisMachine.Name + ": " + err.Error())
+		updateVolumeJobStatus(job, VolumeJobStatusFailed, err.Error())
+		updateVolumeStatus(job.VolumeId, VolumeStatusDeleteFailed)
+		return
+	}
+
+	err = updateVolumeJobStatus(job, VolumeJobStatusFinished, "")
+	if err != nil {
+		return
+	}
+
+	//The Volume record is removed only when the volume is removed from all machines
+	for _, volumeJob := range getVolumeJobsByVolumeId(job.VolumeId) {
+		if volumeJob.Status != VolumeJobStatusFinished {
+			return
+		}
+	}
+
+	if deleteVolume(job.VolumeId) {
+		deleteVolumeJobsByVolumeId(job.VolumeId)
+	}
+}
+
+// Removes a Docker volume from this machine, machines that never deployed an environment don't have its volumes
+func removeDockerVolume(volumeId string) error {
+	scriptTemplate := createTemplate("remove_volume", `
+	#!/bin/sh
+	set -e
+	if docker volume inspect {{.VOLUME_NAME}} > /dev/null 2>&1; then
+		docker volume rm {{.VOLUME_NAME}}
+	fi
+`)
+
+	var templateBytes bytes.Buffer
+	templateData := map[string]string{
+		"VOLUME_NAME": getVolumeDockerName(volumeId),
+	}
+
+	if err := scriptTemplate.Execute(&templateBytes, templateData); err != nil {
+		return err
+	}
+
+	//Docker doesn't remove volumes used by containers, for example by a running deployment that mounted the volume before it was deleted
+	output, err := executeScriptString(templateBytes.String(), func(logLine string) {})
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, lastLines(output, 5))
+	}
+
+	return nil
+}
+
+func updateVolumeJobStatus(job VolumeJob, status string, errorMsg string) error {
+
+	_, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "UPDATE VolumeJob SET Status = ?, ErrorMsg = ? WHERE Id = ?",
+				Arguments: []interface{}{status, errorMsg, job.Id},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf("Cannot update a row in VolumeJob: %s\n", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func deleteVolumeJobsByVolumeId(volumeId string) bool {
+	_, err := connection.WriteParameterized(
+		[]gorqlite.ParameterizedStatement{
+			{
+				Query:     "DELETE FROM VolumeJob WHERE VolumeId = ?",
+				Arguments: []interface{}{volumeId},
+			},
+		},
+	)
+
+	if err != nil {
+		fmt.Printf(" Cannot delete records from VolumeJob table: %s\n", err.Error())
+		return false
+	}
+
+	return true
+}
+
+func getVolumeJobsByVolumeId(volumeId string) []VolumeJob {
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id, Status, VolumeId, MachineId, JobType, ErrorMsg from VolumeJob WHERE VolumeId = ?",
+			Arguments: []interface{}{volumeId},
+		},
+	)
+
+	return handleVolumeJobQuery(rows, err)
+}
+
+func getVolumeJobsByMachineIdAndStatusAndJobType(machineId string, status string, jobType string) []VolumeJob {
+
+	rows, err := connection.QueryOneParameterized(
+		gorqlite.ParameterizedStatement{
+			Query:     "SELECT Id, Status, VolumeId, MachineId, JobType, ErrorMsg from VolumeJob WHERE MachineId = ? AND Status = ? AND JobType = ?",
+			Arguments: []interface{}{machineId, status, jobType},
+		},
+	)
+
+	return handleVolumeJobQuery(rows, err)
+}
+
+func handleVolumeJobQuery(rows gorqlite.QueryResult, err error) []VolumeJob {
+
+	var jobs = []VolumeJob{}
+
+	if err != nil {
+		fmt.Printf(" Cannot read from VolumeJob table: %s\n", err.Error())
+	}
+
+	for rows.Next() {
+		var job VolumeJob
+
+		err := rows.Scan(&job.Id, &job.Status, &job.VolumeId, &job.MachineId, &job.JobType, &job.ErrorMsg)
+		if err != nil {
+			fmt.Printf(" Cannot run Scan: %s\n", err.Error())
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	return jobs
+}
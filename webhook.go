@@ -0,0 +1,396 @@
+/*
+Webhooks from Git providers, we verify a signature of each webhook with Service.WebhookSecret
+Each provider knows how to detect its webhooks, verify a signature and extract a Git ref and a commit from a payload
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const GitHubSignatureHeader = "X-Hub-Signature-256"
+const BitbucketSignatureHeader = "X-Hub-Signature"
+const GitLabTokenHeader = "X-Gitlab-Token"
+const GiteaSignatureHeader = "X-Gitea-Signature"
+const ForgejoSignatureHeader = "X-Forgejo-Signature"
+const GenericSignatureHeader = "X-TurboCloud-Signature"
+
+const GitRefBranchPrefix = "refs/heads/"
+const GitRefTagPrefix = "refs/tags/"
+
+// Branch and tag names are passed to git clone, so only a safe subset of Git ref names is accepted
+var gitRefNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._/+-]*$`)
+
+type WebhookPush struct {
+	Ref       string //Full Git ref, for example refs/heads/main or refs/tags/v1.0.0
+	Commit    string
+	Author    string
+	Message   string
+	IsDeleted bool //A branch or a tag has been deleted, there is nothing to deploy
+}
+
+// GitHub, Gitea and GitLab use the same format of commits in payloads
+type GitCommitPayload struct {
+	Id      string `json:"id"`
+	Message string `json:"message"`
+	Author  struct {
+		Name  string `json:"name"`
+		Email string `json:"email"`
+	} `json:"author"`
+}
+
+type WebhookProvider interface {
+	Name() string
+	Detect(r *http.Request) bool
+	Verify(r *http.Request, body []byte, secret string) bool
+	Parse(body []byte) (WebhookPush, error)
+}
+
+// The order is important: Gitea sends GitHub headers as well and the generic provider accepts any request
+var webhookProviders = []WebhookProvider{
+	GiteaWebhookProvider{},
+	GitHubWebhookProvider{},
+	GitLabWebhookProvider{},
+	BitbucketWebhookProvider{},
+	GenericWebhookProvider{},
+}
+
+func detectWebhookProvider(r *http.Request) WebhookProvider {
+	for _, provider := range webhookProviders {
+		if provider.Detect(r) {
+			return provider
+		}
+	}
+	return nil
+}
+
+func newWebhookPush(ref string, commit string, headCommit GitCommitPayload) WebhookPush {
+	push := WebhookPush{Ref: ref, Commit: commit}
+
+	if headCommit.Author.Name != "" {
+		push.Author = headCommit.Author.Name + " <" + headCommit.Author.Email + ">"
+	}
+	push.Message = strings.TrimSpace(headCommit.Message)
+
+	return push
+}
+
+// Git providers send an all-zero commit as the new commit of a deleted ref
+func isDeletedRefCommit(commit string) bool {
+	return commit != "" && strings.Trim(commit, "0") == ""
+}
+
+func (push WebhookPush) Branch() (string, bool) {
+	return strings.CutPrefix(push.Ref, GitRefBranchPrefix)
+}
+
+func (push WebhookPush) Tag() (string, bool) {
+	return strings.CutPrefix(push.Ref, GitRefTagPrefix)
+}
+
+// Rejects names that git could read as options (-u...) and names with shell metacharacters
+func isValidGitRefName(name string) bool {
+	if len(name) > 255 || !gitRefNameRegexp.MatchString(name) {
+		return false
+	}
+
+	return !strings.Contains(name, "..") && !strings.Contains(name, "//") && !strings.HasSuffix(name, "/") && !strings.HasSuffix(name, ".") && !strings.HasSuffix(name, ".lock")
+}
+
+/*GitHub*/
+
+type GitHubWebhookProvider struct{}
+
+type GitHubPayload struct {
+	Ref        string           `json:"ref"`
+	After      string           `json:"after"`
+	Deleted    bool             `json:"deleted"`
+	HeadCommit GitCommitPayload `json:"head_commit"`
+}
+
+func (GitHubWebhookProvider) Name() string {
+	return "GitHub"
+}
+
+func (GitHubWebhookProvider) Detect(r *http.Request) bool {
+	return r.Header.Get("X-GitHub-Event") != "" || strings.Contains(r.Header.Get("User-Agent"), "GitHub")
+}
+
+func (GitHubWebhookProvider) Verify(r *http.Request, body []byte, secret string) bool {
+	return isValidSHA256Signature(r.Header.Get(GitHubSignatureHeader), secret, body)
+}
+
+func (GitHubWebhookProvider) Parse(body []byte) (WebhookPush, error) {
+	var payload GitHubPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return WebhookPush{}, err
+	}
+
+	push := newWebhookPush(payload.Ref, payload.After, payload.HeadCommit)
+	push.IsDeleted = payload.Deleted || isDeletedRefCommit(payload.After)
+	return push, nil
+}
+
+/*Bitbucket*/
+
+type BitbucketWebhookProvider struct{}
+
+type BitbucketPayload struct {
+	Push struct {
+		Changes []struct {
+			New struct {
+				Name   string `json:"name"`
+				Type   string `json:"type"`
+				Target struct {
+					Hash    string `json:"hash"`
+					Message string `json:"message"`
+					Author  struct {
+						Raw string `json:"raw"`
+					} `json:"author"`
+				} `json:"target"`
+			} `json:"new"`
+			Old struct {
+				Name   string `json:"name"`
+				Type   string `json:"type"`
+				Target struct {
+					Hash string `json:"hash"`
+				} `json:"target"`
+			} `json:"old"`
+		} `json:"changes"`
+	} `json:"push"`
+}
+
+func (BitbucketWebhookProvider) Name() string {
+	return "Bitbucket"
+}
+
+func (BitbucketWebhookProvider) Detect(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("User-Agent"), "Bitbucket")
+}
+
+func (BitbucketWebhookProvider) Verify(r *http.Request, body []byte, secret string) bool {
+	return isValidSHA256Signature(r.Header.Get(BitbucketSignatureHeader), secret, body)
+}
+
+func (BitbucketWebhookProvider) Parse(body []byte) (WebhookPush, error) {
+	var payload BitbucketPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return WebhookPush{}, err
+	}
+
+	if len(payload.Push.Changes) == 0 {
+		return WebhookPush{}, errors.New("Bitbucket payload doesn't contain new changes")
+	}
+
+	//Deleted branches and tags have only the old state
+	if payload.Push.Changes[0].New.Name == "" {
+		if payload.Push.Changes[0].Old.Name == "" {
+			return WebhookPush{}, errors.New("Bitbucket payload doesn't contain new changes")
+		}
+		return WebhookPush{IsDeleted: true}, nil
+	}
+
+	change := payload.Push.Changes[0].New
+	var push WebhookPush
+	push.Commit = change.Target.Hash
+	push.Author = change.Target.Author.Raw
+	push.Message = strings.TrimSpace(change.Target.Message)
+	switch change.Type {
+	case "branch":
+		push.Ref = GitRefBranchPrefix + change.Name
+	case "tag":
+		push.Ref = GitRefTagPrefix + change.Name
+	default:
+		return WebhookPush{}, errors.New("Bitbucket payload contains unknown change type " + change.Type)
+	}
+
+	return push, nil
+}
+
+/*GitLab*/
+
+type GitLabWebhookProvider struct{}
+
+type GitLabPayload struct {
+	Ref         string             `json:"ref"`
+	After       string             `json:"after"`
+	CheckoutSha string             `json:"checkout_sha"`
+	Commits     []GitCommitPayload `json:"commits"`
+}
+
+func (GitLabWebhookProvider) Name() string {
+	return "GitLab"
+}
+
+func (GitLabWebhookProvider) Detect(r *http.Request) bool {
+	return r.Header.Get("X-Gitlab-Event") != ""
+}
+
+// GitLab doesn't sign payloads, it sends the secret token as is
+func (GitLabWebhookProvider) Verify(r *http.Request, body []byte, secret string) bool {
+	token := r.Header.Get(GitLabTokenHeader)
+	if secret == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+}
+
+func (GitLabWebhookProvider) Parse(body []byte) (WebhookPush, error) {
+	var payload GitLabPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return WebhookPush{}, err
+	}
+
+	commit := payload.CheckoutSha
+	if commit == "" {
+		commit = payload.After
+	}
+
+	//GitLab has no head_commit, we should find the commit in the list of pushed commits
+	var headCommit GitCommitPayload
+	for _, pushedCommit := range payload.Commits {
+		if pushedCommit.Id == commit {
+			headCommit = pushedCommit
+		}
+	}
+
+	push := newWebhookPush(payload.Ref, commit, headCommit)
+	push.IsDeleted = isDeletedRefCommit(payload.After)
+	return push, nil
+}
+
+/*Gitea and Forgejo*/
+
+type GiteaWebhookProvider struct{}
+
+type GiteaPayload struct {
+	Ref        string           `json:"ref"`
+	After      string           `json:"after"`
+	HeadCommit GitCommitPayload `json:"head_commit"`
+}
+
+func (GiteaWebhookProvider) Name() string {
+	return "Gitea"
+}
+
+func (GiteaWebhookProvider) Detect(r *http.Request) bool {
+	return r.Header.Get("X-Gitea-Event") != "" || r.Header.Get("X-Forgejo-Event") != ""
+}
+
+// Gitea and Forgejo send a hex HMAC-SHA256 signature without "sha256=" prefix
+func (GiteaWebhookProvider) Verify(r *http.Request, body []byte, secret string) bool {
+	signature := r.Header.Get(GiteaSignatureHeader)
+	if signature == "" {
+		signature = r.Header.Get(ForgejoSignatureHeader)
+	}
+	return isValidSHA256Signature("sha256="+signature, secret, body)
+}
+
+func (GiteaWebhookProvider) Parse(body []byte) (WebhookPush, error) {
+	var payload GiteaPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return WebhookPush{}, err
+	}
+
+	push := newWebhookPush(payload.Ref, payload.After, payload.HeadCommit)
+	push.IsDeleted = isDeletedRefCommit(payload.After)
+	return push, nil
+}
+
+/*Generic*/
+
+// Generic webhooks can be sent from any CI, for example:
+// curl -H "X-TurboCloud-Signature: sha256=..." -d '{"ref":"main","commit":"..."}' https://domain/deploy/serviceId
+type GenericWebhookProvider struct{}
+
+type GenericPayload struct {
+	Ref     string `json:"ref"`
+	Commit  string `json:"commit"`
+	Author  string `json:"author"`  //Optional
+	Message string `json:"message"` //Optional
+}
+
+func (GenericWebhookProvider) Name() string {
+	return "Generic"
+}
+
+func (GenericWebhookProvider) Detect(r *http.Request) bool {
+	return true
+}
+
+func (GenericWebhookProvider) Verify(r *http.Request, body []byte, secret string) bool {
+	return isValidSHA256Signature(r.Header.Get(GenericSignatureHeader), secret, body)
+}
+
+func (GenericWebhookProvider) Parse(body []byte) (WebhookPush, error) {
+	var payload GenericPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return WebhookPush{}, err
+	}
+
+	if payload.Ref == "" {
+		return WebhookPush{}, errors.New("generic payload doesn't contain a ref")
+	}
+
+	//A short branch name can be used instead of a full ref
+	ref := payload.Ref
+	if !strings.HasPrefix(ref, "refs/") {
+		ref = GitRefBranchPrefix + ref
+	}
+
+	return WebhookPush{Ref: ref, Commit: payload.Commit, Author: payload.Author, Message: payload.Message}, nil
+}
+
+/*Internal*/
+
+func readWebhookBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1000000)
+	return io.ReadAll(r.Body)
+}
+
+// GitHub and Bitbucket send a signature in format "sha256=hex(HMAC-SHA256(secret, body))"
+func isValidSHA256Signature(signature string, secret string, body []byte) bool {
+	if secret == "" {
+		return false
+	}
+
+	signatureHex, found := strings.CutPrefix(signature, "sha256=")
+	if !found || signatureHex == "" {
+		return false
+	}
+
+	signatureBytes, err := hex.DecodeString(signatureHex)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return hmac.Equal(signatureBytes, mac.Sum(nil))
+}
+
+func rejectWebhook(w http.ResponseWriter, service *Service, reason string) {
+
+	//We don't know an environment before a payload is verified, so we save the log to all environments of the service
+	for _, environment := range loadEnvironmentsByServiceId(service.Id) {
+		var envLog EnvironmentLog
+		envLog.EnvironmentId = environment.Id
+		envLog.Level = "4"
+		envLog.MachineId = thisMachine.Id
+		envLog.Message = "Webhook for service '" + service.Name + "' has been rejected: " + reason
+		saveEnvironmentLog(envLog)
+	}
+
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
